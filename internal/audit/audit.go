@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DecisionAllow Decision = "allow"
+	DecisionDeny  Decision = "deny"
+	DecisionError Decision = "error"
+
+	Redacted = "[REDACTED]"
+)
+
+type Decision string
+
+// Event is the record of an authorization decision
+type Event struct {
+	Time           time.Time `json:"time"`
+	User           string    `json:"user,omitempty"`
+	Email          string    `json:"email,omitempty"`
+	Groups         []string  `json:"groups,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Destination    string    `json:"destination"`
+	Method         string    `json:"method"`
+	Route          string    `json:"route"`
+	Query          string    `json:"query,omitempty"`
+	RewrittenQuery string    `json:"rewrittenQuery,omitempty"`
+	Decision       Decision  `json:"decision"`
+	Reason         string    `json:"reason,omitempty"`
+	Status         int       `json:"status"`
+}
+
+// Sink writes audit events to a destination
+type Sink interface {
+	Write(event Event) error
+	Close() error
+}
+
+// Settings configures the audit log
+type Settings struct {
+	// SampleRate is the fraction of allowed requests that are recorded, denials are always recorded
+	SampleRate float64
+	// Redact lists the event fields that are replaced before being written
+	Redact []string
+}
+
+// Logger records authorization decisions to every configured sink
+type Logger struct {
+	settings Settings
+	sinks    []*lockedSink
+	// mu guards closed, Record holds it for reading so requests are not serialized
+	mu     sync.RWMutex
+	closed bool
+}
+
+// lockedSink serializes the writes to a sink
+// A slow sink only delays the events written to it
+type lockedSink struct {
+	Sink
+	mu sync.Mutex
+}
+
+func (s *lockedSink) Write(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Sink.Write(event)
+}
+
+func New(settings Settings, sinks ...Sink) *Logger {
+	locked := make([]*lockedSink, 0, len(sinks))
+	for _, sink := range sinks {
+		locked = append(locked, &lockedSink{Sink: sink})
+	}
+
+	return &Logger{
+		settings: settings,
+		sinks:    locked,
+	}
+}
+
+// Record writes the event to every sink
+// A nil Logger discards every event
+func (l *Logger) Record(event Event) {
+	if l == nil || len(l.sinks) == 0 {
+		return
+	}
+
+	if event.Decision == DecisionAllow && l.settings.SampleRate < 1 && rand.Float64() >= l.settings.SampleRate {
+		return
+	}
+
+	event = l.redact(event)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	for _, sink := range l.sinks {
+		if err := sink.Write(event); err != nil {
+			log.Printf("failed to write audit event: %v", err)
+		}
+	}
+}
+
+// Close closes every sink, events recorded afterwards are discarded
+// It must be called after the server stopped handling requests so in-flight decisions are recorded
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+
+	log.Println("shutting down audit log")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("failed to close audit sink: %v", err)
+		}
+	}
+}
+
+func (l *Logger) redact(event Event) Event {
+	for _, field := range l.settings.Redact {
+		switch field {
+		case "user":
+			event.User = Redacted
+		case "email":
+			event.Email = Redacted
+		case "groups":
+			event.Groups = []string{Redacted}
+		case "query":
+			event.Query = redactValue(event.Query)
+		case "rewrittenQuery":
+			event.RewrittenQuery = redactValue(event.RewrittenQuery)
+		}
+	}
+
+	return event
+}
+
+func redactValue(value string) string {
+	if value == "" {
+		return value
+	}
+
+	return Redacted
+}
+
+// RedactableFields returns the fields accepted by Settings.Redact
+func RedactableFields() []string {
+	return []string{"user", "email", "groups", "query", "rewrittenQuery"}
+}
+
+// ValidField reports whether the field can be redacted
+func ValidField(field string) bool {
+	return slices.Contains(RedactableFields(), field)
+}
+
+// writerSink writes events as JSON lines
+type writerSink struct {
+	w io.Writer
+}
+
+// NewStdoutSink returns a sink that writes JSON lines to stdout
+func NewStdoutSink() Sink {
+	return &writerSink{w: os.Stdout}
+}
+
+func (s *writerSink) Write(event Event) error {
+	return json.NewEncoder(s.w).Encode(event)
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
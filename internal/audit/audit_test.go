@@ -0,0 +1,182 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink keeps the events in memory and fails writes once closed
+type memorySink struct {
+	events []Event
+	closed bool
+}
+
+func (s *memorySink) Write(event Event) error {
+	if s.closed {
+		panic("write after close")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestLoggerClose(t *testing.T) {
+	sink := &memorySink{}
+	logger := New(Settings{SampleRate: 1}, sink)
+
+	logger.Record(Event{Decision: DecisionAllow})
+	logger.Close()
+	logger.Close()
+
+	// A request still in flight after the shutdown must not reach the closed sinks
+	logger.Record(Event{Decision: DecisionDeny})
+
+	if !sink.closed {
+		t.Error("sink was not closed")
+	}
+	if len(sink.events) != 1 {
+		t.Errorf("got %d events, want 1", len(sink.events))
+	}
+}
+
+// blockingSink blocks its writes until unblock is closed
+type blockingSink struct {
+	started chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func (s *blockingSink) Write(event Event) error {
+	s.once.Do(func() { close(s.started) })
+	<-s.unblock
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestLoggerSlowSink(t *testing.T) {
+	fast := &memorySink{}
+	slow := &blockingSink{started: make(chan struct{}), unblock: make(chan struct{})}
+	logger := New(Settings{SampleRate: 1}, fast, slow)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Record(Event{Decision: DecisionDeny})
+		}()
+	}
+
+	// The second event reaches the fast sink while the first one is still written to the slow sink
+	<-slow.started
+	deadline := time.After(5 * time.Second)
+	for {
+		logger.sinks[0].mu.Lock()
+		written := len(fast.events)
+		logger.sinks[0].mu.Unlock()
+		if written == 2 {
+			break
+		}
+
+		select {
+		case <-deadline:
+			close(slow.unblock)
+			t.Fatalf("got %d events in the fast sink, want 2", written)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	close(slow.unblock)
+	wg.Wait()
+	logger.Close()
+}
+
+func TestLokiSinkClose(t *testing.T) {
+	var mu sync.Mutex
+	pushed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Streams []struct {
+				Values [][2]string `json:"values"`
+			} `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("invalid push payload: %v", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, stream := range payload.Streams {
+			pushed += len(stream.Values)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := NewLokiSink(server.URL, map[string]string{"service_name": "test"})
+
+	// Writes racing with Close must either be queued or fail, never panic
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_ = sink.Write(Event{Time: time.Now(), Decision: DecisionAllow})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(Event{Time: time.Now(), Decision: DecisionDeny}); err == nil {
+		t.Error("write after close did not fail")
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if pushed != 500 {
+		t.Errorf("got %d pushed events, want the 500 events queued before close", pushed)
+	}
+}
+
+func TestLokiSinkWriteDuringClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for i := 0; i < 20; i++ {
+		sink := NewLokiSink(server.URL, nil)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = sink.Write(Event{Time: time.Now(), Decision: DecisionAllow})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			sink.Close()
+		}()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// fileSink writes events as JSON lines to a file
+// The file is rotated once it reaches the maximum size
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// NewFileSink returns a sink that writes JSON lines to path
+// The file is rotated when it grows past maxSize bytes and only maxBackups rotated files are kept
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	s := &fileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+func (s *fileSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+// rotate renames the current file with a timestamp suffix and removes the oldest backups
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	backup := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(s.path, backup); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		backups, err := filepath.Glob(s.path + ".*")
+		if err != nil {
+			return err
+		}
+
+		// timestamps sort lexicographically
+		slices.Sort(backups)
+		for len(backups) > s.maxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				return err
+			}
+			backups = backups[1:]
+		}
+	}
+
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
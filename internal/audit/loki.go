@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	lokiBatchSize     = 100
+	lokiFlushInterval = time.Second
+)
+
+// lokiSink pushes events to a Loki push endpoint in batches
+type lokiSink struct {
+	url    string
+	labels map[string]string
+	client *http.Client
+
+	events chan Event
+	done   chan struct{}
+
+	// mu guards closed so Write never sends on the closed events channel
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewLokiSink returns a sink that pushes events to the Loki push API
+// url is the full push endpoint, e.g. http://loki:3100/loki/api/v1/push
+func NewLokiSink(url string, labels map[string]string) Sink {
+	s := &lokiSink{
+		url:    url,
+		labels: labels,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan Event, lokiBatchSize*10),
+		done:   make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *lokiSink) Write(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("loki audit sink is closed, dropping event")
+	}
+
+	select {
+	case s.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("loki audit sink buffer is full, dropping event")
+	}
+}
+
+func (s *lokiSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(lokiFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, lokiBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.push(batch); err != nil {
+			log.Printf("failed to push audit events to loki: %v", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= lokiBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// push sends the events grouped by decision so it can be used as a stream label
+func (s *lokiSink) push(events []Event) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	streams := map[Decision]*stream{}
+	for _, event := range events {
+		st, ok := streams[event.Decision]
+		if !ok {
+			labels := map[string]string{"decision": string(event.Decision)}
+			for k, v := range s.labels {
+				labels[k] = v
+			}
+			st = &stream{Stream: labels}
+			streams[event.Decision] = st
+		}
+
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(event.Time.UnixNano(), 10), string(line)})
+	}
+
+	payload := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, st := range streams {
+		payload.Streams = append(payload.Streams, st)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("loki returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (s *lokiSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+
+	return nil
+}
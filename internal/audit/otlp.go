@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// otlpSink emits events as OpenTelemetry log records
+// The exporter is configured with the standard OTEL_* environment variables
+type otlpSink struct {
+	provider *sdklog.LoggerProvider
+	logger   otellog.Logger
+}
+
+// NewOTLPSink returns a sink that exports events with the OpenTelemetry logs exporter
+func NewOTLPSink(ctx context.Context) (Sink, error) {
+	exporter, err := autoexport.NewLogExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)))
+
+	return &otlpSink{
+		provider: provider,
+		logger:   provider.Logger("lgtmp-query-gateway/audit"),
+	}, nil
+}
+
+func (s *otlpSink) Write(event Event) error {
+	var record otellog.Record
+	record.SetTimestamp(event.Time)
+	record.SetSeverity(otellog.SeverityInfo)
+	if event.Decision != DecisionAllow {
+		record.SetSeverity(otellog.SeverityWarn)
+	}
+	record.SetBody(otellog.StringValue("authorization " + string(event.Decision)))
+
+	groups := make([]otellog.Value, 0, len(event.Groups))
+	for _, group := range event.Groups {
+		groups = append(groups, otellog.StringValue(group))
+	}
+
+	record.AddAttributes(
+		otellog.String("user", event.User),
+		otellog.String("email", event.Email),
+		otellog.Slice("groups", groups...),
+		otellog.String("tenant", event.Tenant),
+		otellog.String("destination", event.Destination),
+		otellog.String("method", event.Method),
+		otellog.String("route", event.Route),
+		otellog.String("query", event.Query),
+		otellog.String("rewritten_query", event.RewrittenQuery),
+		otellog.String("decision", string(event.Decision)),
+		otellog.String("reason", event.Reason),
+		otellog.Int("status", event.Status),
+	)
+
+	s.logger.Emit(context.Background(), record)
+
+	return nil
+}
+
+func (s *otlpSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	return s.provider.Shutdown(ctx)
+}
@@ -5,13 +5,17 @@ import (
 	"log"
 	"os"
 
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/explain"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/gateway"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/policytest"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/validate"
 	"github.com/urfave/cli/v3"
 )
 
 func Run() error {
 
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	flags := []cli.Flag{
 		&cli.BoolFlag{Name: "verbose", Usage: "Log debug messages"},
@@ -26,6 +30,9 @@ func Run() error {
 		HideVersion: false,
 		Commands: []*cli.Command{
 			gateway.Command(),
+			validate.Command(),
+			explain.Command(),
+			policytest.Command(),
 		},
 		EnableShellCompletion: true,
 	}
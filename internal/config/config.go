@@ -2,67 +2,257 @@ package config
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/google/cel-go/cel"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
-	"gopkg.in/yaml.v3"
 )
 
 const (
 	ModeAllowList Mode = "allowlist"
 	ModeDenyList  Mode = "denylist"
 
+	CostActionReject CostAction = "reject"
+	CostActionWarn   CostAction = "warn"
+
+	RuleEffectAllow RuleEffect = "allow"
+	RuleEffectDeny  RuleEffect = "deny"
+
+	FailureModeOpen   FailureMode = "open"
+	FailureModeClosed FailureMode = "closed"
+
+	MaskActionDrop MaskAction = "drop"
+	MaskActionHash MaskAction = "hash"
+
+	RateLimitUser   RateLimitKey = "user"
+	RateLimitGroup  RateLimitKey = "group"
+	RateLimitTenant RateLimitKey = "tenant"
+
 	StackLoki       StackType = "loki"
 	StackPrometheus StackType = "prometheus"
 	StackMimir      StackType = "mimir"
+	StackCortex     StackType = "cortex"
+	StackThanos     StackType = "thanos"
 	StackTempo      StackType = "tempo"
 	StackPyroscope  StackType = "pyroscope"
 )
 
 type Mode string
+type CostAction string
+type RuleEffect string
+type FailureMode string
+type MaskAction string
+type RateLimitKey string
 type StackType string
 
 // Config represents the root YAML structure
 type Config struct {
-	Destinations map[string]Destination `yaml:",inline"`
+	Destinations map[string]Destination `yaml:",inline" validate:"dive"`
 }
 
 // Destination represents a destination with a map of tenants
 type Destination struct {
-	Type           StackType         `yaml:"type" validate:"required"`
-	Upstream       string            `yaml:"upstream" validate:"required"`
-	AllowUndefined bool              `yaml:"allowUndefined"`
-	Tenants        map[string]Tenant `yaml:"tenants"`
+	Type           StackType `yaml:"type" validate:"required"`
+	Upstream       string    `yaml:"upstream" validate:"required"`
+	AllowUndefined bool      `yaml:"allowUndefined"`
+	PathPrefix     *string   `yaml:"pathPrefix"`
+	// AlertmanagerPathPrefix is where Mimir serves the multi-tenant Alertmanager API
+	AlertmanagerPathPrefix *string           `yaml:"alertmanagerPathPrefix"`
+	Tenants                map[string]Tenant `yaml:"tenants" validate:"dive"`
+	Routes                 RoutePolicy       `yaml:"routes"`
+	RateLimiting           RateLimiting      `yaml:"rateLimiting"`
+	// Timeout bounds the duration of the requests, including the upstream response, they are not bounded when unset
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+	// ExternalAuthz delegates the authorization of the requests to an external decision service
+	ExternalAuthz *ExternalAuthz `yaml:"externalAuthz"`
+
+	// FilterMetadata only returns metadata of metrics that the user can query
+	FilterMetadata   bool          `yaml:"filterMetadata"`
+	MetadataCacheTTL time.Duration `yaml:"metadataCacheTTL"`
+
+	// MaskSecret keys the hashes of the label values masked with the hash action
+	MaskSecret string `yaml:"maskSecret"`
+}
+
+// RoutePolicy controls the routes that are proxied without LBAC enforcement
+// Routes not supported by the gateway are denied unless listed here
+type RoutePolicy struct {
+	// Passthrough lists request paths, a trailing * matches every path with that prefix
+	Passthrough []string `yaml:"passthrough"`
+}
+
+// RateLimiting configures the rate limits of a destination
+type RateLimiting struct {
+	Limits []RateLimit `yaml:"limits" validate:"dive"`
+	// Redis shares the rate limiting state between gateway replicas
+	Redis *RedisSettings `yaml:"redis"`
+}
+
+// RateLimit is a token bucket and concurrency limit applied to every user, group or tenant
+type RateLimit struct {
+	Key RateLimitKey `yaml:"key" validate:"required,oneof=user group tenant"`
+	// Rate is the number of requests per second
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// MaxConcurrent is the maximum number of in-flight requests
+	MaxConcurrent int `yaml:"maxConcurrent"`
+}
+
+// RedisSettings configures the connection to a server compatible with the Redis protocol
+type RedisSettings struct {
+	Address  string `yaml:"address" validate:"required"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// ExternalAuthz configures an external decision service, e.g. OPA
+// Requests are only allowed when both the gateway and the service allow them
+type ExternalAuthz struct {
+	URL     string            `yaml:"url" validate:"required,url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// CacheTTL is how long decisions are cached, they are not cached when unset
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	// FailureMode controls whether requests are allowed (open) or denied (closed) when the service fails
+	FailureMode FailureMode `yaml:"failureMode" validate:"omitempty,oneof=open closed"`
 }
 
 // Tenant represents a tenant with a mode and a list of groups
 type Tenant struct {
 	Mode   Mode    `yaml:"mode" validate:"required,oneof=allowlist denylist"`
-	Groups []Group `yaml:"groups"`
+	Groups []Group `yaml:"groups" validate:"dive"`
+	Roles  Roles   `yaml:"roles"`
+	Limits Limits  `yaml:"limits"`
+	Rules  []Rule  `yaml:"rules" validate:"dive"`
+}
+
+// Limits restricts the queries that can be sent upstream, zero values are unlimited
+type Limits struct {
+	// MaxRange is the maximum time range of a query (end - start)
+	MaxRange time.Duration `yaml:"maxRange"`
+	// MaxLookback is how far back in time a query can start
+	MaxLookback time.Duration `yaml:"maxLookback"`
+	// MinStep is the minimum resolution of range queries
+	MinStep time.Duration `yaml:"minStep"`
+	// MaxLimit is the maximum number of log lines returned by a query
+	MaxLimit int `yaml:"maxLimit"`
+	// MaxRangeVector is the maximum duration of range vectors and subqueries inside the expression
+	MaxRangeVector time.Duration `yaml:"maxRangeVector"`
+}
+
+// Roles maps privileged operations to the token role required to perform them
+type Roles struct {
+	RulerWrite string `yaml:"rulerWrite"`
+	Delete     string `yaml:"delete"`
 }
 
 // Group represents a group
 type Group struct {
-	Name     string   `yaml:"name" validate:"required"`
-	LBAC     []string `yaml:"enforcedLabels"`
+	Name         string       `yaml:"name" validate:"required"`
+	LBAC         []string     `yaml:"enforcedLabels"`
+	HiddenLabels []string     `yaml:"hiddenLabels"`
+	Metrics      MetricFilter `yaml:"metrics"`
+	Limits       Limits       `yaml:"limits"`
+	CostBudget   CostBudget   `yaml:"costBudget"`
+	Forbidden    Forbidden    `yaml:"forbidden"`
+	// Redact rewrites the log lines returned to the users of the group (loki)
+	Redact []Redaction `yaml:"redact"`
+	// MaskLabels hides label values in the results returned to the users of the group
+	MaskLabels LabelMask `yaml:"maskLabels"`
+	// Rules are only evaluated for the users of the group
+	Rules    []Rule `yaml:"rules" validate:"dive"`
 	Matchers []*labels.Matcher
 }
 
+// Rule is a CEL expression evaluated against the user, the request and its query
+// allow rules must be true for the tenant (or group) to apply, deny rules deny the request when true
+// The matchers of the rule are enforced when the expression is true
+type Rule struct {
+	Name       string     `yaml:"name" validate:"required"`
+	Expression string     `yaml:"expression" validate:"required"`
+	Effect     RuleEffect `yaml:"effect" validate:"omitempty,oneof=allow deny"`
+	LBAC       []string   `yaml:"enforcedLabels"`
+
+	Program  cel.Program       `yaml:"-"`
+	Matchers []*labels.Matcher `yaml:"-"`
+}
+
+// Forbidden lists what the queries of a group can not reference
+type Forbidden struct {
+	// Labels can not be selected, filtered, extracted, formatted or grouped by
+	Labels []string `yaml:"labels"`
+	// Stages are LogQL pipeline stages, e.g. json, logfmt or line_format
+	Stages []string `yaml:"stages"`
+	// Functions are PromQL functions and aggregations, e.g. count_values
+	Functions []string `yaml:"functions"`
+}
+
+// LabelMask hides the values of labels in query results, series and label values
+type LabelMask struct {
+	Labels []string `yaml:"labels"`
+	// Action is drop (remove the labels) or hash (replace the values with a hash), defaults to drop
+	Action MaskAction `yaml:"action" validate:"omitempty,oneof=drop hash"`
+	// RequireAggregation denies PromQL queries whose results can have the labels, e.g. sum without(customer_id)
+	RequireAggregation bool `yaml:"requireAggregation"`
+}
+
+// CostBudget limits the estimated cost of the queries of a group
+type CostBudget struct {
+	Max    int        `yaml:"max"`
+	Action CostAction `yaml:"action" validate:"omitempty,oneof=reject warn"`
+}
+
+// MetricFilter restricts the metric names that a group can see and query
+// The filters are lists of metric name patterns, see MetricPattern
+type MetricFilter struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	allow    []MetricPattern
+	deny     []MetricPattern
+	matchers []*labels.Matcher
+}
+
 func LoadConfig(path string) (*Config, error) {
 	// Load the configuration from the specified path
 	// and return a Config struct
+	// path can be a file or a directory of files that are merged
 
-	data, err := os.ReadFile(path)
+	document, err := LoadDocument(path)
 	if err != nil {
 		return nil, err
 	}
 
 	var config Config
-	err = yaml.Unmarshal(data, &config)
+	err = document.Node.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.parseMatchers()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.compileRules()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.compileMetricFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.compileRedactions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.checkMasks()
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +266,89 @@ func LoadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
+// APIPrefix returns the path prefix where the destination serves its query API
+// e.g. Mimir serves the Prometheus API under /prometheus while vanilla Prometheus serves it under /
+func (d Destination) APIPrefix() string {
+	if d.PathPrefix == nil {
+		switch d.Type {
+		case StackLoki:
+			return "/loki"
+		case StackMimir, StackCortex:
+			return "/prometheus"
+		default:
+			// Prometheus and Thanos Query serve the API from the root path
+			return ""
+		}
+	}
+
+	return normalizePrefix(*d.PathPrefix)
+}
+
+// AllowsPassthrough reports whether the path can be proxied without LBAC enforcement
+func (r RoutePolicy) AllowsPassthrough(path string) bool {
+	for _, route := range r.Passthrough {
+		if prefix, ok := strings.CutSuffix(route, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsEmpty reports whether no limit is set
+func (l Limits) IsEmpty() bool {
+	return l == Limits{}
+}
+
+// Merge returns the limits overridden by the values set in o
+func (l Limits) Merge(o Limits) Limits {
+	if o.MaxRange != 0 {
+		l.MaxRange = o.MaxRange
+	}
+	if o.MaxLookback != 0 {
+		l.MaxLookback = o.MaxLookback
+	}
+	if o.MinStep != 0 {
+		l.MinStep = o.MinStep
+	}
+	if o.MaxLimit != 0 {
+		l.MaxLimit = o.MaxLimit
+	}
+	if o.MaxRangeVector != 0 {
+		l.MaxRangeVector = o.MaxRangeVector
+	}
+
+	return l
+}
+
+// AlertmanagerPrefix returns the path prefix where the destination serves the Alertmanager API
+// An empty prefix means that the destination does not serve the Alertmanager API
+func (d Destination) AlertmanagerPrefix() string {
+	if d.AlertmanagerPathPrefix == nil {
+		switch d.Type {
+		case StackMimir, StackCortex:
+			return "/alertmanager"
+		default:
+			return ""
+		}
+	}
+
+	return normalizePrefix(*d.AlertmanagerPathPrefix)
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	return prefix
+}
+
 func (g *Group) UnmarshalYAML(unmarshal func(any) error) error {
 	// create an alias to avoid infinite recursion
 	type Alias Group
@@ -85,23 +358,9 @@ func (g *Group) UnmarshalYAML(unmarshal func(any) error) error {
 		return err
 	}
 
-	//TODO: find a way to copy values from aux to g automatically
-	g.LBAC = aux.LBAC
-	g.Name = aux.Name
-	g.Matchers = make([]*labels.Matcher, 0, len(aux.LBAC))
+	*g = Group(aux)
 
-	for _, matcher := range aux.LBAC {
-		str := matcher
-		if !strings.HasPrefix(str, "{") {
-			str = "{" + str + "}"
-		}
-		m, err := parser.ParseMetricSelector(str)
-		if err != nil {
-			log.Printf("failed to parse matcher %s: %v", matcher, err)
-			return fmt.Errorf("failed to parse matcher %s: %w", matcher, err)
-		}
-		g.Matchers = append(g.Matchers, m...)
-	}
+	// The matchers are parsed once the query language of the destination is known
 	return nil
 }
 
@@ -133,6 +392,10 @@ func (s *StackType) UnmarshalYAML(unmarshal func(any) error) error {
 		*s = StackPrometheus
 	case string(StackMimir):
 		*s = StackMimir
+	case string(StackCortex):
+		*s = StackCortex
+	case string(StackThanos):
+		*s = StackThanos
 	case string(StackTempo):
 		*s = StackTempo
 	case string(StackPyroscope):
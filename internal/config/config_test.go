@@ -0,0 +1,116 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigValidatesNestedSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		invalid string
+	}{
+		{
+			name: "valid",
+			config: `
+"localhost:9000":
+  type: loki
+  upstream: http://localhost:3100
+  rateLimiting:
+    limits:
+      - key: user
+        rate: 10
+  tenants:
+    t1:
+      mode: allowlist
+      groups:
+        - name: team-a
+          costBudget:
+            max: 100
+            action: warn
+`,
+		},
+		{
+			name: "invalid rate limit key",
+			config: `
+"localhost:9000":
+  type: loki
+  upstream: http://localhost:3100
+  rateLimiting:
+    limits:
+      - key: bogus
+        rate: 10
+`,
+			invalid: "Key",
+		},
+		{
+			name: "invalid cost action",
+			config: `
+"localhost:9000":
+  type: loki
+  upstream: http://localhost:3100
+  tenants:
+    t1:
+      mode: allowlist
+      groups:
+        - name: team-a
+          costBudget:
+            max: 100
+            action: explode
+`,
+			invalid: "Action",
+		},
+		{
+			name: "invalid failure mode",
+			config: `
+"localhost:9000":
+  type: mimir
+  upstream: http://localhost:9009
+  externalAuthz:
+    url: http://authz:8080
+    failureMode: sometimes
+`,
+			invalid: "FailureMode",
+		},
+		{
+			name: "hashed labels without secret",
+			config: `
+"localhost:9000":
+  type: mimir
+  upstream: http://localhost:9009
+  tenants:
+    t1:
+      mode: allowlist
+      groups:
+        - name: team-a
+          maskLabels:
+            labels: [customer_id]
+            action: hash
+`,
+			invalid: "maskSecret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadConfig(path)
+			if tt.invalid == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.invalid) {
+				t.Fatalf("got %v, want an error about %s", err, tt.invalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// origin is where a key was defined
+type origin struct {
+	file string
+	line int
+}
+
+func (o origin) String() string {
+	return fmt.Sprintf("%s:%d", o.file, o.line)
+}
+
+// mergedDestination accumulates the definition of a destination across files
+type mergedDestination struct {
+	node    *yaml.Node
+	tenants *yaml.Node
+	keys    map[string]origin
+}
+
+// Files returns the configuration files of path
+// path can be a single file or a directory, in which case every YAML file in it is returned
+// Hidden files are skipped, this includes the ..data directory of Kubernetes ConfigMap volumes
+func Files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !IsConfigFile(name) {
+			continue
+		}
+
+		// ConfigMap volumes are symlinks to the files, the entry type is not enough
+		if info, err := os.Stat(filepath.Join(path, name)); err != nil || info.IsDir() {
+			continue
+		}
+
+		files = append(files, filepath.Join(path, name))
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no configuration files found in %s", path)
+	}
+
+	slices.Sort(files)
+
+	return files, nil
+}
+
+// IsConfigFile reports whether the file name has a YAML extension
+func IsConfigFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Document is the configuration merged from every file
+type Document struct {
+	Node *yaml.Node
+	// files maps the destination, setting and tenant keys to the file that defined them
+	files map[*yaml.Node]string
+}
+
+// File returns the file that defined the key node
+func (d *Document) File(key *yaml.Node) string {
+	return d.files[key]
+}
+
+// LoadDocument reads the configuration files of path and merges them into a single document
+// Destinations can be split across files, e.g. one file with the destination settings and
+// one file per team with its tenants, but each setting and tenant must be defined only once
+func LoadDocument(path string) (*Document, error) {
+	files, err := Files(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := &Document{files: map[*yaml.Node]string{}}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	destinations := map[string]*mergedDestination{}
+	hosts := map[string]origin{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var doc yaml.Node
+		err = yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		if len(doc.Content) == 0 {
+			// empty file
+			continue
+		}
+
+		node := resolve(doc.Content[0])
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s:%d: expected a mapping of destinations", file, node.Line)
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], resolve(node.Content[i+1])
+			host := key.Value
+
+			if value.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("%s:%d: destination %q must be a mapping", file, key.Line, host)
+			}
+
+			destination, ok := destinations[host]
+			if !ok {
+				destination = &mergedDestination{
+					node: &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: value.Line, Column: value.Column},
+					keys: map[string]origin{},
+				}
+				destinations[host] = destination
+				hosts[host] = origin{file: file, line: key.Line}
+				root.Content = append(root.Content, key, destination.node)
+				document.files[key] = file
+			}
+
+			err = destination.merge(document, file, host, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	document.Node = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+
+	return document, nil
+}
+
+// merge adds the settings and tenants of a destination defined in file
+func (d *mergedDestination) merge(document *Document, file, host string, node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolve(node.Content[i+1])
+		current := origin{file: file, line: key.Line}
+
+		if key.Value == "tenants" {
+			// Tenants are only merged when every file defines them as a mapping, e.g. not null
+			previous, ok := d.keys["tenants"]
+			if ok && (value.Kind != yaml.MappingNode || d.tenants == nil) {
+				return fmt.Errorf("%s: tenants of destination %q must be a mapping to be merged with the tenants defined in %s",
+					current, host, previous)
+			}
+			if !ok {
+				d.keys["tenants"] = current
+			}
+
+			if value.Kind != yaml.MappingNode {
+				// Reported by the validation unless it is null
+				document.files[key] = file
+				d.node.Content = append(d.node.Content, key, value)
+				continue
+			}
+
+			if d.tenants == nil {
+				d.tenants = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: value.Line, Column: value.Column}
+				d.node.Content = append(d.node.Content, key, d.tenants)
+			}
+
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				tenant := value.Content[j]
+				name := "tenants." + tenant.Value
+				if previous, ok := d.keys[name]; ok {
+					return fmt.Errorf("%s:%d: tenant %q of destination %q is already defined in %s",
+						file, tenant.Line, tenant.Value, host, previous)
+				}
+				d.keys[name] = origin{file: file, line: tenant.Line}
+				document.files[tenant] = file
+				d.tenants.Content = append(d.tenants.Content, tenant, value.Content[j+1])
+			}
+
+			continue
+		}
+
+		if previous, ok := d.keys[key.Value]; ok {
+			return fmt.Errorf("%s: setting %q of destination %q is already defined in %s",
+				current, key.Value, host, previous)
+		}
+		d.keys[key.Value] = current
+		document.files[key] = file
+		d.node.Content = append(d.node.Content, key, value)
+	}
+
+	return nil
+}
+
+// resolve returns the node referenced by an alias
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	return node
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files in a new directory and returns its path
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestLoadConfigDirectory(t *testing.T) {
+	settings := `
+"localhost:9000":
+  type: loki
+  upstream: http://localhost:3100
+`
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		tenants []string
+		err     string
+	}{
+		{
+			name: "tenants split across files",
+			files: map[string]string{
+				"00-destination.yaml": settings,
+				"team-a.yaml":         "\"localhost:9000\":\n  tenants:\n    a:\n      mode: allowlist\n",
+				"team-b.yml":          "\"localhost:9000\":\n  tenants:\n    b:\n      mode: allowlist\n",
+			},
+			tenants: []string{"a", "b"},
+		},
+		{
+			name: "hidden, empty and other files are skipped",
+			files: map[string]string{
+				"destination.yaml": settings,
+				"empty.yaml":       "",
+				".team-a.yaml":     "\"localhost:9000\":\n  tenants:\n    a:\n      mode: allowlist\n",
+				"README.md":        "# not a configuration file",
+			},
+			tenants: []string{},
+		},
+		{
+			name: "tenant defined twice",
+			files: map[string]string{
+				"a.yaml": settings + "  tenants:\n    a:\n      mode: allowlist\n",
+				"b.yaml": "\"localhost:9000\":\n  tenants:\n    a:\n      mode: denylist\n",
+			},
+			err: `b.yaml:3: tenant "a" of destination "localhost:9000" is already defined in`,
+		},
+		{
+			// Files are merged in name order, the error points to the later file
+			name: "setting defined twice",
+			files: map[string]string{
+				"b.yaml": settings,
+				"a.yaml": "\"localhost:9000\":\n  upstream: http://loki:3100\n",
+			},
+			err: `b.yaml:4: setting "upstream" of destination "localhost:9000" is already defined in`,
+		},
+		{
+			name: "null tenants before a mapping",
+			files: map[string]string{
+				"a.yaml": settings + "  tenants:\n",
+				"b.yaml": "\"localhost:9000\":\n  tenants:\n    a:\n      mode: allowlist\n",
+			},
+			err: `b.yaml:2: tenants of destination "localhost:9000" must be a mapping`,
+		},
+		{
+			name: "null tenants after a mapping",
+			files: map[string]string{
+				"a.yaml": settings + "  tenants:\n    a:\n      mode: allowlist\n",
+				"b.yaml": "\"localhost:9000\":\n  tenants: null\n",
+			},
+			err: `b.yaml:2: tenants of destination "localhost:9000" must be a mapping`,
+		},
+		{
+			name: "list of tenants after a mapping",
+			files: map[string]string{
+				"a.yaml": settings + "  tenants:\n    a:\n      mode: allowlist\n",
+				"b.yaml": "\"localhost:9000\":\n  tenants: [b]\n",
+			},
+			err: `b.yaml:2: tenants of destination "localhost:9000" must be a mapping`,
+		},
+		{
+			name: "null tenants in a single file",
+			files: map[string]string{
+				"a.yaml": settings + "  tenants:\n",
+			},
+			tenants: []string{},
+		},
+		{
+			name: "destination is not a mapping",
+			files: map[string]string{
+				"a.yaml": settings,
+				"b.yaml": "\"localhost:9000\": null\n",
+			},
+			err: `b.yaml:1: destination "localhost:9000" must be a mapping`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeFiles(t, tt.files))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tenants := make([]string, 0)
+			for name := range cfg.Destinations["localhost:9000"].Tenants {
+				tenants = append(tenants, name)
+			}
+			slices.Sort(tenants)
+			if !slices.Equal(tenants, tt.tenants) {
+				t.Errorf("got tenants %v, want %v", tenants, tt.tenants)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package config
+
+import "fmt"
+
+// checkMasks checks that the destinations whose groups hash label values have a secret
+// Unkeyed hashes of values from a small set can be reversed by hashing every candidate
+func (c *Config) checkMasks() error {
+	for host, destination := range c.Destinations {
+		if destination.MaskSecret != "" {
+			continue
+		}
+
+		for name, tenant := range destination.Tenants {
+			for _, group := range tenant.Groups {
+				if group.MaskLabels.Action == MaskActionHash {
+					return fmt.Errorf("destination %s: tenant %s: group %s: maskLabels: the hash action requires the maskSecret of the destination", host, name, group.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// traceQLMatcher matches a TraceQL attribute comparison, e.g. resource.service.name = "api"
+var traceQLMatcher = regexp.MustCompile(`^\s*((?:resource|span|event|link|instrumentation)?\.[A-Za-z0-9_.:/-]+)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*$`)
+
+// StackTypes returns every supported stack type
+func StackTypes() []StackType {
+	return []StackType{StackLoki, StackPrometheus, StackMimir, StackCortex, StackThanos, StackTempo, StackPyroscope}
+}
+
+// ParseMatchers parses an enforced label of a group with the query language of the stack
+// PromQL and LogQL matchers can be written with or without braces, e.g. team="a" or {team="a"}
+func ParseMatchers(stack StackType, matcher string) ([]*labels.Matcher, error) {
+	if stack == StackTempo {
+		return parseTraceQLMatcher(matcher)
+	}
+
+	str := matcher
+	if !strings.HasPrefix(str, "{") {
+		str = "{" + str + "}"
+	}
+
+	switch stack {
+	case StackLoki:
+		// Selectors that match the empty string are valid as enforced labels, they are never sent alone
+		return syntax.ParseMatchers(str, false)
+	default:
+		return parser.ParseMetricSelector(str)
+	}
+}
+
+// parseTraceQLMatcher parses a TraceQL attribute comparison, only one comparison is allowed
+func parseTraceQLMatcher(matcher string) ([]*labels.Matcher, error) {
+	parts := traceQLMatcher.FindStringSubmatch(matcher)
+	if parts == nil {
+		return nil, fmt.Errorf(`expected a TraceQL attribute comparison, e.g. resource.service.name = "api"`)
+	}
+
+	value, err := strconv.Unquote(parts[3])
+	if err != nil {
+		return nil, err
+	}
+
+	var matchType labels.MatchType
+	switch parts[2] {
+	case "=":
+		matchType = labels.MatchEqual
+	case "!=":
+		matchType = labels.MatchNotEqual
+	case "=~":
+		matchType = labels.MatchRegexp
+	case "!~":
+		matchType = labels.MatchNotRegexp
+	}
+
+	m, err := labels.NewMatcher(matchType, parts[1], value)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*labels.Matcher{m}, nil
+}
+
+// parseMatchers parses the enforced labels of every group with the query language of its destination
+func (c *Config) parseMatchers() error {
+	for host, destination := range c.Destinations {
+		for name, tenant := range destination.Tenants {
+			for i, group := range tenant.Groups {
+				group.Matchers = make([]*labels.Matcher, 0, len(group.LBAC))
+
+				for _, matcher := range group.LBAC {
+					m, err := ParseMatchers(destination.Type, matcher)
+					if err != nil {
+						log.Printf("failed to parse matcher %s: %v", matcher, err)
+						return fmt.Errorf("destination %s: tenant %s: group %s: failed to parse matcher %s: %w",
+							host, name, group.Name, matcher, err)
+					}
+					group.Matchers = append(group.Matchers, m...)
+				}
+
+				tenant.Groups[i] = group
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// MetricPattern matches metric names
+// It is either an exact name, a prefix ending with * (e.g. node_*) or a regular expression between slashes (e.g. /.*_billing_.*/)
+type MetricPattern struct {
+	exact  string
+	prefix string
+	regex  *regexp.Regexp
+	// source is the regular expression as written in the configuration
+	source string
+}
+
+// ParseMetricPattern parses a metric name pattern, regular expressions are fully anchored like PromQL matchers
+func ParseMetricPattern(pattern string) (MetricPattern, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return MetricPattern{}, fmt.Errorf("invalid metric name regex %s: %w", pattern, err)
+		}
+		return MetricPattern{regex: re, source: pattern[1 : len(pattern)-1]}, nil
+	}
+
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return MetricPattern{prefix: prefix}, nil
+	}
+
+	if pattern == "" {
+		return MetricPattern{}, fmt.Errorf("empty metric name pattern")
+	}
+
+	return MetricPattern{exact: pattern}, nil
+}
+
+// Matches reports whether the metric name matches the pattern
+func (p MetricPattern) Matches(name string) bool {
+	switch {
+	case p.regex != nil:
+		return p.regex.MatchString(name)
+	case p.exact != "":
+		return name == p.exact
+	default:
+		return strings.HasPrefix(name, p.prefix)
+	}
+}
+
+// regexString returns the pattern as a PromQL regular expression
+func (p MetricPattern) regexString() string {
+	switch {
+	case p.regex != nil:
+		return p.source
+	case p.exact != "":
+		return regexp.QuoteMeta(p.exact)
+	default:
+		return regexp.QuoteMeta(p.prefix) + ".*"
+	}
+}
+
+// Compile parses the patterns of the filter and builds the matchers that enforce it
+func (f *MetricFilter) Compile() error {
+	f.allow = make([]MetricPattern, 0, len(f.Allow))
+	for _, pattern := range f.Allow {
+		p, err := ParseMetricPattern(pattern)
+		if err != nil {
+			return err
+		}
+		f.allow = append(f.allow, p)
+	}
+
+	f.deny = make([]MetricPattern, 0, len(f.Deny))
+	for _, pattern := range f.Deny {
+		p, err := ParseMetricPattern(pattern)
+		if err != nil {
+			return err
+		}
+		f.deny = append(f.deny, p)
+	}
+
+	f.matchers = make([]*labels.Matcher, 0, 2)
+	if len(f.allow) > 0 {
+		m, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, alternatives(f.allow))
+		if err != nil {
+			return err
+		}
+		f.matchers = append(f.matchers, m)
+	}
+	if len(f.deny) > 0 {
+		m, err := labels.NewMatcher(labels.MatchNotRegexp, labels.MetricName, alternatives(f.deny))
+		if err != nil {
+			return err
+		}
+		f.matchers = append(f.matchers, m)
+	}
+
+	return nil
+}
+
+// alternatives returns a regular expression that matches any of the patterns
+func alternatives(patterns []MetricPattern) string {
+	parts := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		parts = append(parts, "(?:"+p.regexString()+")")
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// Allows reports whether the metric name passes the filter
+func (f MetricFilter) Allows(name string) bool {
+	if len(f.allow) > 0 && !matchesAny(f.allow, name) {
+		return false
+	}
+
+	return !matchesAny(f.deny, name)
+}
+
+func matchesAny(patterns []MetricPattern, name string) bool {
+	for _, p := range patterns {
+		if p.Matches(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsEmpty reports whether the filter has no rules
+func (f MetricFilter) IsEmpty() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
+
+// Matchers returns the __name__ matchers that only select the metrics allowed by the filter
+func (f MetricFilter) Matchers() []*labels.Matcher {
+	return f.matchers
+}
+
+// compileMetricFilters compiles the metric filters of every group
+func (c *Config) compileMetricFilters() error {
+	for host, destination := range c.Destinations {
+		for name, tenant := range destination.Tenants {
+			for i := range tenant.Groups {
+				group := &tenant.Groups[i]
+				err := group.Metrics.Compile()
+				if err != nil {
+					return fmt.Errorf("destination %s: tenant %s: group %s: %w", host, name, group.Name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
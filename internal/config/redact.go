@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/grafana/loki/v3/pkg/logql/log"
+)
+
+// DefaultRedactionReplacement replaces the matches of a redaction pattern without replacement
+const DefaultRedactionReplacement = "[REDACTED]"
+
+// Redaction rewrites the log lines returned to the users of a group
+// Exactly one of Pattern, LineFormat or LabelFormat must be set
+type Redaction struct {
+	// Pattern is a regular expression whose matches are replaced, the replacement can reference its groups (e.g. $1)
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	// LineFormat replaces the line with a LogQL line_format template
+	LineFormat string `yaml:"lineFormat"`
+	// LabelFormat sets stream labels with LogQL label_format templates, they can only reference the stream labels
+	LabelFormat map[string]string `yaml:"labelFormat"`
+
+	Regexp *regexp.Regexp `yaml:"-"`
+}
+
+// LabelFmts returns the label_format expressions of the redaction
+func (r Redaction) LabelFmts() []log.LabelFmt {
+	fmts := make([]log.LabelFmt, 0, len(r.LabelFormat))
+	for name, template := range r.LabelFormat {
+		fmts = append(fmts, log.NewTemplateLabelFmt(name, template))
+	}
+
+	return fmts
+}
+
+// compileRedactions compiles the redaction patterns and checks the templates of every group
+// The templates are not kept, LogQL formatters can not be shared between requests
+func (c *Config) compileRedactions() error {
+	for host, destination := range c.Destinations {
+		for name, tenant := range destination.Tenants {
+			for _, group := range tenant.Groups {
+				for i := range group.Redact {
+					err := group.Redact[i].Compile()
+					if err != nil {
+						return fmt.Errorf("destination %s: tenant %s: group %s: redaction %d: %w", host, name, group.Name, i, err)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Compile compiles the pattern and checks the templates of the redaction
+func (r *Redaction) Compile() error {
+	set := 0
+	for _, ok := range []bool{r.Pattern != "", r.LineFormat != "", len(r.LabelFormat) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of pattern, lineFormat or labelFormat must be set")
+	}
+
+	switch {
+	case r.Pattern != "":
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.Regexp = re
+
+		if r.Replacement == "" {
+			r.Replacement = DefaultRedactionReplacement
+		}
+
+	case r.LineFormat != "":
+		if _, err := log.NewFormatter(r.LineFormat); err != nil {
+			return err
+		}
+
+	default:
+		if _, err := log.NewLabelsFormatter(r.LabelFmts()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/policy"
+)
+
+// compileRules compiles the rules of every tenant and group
+func (c *Config) compileRules() error {
+	for host, destination := range c.Destinations {
+		for name, tenant := range destination.Tenants {
+			err := compileRules(destination.Type, tenant.Rules)
+			if err != nil {
+				return fmt.Errorf("destination %s: tenant %s: %w", host, name, err)
+			}
+
+			for _, group := range tenant.Groups {
+				err := compileRules(destination.Type, group.Rules)
+				if err != nil {
+					return fmt.Errorf("destination %s: tenant %s: group %s: %w", host, name, group.Name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func compileRules(stack StackType, rules []Rule) error {
+	for i := range rules {
+		rule := &rules[i]
+
+		switch rule.Effect {
+		case "", RuleEffectAllow, RuleEffectDeny:
+		default:
+			return fmt.Errorf("rule %s: invalid effect %s", rule.Name, rule.Effect)
+		}
+
+		if rule.Effect == "" && len(rule.LBAC) == 0 {
+			return fmt.Errorf("rule %s: a rule without effect must have enforcedLabels", rule.Name)
+		}
+
+		program, err := policy.Compile(rule.Expression)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		rule.Program = program
+
+		for _, matcher := range rule.LBAC {
+			m, err := ParseMatchers(stack, matcher)
+			if err != nil {
+				return fmt.Errorf("rule %s: failed to parse matcher %s: %w", rule.Name, matcher, err)
+			}
+			rule.Matchers = append(rule.Matchers, m...)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package explain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/gateway"
+	"github.com/urfave/cli/v3"
+)
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "explain",
+		Usage:  "Show how the gateway authorizes and rewrites a request for a user",
+		Action: Explain,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to the configuration file or to a directory of configuration files",
+				Aliases: []string{"f"},
+				Sources: cli.EnvVars("CONFIG"),
+				Value:   "config.yaml",
+			},
+			&cli.StringFlag{
+				Name:     "host",
+				Usage:    "Destination host, as sent in the Host header",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tenant",
+				Usage:    "Tenant, as sent in the X-Scope-OrgID header",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "method",
+				Usage: "HTTP method of the request",
+				Value: "GET",
+			},
+			&cli.StringFlag{
+				Name:     "route",
+				Usage:    "Path of the request, e.g. /loki/api/v1/query_range",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "query",
+				Usage: "Query of the request, sent as the query parameter",
+			},
+			&cli.StringSliceFlag{
+				Name:  "param",
+				Usage: "Other request parameter as name=value, can be repeated, e.g. match[]={job=\"api\"}",
+			},
+			&cli.StringFlag{
+				Name:  "token",
+				Usage: "ID token to take the claims from, the token is decoded but not validated",
+			},
+			&cli.StringSliceFlag{
+				Name:  "group",
+				Usage: "Group of the user, can be repeated",
+			},
+			&cli.StringSliceFlag{
+				Name:  "role",
+				Usage: "Role of the user, can be repeated",
+			},
+			&cli.StringFlag{
+				Name:  "email",
+				Usage: "Email of the user",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format (text, json)",
+				Value: "text",
+			},
+		},
+	}
+}
+
+func Explain(ctx context.Context, c *cli.Command) error {
+	cfg, err := config.LoadConfig(c.String("config"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	claims := gateway.Claims{}
+	if token := c.String("token"); token != "" {
+		claims, err = gateway.DecodeToken(token)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("invalid token: %v", err), 1)
+		}
+	}
+	claims.Groups = append(claims.Groups, c.StringSlice("group")...)
+	claims.Roles = append(claims.Roles, c.StringSlice("role")...)
+	if email := c.String("email"); email != "" {
+		claims.Email = email
+	}
+
+	params := url.Values{}
+	if query := c.String("query"); query != "" {
+		params.Set("query", query)
+	}
+	for _, param := range c.StringSlice("param") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return cli.Exit(fmt.Sprintf("invalid parameter %q, expected name=value", param), 1)
+		}
+		params.Add(name, value)
+	}
+
+	explanation, err := gateway.Explain(cfg, gateway.ExplainRequest{
+		Host:   c.String("host"),
+		Tenant: c.String("tenant"),
+		Method: strings.ToUpper(c.String("method")),
+		Path:   c.String("route"),
+		Params: params,
+		Claims: claims,
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if c.String("output") == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(explanation)
+	}
+
+	fmt.Printf("decision:        %s (%d)\n", explanation.Decision, explanation.Status)
+	if explanation.Reason != "" {
+		fmt.Printf("reason:          %s\n", explanation.Reason)
+	}
+	fmt.Printf("groups:          %s\n", strings.Join(explanation.Groups, ", "))
+	fmt.Printf("matchers:        %s\n", strings.Join(explanation.Matchers, ", "))
+	if explanation.Query != "" {
+		fmt.Printf("query:           %s\n", explanation.Query)
+	}
+	if explanation.RewrittenQuery != "" {
+		fmt.Printf("rewritten query: %s\n", explanation.RewrittenQuery)
+	}
+	if explanation.Upstream != "" {
+		fmt.Printf("upstream:        %s\n", explanation.Upstream)
+	}
+	if explanation.Body != "" {
+		fmt.Printf("body:            %s\n", explanation.Body)
+	}
+	if explanation.ResponseFiltered {
+		fmt.Println("response:        filtered by the gateway")
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package extauthz
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/policy"
+)
+
+const (
+	defaultTimeout = time.Second
+
+	// maxResponseSize limits the decisions read from the service
+	maxResponseSize = 1 << 20
+
+	// maxCacheEntries bounds the cached decisions, the least recently used are evicted first
+	maxCacheEntries = 10000
+)
+
+// ErrUnavailable is returned when the service can not be reached or does not answer with a decision
+// Only these failures are allowed in the open failure mode
+var ErrUnavailable = errors.New("external authorization unavailable")
+
+// Decision is the answer of the decision service
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	// Matchers are enforced in addition to the matchers of the groups of the user
+	Matchers []string `json:"matchers"`
+}
+
+// request is the body sent to the service, OPA expects the input under the "input" key
+type request struct {
+	Input policy.Input `json:"input"`
+}
+
+// response accepts both the OPA data API response ({"result": {...}}) and a bare decision
+// A missing result, e.g. an undefined OPA rule, is a denial
+type response struct {
+	Result *Decision `json:"result"`
+	Decision
+}
+
+// Client asks an external decision service to authorize the requests
+type Client struct {
+	url        string
+	headers    map[string]string
+	cacheTTL   time.Duration
+	failOpen   bool
+	httpClient *http.Client
+
+	mu sync.Mutex
+	// cache holds the decisions by input, order lists them from the most recently used
+	cache map[string]*list.Element
+	order *list.List
+}
+
+type cacheEntry struct {
+	key      string
+	decision *Decision
+	expires  time.Time
+}
+
+// New returns a client of the decision service
+func New(settings config.ExternalAuthz) (*Client, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid external authorization url %q", settings.URL)
+	}
+
+	switch settings.FailureMode {
+	case "", config.FailureModeOpen, config.FailureModeClosed:
+	default:
+		return nil, fmt.Errorf("invalid external authorization failure mode %q, available options: open, closed", settings.FailureMode)
+	}
+
+	timeout := settings.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	return &Client{
+		url:        settings.URL,
+		headers:    settings.Headers,
+		cacheTTL:   settings.CacheTTL,
+		failOpen:   settings.FailureMode == config.FailureModeOpen,
+		httpClient: &http.Client{Timeout: timeout},
+		cache:      map[string]*list.Element{},
+		order:      list.New(),
+	}, nil
+}
+
+// FailOpen reports whether requests are allowed when the service fails
+func (c *Client) FailOpen() bool {
+	return c.failOpen
+}
+
+// Decide returns the decision of the service for the input
+// The returned bool is true when the decision was cached
+func (c *Client) Decide(ctx context.Context, input policy.Input) (*Decision, bool, error) {
+	key, err := cacheKey(input)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if decision, ok := c.get(key); ok {
+		return decision, true, nil
+	}
+
+	body, err := json.Marshal(request{Input: input})
+	if err != nil {
+		return nil, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%w: service returned %s", ErrUnavailable, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	var r response
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, false, fmt.Errorf("invalid external authorization response: %w", err)
+	}
+
+	decision := &r.Decision
+	if r.Result != nil {
+		decision = r.Result
+	}
+
+	c.set(key, decision)
+
+	return decision, false, nil
+}
+
+// cacheKey identifies the decisions that can be reused
+// The time of the request is ignored, otherwise decisions would never be reused
+func cacheKey(input policy.Input) (string, error) {
+	input.Request.Time = time.Time{}
+
+	key, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+func (c *Client) get(key string) (*Decision, bool) {
+	if c.cacheTTL <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.cache[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.cache, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return entry.decision, true
+}
+
+func (c *Client) set(key string, decision *Decision) {
+	if c.cacheTTL <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, decision: decision, expires: time.Now().Add(c.cacheTTL)}
+	if element, ok := c.cache[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.cache[key] = c.order.PushFront(entry)
+
+	// Expired entries are evicted when they are looked up or once they are the least recently used
+	for c.order.Len() > maxCacheEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.cache, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,167 @@
+package extauthz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/policy"
+)
+
+// stub returns a decision service that answers every request with the status and body
+func stub(t *testing.T, status int, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		allow       bool
+		matchers    int
+		unavailable bool
+		invalid     bool
+	}{
+		{name: "bare decision", status: http.StatusOK, body: `{"allow": true, "matchers": ["team=\"a\""]}`, allow: true, matchers: 1},
+		{name: "OPA result", status: http.StatusOK, body: `{"result": {"allow": true}}`, allow: true},
+		{name: "undefined OPA rule", status: http.StatusOK, body: `{}`},
+		{name: "server error", status: http.StatusInternalServerError, unavailable: true},
+		{name: "invalid response", status: http.StatusOK, body: `allow`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := stub(t, tt.status, tt.body)
+			client, err := New(config.ExternalAuthz{URL: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decision, _, err := client.Decide(context.Background(), policy.Input{})
+			switch {
+			case tt.unavailable:
+				if !errors.Is(err, ErrUnavailable) {
+					t.Fatalf("got %v, want an unavailable error", err)
+				}
+				return
+			case tt.invalid:
+				if err == nil || errors.Is(err, ErrUnavailable) {
+					t.Fatalf("got %v, want an invalid response error", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if decision.Allow != tt.allow || len(decision.Matchers) != tt.matchers {
+				t.Errorf("got decision %+v", decision)
+			}
+		})
+	}
+}
+
+func TestDecideUnreachable(t *testing.T) {
+	server, _ := stub(t, http.StatusOK, `{"allow": true}`)
+	server.Close()
+
+	client, err := New(config.ExternalAuthz{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.Decide(context.Background(), policy.Input{}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v, want an unavailable error", err)
+	}
+}
+
+func TestDecideCache(t *testing.T) {
+	server, calls := stub(t, http.StatusOK, `{"allow": true}`)
+	client, err := New(config.ExternalAuthz{URL: server.URL, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := policy.Input{User: policy.User{Name: "alice"}, Request: policy.Request{Time: time.Now()}}
+	bob := policy.Input{User: policy.User{Name: "bob"}}
+
+	if _, cached, _ := client.Decide(context.Background(), alice); cached {
+		t.Error("first decision was cached")
+	}
+
+	// The request time is not part of the key
+	alice.Request.Time = time.Now().Add(time.Second)
+	if _, cached, _ := client.Decide(context.Background(), alice); !cached {
+		t.Error("second decision was not cached")
+	}
+
+	if _, cached, _ := client.Decide(context.Background(), bob); cached {
+		t.Error("decision of another user was cached")
+	}
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+}
+
+func TestCacheBounded(t *testing.T) {
+	client, err := New(config.ExternalAuthz{URL: "http://authz", CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxCacheEntries; i++ {
+		client.set(fmt.Sprint(i), &Decision{Allow: true})
+	}
+
+	// The first entry is used again, the second one is the least recently used
+	if _, ok := client.get("0"); !ok {
+		t.Fatal("entry 0 is not cached")
+	}
+	client.set("new", &Decision{Allow: true})
+
+	if len(client.cache) != maxCacheEntries || client.order.Len() != maxCacheEntries {
+		t.Errorf("got %d cached entries, want %d", len(client.cache), maxCacheEntries)
+	}
+	if _, ok := client.get("1"); ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	for _, key := range []string{"0", "new"} {
+		if _, ok := client.get(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	client, err := New(config.ExternalAuthz{URL: "http://authz", CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.set("expired", &Decision{Allow: true})
+	client.cache["expired"].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+
+	if _, ok := client.get("expired"); ok {
+		t.Error("expired entry was returned")
+	}
+	if len(client.cache) != 0 || client.order.Len() != 0 {
+		t.Error("expired entry was not removed")
+	}
+}
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkFile   = "file"
+	AuditSinkOTLP   = "otlp"
+	AuditSinkLoki   = "loki"
+)
+
+// queryParameters are the request parameters that carry a query or selector
+var queryParameters = []string{"query", "match[]", "match", "selector"}
+
+// newAuditLogger returns the audit logger configured by the command flags
+// It returns nil when no sink is configured
+func newAuditLogger(ctx context.Context, c *cli.Command) (*audit.Logger, error) {
+	sinks := make([]audit.Sink, 0)
+	for _, name := range c.StringSlice("audit-sink") {
+		switch name {
+		case AuditSinkStdout:
+			sinks = append(sinks, audit.NewStdoutSink())
+
+		case AuditSinkFile:
+			sink, err := audit.NewFileSink(c.String("audit-file"), c.Int("audit-file-max-size")*1024*1024, int(c.Int("audit-file-max-backups")))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+
+		case AuditSinkOTLP:
+			sink, err := audit.NewOTLPSink(ctx)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+
+		case AuditSinkLoki:
+			url := c.String("audit-loki-url")
+			if url == "" {
+				return nil, fmt.Errorf("audit-loki-url is required by the loki audit sink")
+			}
+			sinks = append(sinks, audit.NewLokiSink(url, map[string]string{"service_name": "lgtmp-query-gateway"}))
+
+		default:
+			return nil, fmt.Errorf("invalid audit sink %q", name)
+		}
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	logger := audit.New(audit.Settings{
+		SampleRate: c.Float("audit-sample-rate"),
+		Redact:     c.StringSlice("audit-redact"),
+	}, sinks...)
+
+	return logger, nil
+}
+
+// MUST be called before the checkPermissions middleware
+// This middleware records the authorization decision of every request
+func (h *Handler) audit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if h.auditLogger == nil {
+			return next(c)
+		}
+
+		// The proxy rewrites the request host
+		host := c.Request().Host
+
+		err := next(c)
+
+		event := audit.Event{
+			Time:        time.Now(),
+			Destination: host,
+			Method:      c.Request().Method,
+			Route:       c.Request().URL.Path,
+		}
+
+		if original, ok := stacks.OriginalParams(c); ok {
+			event.Query = queryString(original)
+			if params, paramsErr := stacks.Params(c); paramsErr == nil {
+				event.RewrittenQuery = queryString(params)
+			}
+		} else {
+			// The parameters were not read, e.g. the user is not authorized
+			// The form body of the request is not parsed for them, only its URL is recorded
+			event.Query = queryString(c.Request().URL.Query())
+		}
+		if user, ok := c.Get("user").(string); ok {
+			event.User = user
+		}
+		if email, ok := c.Get("email").(string); ok {
+			event.Email = email
+		}
+		if groups, ok := c.Get("groups").([]string); ok {
+			event.Groups = groups
+		}
+		if tenantNames, ok := c.Get("tenantNames").([]string); ok {
+			event.Tenant = strings.Join(tenantNames, "|")
+		} else {
+			event.Tenant = c.Request().Header.Get(TenantIDHeader)
+		}
+
+		event.Decision, event.Status, event.Reason = decision(c, err)
+
+		h.auditLogger.Record(event)
+
+		return err
+	}
+}
+
+// decision returns the authorization decision of the request from its outcome
+// Upstream failures are still allowed requests, only the errors raised by the gateway are decisions
+func decision(c echo.Context, err error) (audit.Decision, int, string) {
+	if err == nil {
+		return audit.DecisionAllow, c.Response().Status, ""
+	}
+
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) {
+		return audit.DecisionError, http.StatusInternalServerError, err.Error()
+	}
+
+	reason := fmt.Sprint(httpErr.Message)
+	switch httpErr.Code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity, http.StatusTooManyRequests:
+		return audit.DecisionDeny, httpErr.Code, reason
+	default:
+		return audit.DecisionError, httpErr.Code, reason
+	}
+}
+
+// queryString returns the query parameters of the request, repeated parameters are joined with a newline
+func queryString(params map[string][]string) string {
+	queries := make([]string, 0)
+	for _, name := range queryParameters {
+		queries = append(queries, params[name]...)
+	}
+
+	return strings.Join(queries, "\n")
+}
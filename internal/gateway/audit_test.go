@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
+	"github.com/labstack/echo/v4"
+)
+
+// memorySink keeps the audit events in memory
+type memorySink struct {
+	events []audit.Event
+}
+
+func (s *memorySink) Write(event audit.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	cfg := loadConfig(t, `
+"mimir.example.com":
+  type: mimir
+  upstream: http://localhost:9009
+  tenants:
+    prod:
+      mode: allowlist
+      groups:
+        - name: team-a
+          enforcedLabels: ['team="a"']
+`)
+
+	tests := []struct {
+		name      string
+		method    string
+		tenant    string
+		url       string
+		body      string
+		decision  audit.Decision
+		query     string
+		rewritten string
+	}{
+		{
+			name:      "allowed",
+			method:    http.MethodGet,
+			tenant:    "prod",
+			url:       "?" + url.Values{"query": {"up"}}.Encode(),
+			decision:  audit.DecisionAllow,
+			query:     "up",
+			rewritten: `up{team="a"}`,
+		},
+		{
+			name:      "allowed form",
+			method:    http.MethodPost,
+			tenant:    "prod",
+			body:      url.Values{"query": {"up"}}.Encode(),
+			decision:  audit.DecisionAllow,
+			query:     "up",
+			rewritten: `up{team="a"}`,
+		},
+		{
+			name:     "denied",
+			method:   http.MethodGet,
+			tenant:   "undefined",
+			url:      "?" + url.Values{"query": {"up"}}.Encode(),
+			decision: audit.DecisionDeny,
+			query:    "up",
+		},
+		{
+			// The form body of a denied request is not read
+			name:     "denied form",
+			method:   http.MethodPost,
+			tenant:   "undefined",
+			body:     url.Values{"query": {"up"}}.Encode(),
+			decision: audit.DecisionDeny,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memorySink{}
+			handler := newTestHandler(t, cfg, Claims{Email: "a@example.com", Groups: []string{"team-a"}})
+			handler.auditLogger = audit.New(audit.Settings{SampleRate: 1}, sink)
+
+			req := httptest.NewRequest(tt.method, "/prometheus/api/v1/query"+tt.url, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			}
+			req.Host = "mimir.example.com"
+			req.Header.Set(TenantIDHeader, tt.tenant)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			upstream := func(c echo.Context) error { return nil }
+			_ = handler.audit(handler.checkPermissions(handler.handle(upstream)))(c)
+
+			if len(sink.events) != 1 {
+				t.Fatalf("got %d events, want 1", len(sink.events))
+			}
+			event := sink.events[0]
+			if event.Decision != tt.decision {
+				t.Errorf("got decision %s, want %s", event.Decision, tt.decision)
+			}
+			if event.Query != tt.query {
+				t.Errorf("got query %q, want %q", event.Query, tt.query)
+			}
+			if event.RewrittenQuery != tt.rewritten {
+				t.Errorf("got rewritten query %q, want %q", event.RewrittenQuery, tt.rewritten)
+			}
+
+			if tt.decision == audit.DecisionDeny && c.Get("params") != nil {
+				t.Error("the parameters of a denied request were parsed")
+			}
+		})
+	}
+}
@@ -1,8 +1,9 @@
 package gateway
 
 import (
-	"log"
+	"fmt"
 	"net/url"
+	"sync/atomic"
 
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
 	"github.com/labstack/echo/v4"
@@ -10,19 +11,26 @@ import (
 )
 
 type CustomBalancer struct {
-	targets map[string]*middleware.ProxyTarget
+	// state holds the targets, it is replaced when the configuration is reloaded
+	state *atomic.Pointer[state]
 }
 
-func NewCustomBalancer(destinations map[string]config.Destination) *CustomBalancer {
+// NewCustomBalancer returns a balancer that proxies to the targets of the handler state
+func NewCustomBalancer(handler *Handler) *CustomBalancer {
+	return &CustomBalancer{state: &handler.state}
+}
+
+// newTargets returns the proxy target of every destination
+func newTargets(destinations map[string]config.Destination) (map[string]*middleware.ProxyTarget, error) {
 	targets := map[string]*middleware.ProxyTarget{}
 	for host, dest := range destinations {
 		if dest.Upstream == "" {
-			log.Panic("missing upstream for destination " + host)
+			return nil, fmt.Errorf("missing upstream for destination %s", host)
 		}
 
 		upstream, err := url.Parse(dest.Upstream)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 
 		targets[host] = &middleware.ProxyTarget{
@@ -30,9 +38,7 @@ func NewCustomBalancer(destinations map[string]config.Destination) *CustomBalanc
 		}
 	}
 
-	return &CustomBalancer{
-		targets: targets,
-	}
+	return targets, nil
 }
 
 // AddTarget implements the ProxyBalancer interface (required by Echo)
@@ -50,8 +56,8 @@ func (b *CustomBalancer) RemoveTarget(string) bool {
 // Next selects the appropriate backend based on the Host header
 // User must ensure that the target exists
 func (b *CustomBalancer) Next(c echo.Context) *middleware.ProxyTarget {
-	host := c.Request().Host
-	target := b.targets[host]
+	// The target selected by checkTarget, the targets may have been reloaded since
+	target := c.Get("proxyTarget").(*middleware.ProxyTarget)
 
 	// Patch host header to match the target
 	c.Request().Host = target.URL.Host
@@ -63,10 +69,13 @@ func (b *CustomBalancer) Next(c echo.Context) *middleware.ProxyTarget {
 func (b *CustomBalancer) checkTarget(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		host := c.Request().Host
-		if _, ok := b.targets[host]; !ok {
+		target, ok := b.state.Load().targets[host]
+		if !ok {
 			return echo.ErrNotFound
 		}
 
+		c.Set("proxyTarget", target)
+
 		return next(c)
 	}
 }
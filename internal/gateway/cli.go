@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/providers"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/providers/entra"
 	"github.com/urfave/cli/v3"
@@ -55,7 +56,7 @@ func Command() *cli.Command {
 			},
 			&cli.StringFlag{
 				Name:    "config",
-				Usage:   "Path to the configuration file",
+				Usage:   "Path to the configuration file or to a directory of configuration files",
 				Aliases: []string{"f"},
 				Sources: cli.EnvVars("CONFIG"),
 				Value:   "config.yaml",
@@ -76,6 +77,22 @@ func Command() *cli.Command {
 					return nil
 				},
 			},
+			&cli.StringFlag{
+				Name:    "admin-port",
+				Usage:   "Port of the admin server, exposes the gateway metrics",
+				Sources: cli.EnvVars("ADMIN_PORT"),
+				Value:   "9090",
+				Action: func(ctx context.Context, c *cli.Command, v string) error {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						return err
+					}
+					if n < 1 || n > 65535 {
+						return cli.Exit("Invalid admin port", 1)
+					}
+					return nil
+				},
+			},
 			&cli.BoolFlag{
 				Name:    "disable-token-validation",
 				Usage:   "Disable OIDC Token validation",
@@ -88,6 +105,67 @@ func Command() *cli.Command {
 				Sources: cli.EnvVars("DRAIN_DURATION"),
 				Value:   30 * time.Second,
 			},
+			&cli.StringSliceFlag{
+				Name:    "audit-sink",
+				Usage:   "Audit log sink, can be repeated (stdout, file, otlp, loki)",
+				Sources: cli.EnvVars("AUDIT_SINKS"),
+				Action: func(ctx context.Context, c *cli.Command, v []string) error {
+					for _, sink := range v {
+						if !slices.Contains([]string{AuditSinkStdout, AuditSinkFile, AuditSinkOTLP, AuditSinkLoki}, sink) {
+							return cli.Exit(fmt.Sprintf("Invalid audit sink %q", sink), 1)
+						}
+					}
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:    "audit-file",
+				Usage:   "Path to the audit log file",
+				Sources: cli.EnvVars("AUDIT_FILE"),
+				Value:   "audit.log",
+			},
+			&cli.IntFlag{
+				Name:    "audit-file-max-size",
+				Usage:   "Size in megabytes after which the audit log file is rotated",
+				Sources: cli.EnvVars("AUDIT_FILE_MAX_SIZE"),
+				Value:   100,
+			},
+			&cli.IntFlag{
+				Name:    "audit-file-max-backups",
+				Usage:   "Number of rotated audit log files to keep, 0 keeps every file",
+				Sources: cli.EnvVars("AUDIT_FILE_MAX_BACKUPS"),
+				Value:   5,
+			},
+			&cli.StringFlag{
+				Name:    "audit-loki-url",
+				Usage:   "Loki push endpoint of the loki audit sink, e.g. http://loki:3100/loki/api/v1/push",
+				Sources: cli.EnvVars("AUDIT_LOKI_URL"),
+			},
+			&cli.FloatFlag{
+				Name:    "audit-sample-rate",
+				Usage:   "Fraction of allowed requests that are audited, denied requests are always audited",
+				Sources: cli.EnvVars("AUDIT_SAMPLE_RATE"),
+				Value:   1,
+				Action: func(ctx context.Context, c *cli.Command, v float64) error {
+					if v < 0 || v > 1 {
+						return cli.Exit("Invalid audit sample rate, must be between 0 and 1", 1)
+					}
+					return nil
+				},
+			},
+			&cli.StringSliceFlag{
+				Name:    "audit-redact",
+				Usage:   "Audit log field to redact, can be repeated (user, email, groups, query, rewrittenQuery)",
+				Sources: cli.EnvVars("AUDIT_REDACT"),
+				Action: func(ctx context.Context, c *cli.Command, v []string) error {
+					for _, field := range v {
+						if !audit.ValidField(field) {
+							return cli.Exit(fmt.Sprintf("Invalid audit field %q, available options: %v", field, audit.RedactableFields()), 1)
+						}
+					}
+					return nil
+				},
+			},
 		},
 	}
 }
@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+// AuthzReport lists what the caller can access
+type AuthzReport struct {
+	Name         string              `json:"name"`
+	Email        string              `json:"email"`
+	Groups       []string            `json:"groups"`
+	Roles        []string            `json:"roles"`
+	Destinations []DestinationReport `json:"destinations"`
+}
+
+type DestinationReport struct {
+	Host string           `json:"host"`
+	Type config.StackType `json:"type"`
+	// AllowUndefined is set when tenants that are not configured can be queried without restrictions
+	AllowUndefined bool           `json:"allowUndefined"`
+	Tenants        []TenantReport `json:"tenants"`
+}
+
+type TenantReport struct {
+	Name string      `json:"name"`
+	Mode config.Mode `json:"mode"`
+	// Groups are the tenant groups the caller is part of
+	Groups []string `json:"groups"`
+	// Matchers are enforced on every query of the caller
+	Matchers     []string `json:"matchers"`
+	HiddenLabels []string `json:"hiddenLabels,omitempty"`
+}
+
+// debugAuthz reports the destinations and tenants the caller can access and the matchers enforced on each
+// The caller is identified by its own token, only the tenants it can access are reported
+func (h *Handler) debugAuthz(c echo.Context) error {
+	req := c.Request()
+	if req.Header.Get("x-id-token") == "" {
+		if token, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+			req.Header.Set("x-id-token", token)
+		}
+	}
+
+	claims, err := h.claims(c)
+	if err != nil {
+		return err
+	}
+
+	// Every tenant goes through the same authorization as the requests of the caller
+	// including the CEL rules and the external decision service
+	resolver := &Handler{staticClaims: claims}
+	resolver.state.Store(h.state.Load())
+
+	cfg := resolver.state.Load().config
+	report := AuthzReport{
+		Name:         claims.Name,
+		Email:        claims.Email,
+		Groups:       claims.Groups,
+		Roles:        claims.Roles,
+		Destinations: make([]DestinationReport, 0),
+	}
+
+	hosts := slices.Sorted(maps.Keys(cfg.Destinations))
+	for _, host := range hosts {
+		destination := cfg.Destinations[host]
+		destinationReport := DestinationReport{
+			Host:           host,
+			Type:           destination.Type,
+			AllowUndefined: destination.AllowUndefined,
+			Tenants:        make([]TenantReport, 0),
+		}
+
+		names := slices.Sorted(maps.Keys(destination.Tenants))
+		for _, name := range names {
+			tenantReport, ok := resolver.tenantReport(c, host, name)
+			if !ok {
+				continue
+			}
+			tenantReport.Mode = destination.Tenants[name].Mode
+
+			destinationReport.Tenants = append(destinationReport.Tenants, tenantReport)
+		}
+
+		if len(destinationReport.Tenants) > 0 || destination.AllowUndefined {
+			report.Destinations = append(report.Destinations, destinationReport)
+		}
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// tenantReport runs a query of the caller to the tenant through checkPermissions
+// It reports false when the request is denied
+func (h *Handler) tenantReport(c echo.Context, host, tenant string) (TenantReport, bool) {
+	report := TenantReport{
+		Name:     tenant,
+		Groups:   make([]string, 0),
+		Matchers: make([]string, 0),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(c.Request().Context())
+	req.Host = host
+	req.Header.Set(TenantIDHeader, tenant)
+
+	// The groups and matchers after the rules are applied
+	resolve := func(c echo.Context) error {
+		groups, _, err := stacks.UserGroups(c)
+		if err != nil {
+			return err
+		}
+
+		for _, group := range groups {
+			if group.Name != "" {
+				report.Groups = append(report.Groups, group.Name)
+			}
+		}
+		for _, m := range stacks.Matchers(groups) {
+			report.Matchers = append(report.Matchers, m.String())
+		}
+		report.HiddenLabels = stacks.HiddenLabels(groups)
+
+		return nil
+	}
+
+	err := h.checkPermissions(resolve)(echo.New().NewContext(req, httptest.NewRecorder()))
+	if err != nil {
+		return report, false
+	}
+
+	return report, true
+}
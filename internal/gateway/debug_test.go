@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// loadConfig loads the YAML configuration like the gateway does
+func loadConfig(t *testing.T, content string) *config.Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+// newTestHandler returns a handler that identifies every request with the claims
+func newTestHandler(t *testing.T, cfg *config.Config, claims Claims) *Handler {
+	t.Helper()
+
+	state, err := newState(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &Handler{staticClaims: &claims}
+	handler.state.Store(state)
+
+	return handler
+}
+
+func TestDebugAuthz(t *testing.T) {
+	cfg := loadConfig(t, `
+"loki.example.com":
+  type: loki
+  upstream: http://localhost:3100
+  tenants:
+    denied-by-rule:
+      mode: allowlist
+      groups:
+        - name: team-a
+      rules:
+        - name: no-contractors
+          effect: deny
+          expression: '"contractor" in user.roles'
+    inactive-group:
+      mode: allowlist
+      groups:
+        - name: team-a
+          rules:
+            - name: employees
+              effect: allow
+              expression: 'user.email.endsWith("@example.com")'
+    rule-matchers:
+      mode: allowlist
+      groups:
+        - name: team-a
+          enforcedLabels: ['team="a"']
+      rules:
+        - name: production-only
+          expression: 'true'
+          enforcedLabels: ['env="prod"']
+`)
+
+	handler := newTestHandler(t, cfg, Claims{
+		Name:   "alice",
+		Email:  "alice@contractor.com",
+		Groups: []string{"team-a"},
+		Roles:  []string{"contractor"},
+	})
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/debug/authz", nil), rec)
+	if err := handler.debugAuthz(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var report AuthzReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Destinations) != 1 {
+		t.Fatalf("got destinations %+v, want 1", report.Destinations)
+	}
+	tenants := report.Destinations[0].Tenants
+	if len(tenants) != 1 || tenants[0].Name != "rule-matchers" {
+		t.Fatalf("got tenants %+v, want only rule-matchers", tenants)
+	}
+
+	want := []string{`team="a"`, `env="prod"`}
+	for _, matcher := range want {
+		if !slices.Contains(tenants[0].Matchers, matcher) {
+			t.Errorf("got matchers %v, want %v", tenants[0].Matchers, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+// ExplainRequest is a request to explain on behalf of a user
+type ExplainRequest struct {
+	Host   string
+	Tenant string
+	Method string
+	Path   string
+	Params url.Values
+	Claims Claims
+}
+
+// Explanation is what the gateway does with a request
+type Explanation struct {
+	Decision audit.Decision `json:"decision"`
+	Status   int            `json:"status"`
+	Reason   string         `json:"reason,omitempty"`
+	// Groups are the tenant groups the user is part of
+	Groups []string `json:"groups"`
+	// Matchers are enforced on every selector of the query
+	Matchers []string `json:"matchers"`
+	Query    string   `json:"query,omitempty"`
+	// RewrittenQuery is the query sent upstream
+	RewrittenQuery string `json:"rewrittenQuery,omitempty"`
+	// Upstream is the request sent upstream
+	Upstream string `json:"upstream,omitempty"`
+	// Body is the form body sent upstream, query APIs accept the parameters in the body of POST requests
+	Body string `json:"body,omitempty"`
+	// ResponseFiltered is set when the upstream response is filtered before it is returned
+	ResponseFiltered bool `json:"responseFiltered"`
+}
+
+// Explain runs the request through the same middlewares as the gateway, without sending it upstream
+// Routes that look up upstream data to enforce LBAC (e.g. metadata, deletes and silences) still reach the upstream
+func Explain(cfg *config.Config, r ExplainRequest) (*Explanation, error) {
+	destination, ok := cfg.Destinations[r.Host]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "unknown destination "+r.Host)
+	}
+
+	// The external decision service is asked like it is by the gateway
+	authorizers, err := newAuthorizers(cfg.Destinations)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &Handler{staticClaims: &r.Claims}
+	handler.state.Store(&state{config: cfg, authorizers: authorizers})
+
+	explanation := &Explanation{
+		Groups:   make([]string, 0),
+		Matchers: make([]string, 0),
+		Query:    queryString(r.Params),
+	}
+
+	if tenant, ok := destination.Tenants[r.Tenant]; ok {
+		groups := make([]config.Group, 0)
+		for _, group := range tenant.Groups {
+			if slices.Contains(r.Claims.Groups, group.Name) {
+				groups = append(groups, group)
+				explanation.Groups = append(explanation.Groups, group.Name)
+			}
+		}
+
+		for _, m := range stacks.Matchers(groups) {
+			explanation.Matchers = append(explanation.Matchers, m.String())
+		}
+	}
+
+	// The request that would be sent upstream
+	upstream := func(c echo.Context) error {
+		params, err := stacks.Params(c)
+		if err != nil {
+			return err
+		}
+
+		// The groups and matchers after the rules are applied
+		if groups, ok, err := stacks.UserGroups(c); err == nil && ok {
+			explanation.Groups = make([]string, 0)
+			for _, group := range groups {
+				if group.Name != "" {
+					explanation.Groups = append(explanation.Groups, group.Name)
+				}
+			}
+
+			explanation.Matchers = make([]string, 0)
+			for _, m := range stacks.Matchers(groups) {
+				explanation.Matchers = append(explanation.Matchers, m.String())
+			}
+		}
+
+		explanation.RewrittenQuery = queryString(params)
+		explanation.ResponseFiltered = c.Get("responseBuffer") != nil || c.Get("responseStream") != nil
+
+		target := destination.Upstream + c.Request().URL.Path
+		if c.Request().URL.RawQuery != "" {
+			target += "?" + c.Request().URL.RawQuery
+		}
+		explanation.Upstream = c.Request().Method + " " + target
+		if c.Request().URL.RawQuery == "" {
+			explanation.Body = params.Encode()
+		}
+
+		return nil
+	}
+
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var req *http.Request
+	if method == http.MethodPost || method == http.MethodPut {
+		req = httptest.NewRequest(method, r.Path, strings.NewReader(r.Params.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	} else {
+		req = httptest.NewRequest(method, r.Path+"?"+r.Params.Encode(), nil)
+	}
+	req.Host = r.Host
+	req.Header.Set(TenantIDHeader, r.Tenant)
+
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	err = handler.checkPermissions(handler.handle(upstream))(c)
+
+	explanation.Decision, explanation.Status, explanation.Reason = decision(c, err)
+	if explanation.Decision != audit.DecisionAllow {
+		explanation.RewrittenQuery = ""
+		explanation.Upstream = ""
+		explanation.Body = ""
+	} else if explanation.Status == 0 {
+		// Nothing is written by the upstream handler
+		explanation.Status = http.StatusOK
+	}
+
+	return explanation, nil
+}
+
+// DecodeToken returns the claims of a JWT without validating it
+func DecodeToken(token string) (Claims, error) {
+	claims := Claims{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("expected 3 parts, got %d", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, err
+	}
+
+	err = json.Unmarshal(payload, &claims)
+
+	return claims, err
+}
@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
+)
+
+func TestExplain(t *testing.T) {
+	cfg := loadConfig(t, `
+"loki.example.com":
+  type: loki
+  upstream: http://localhost:3100
+  tenants:
+    shared:
+      mode: allowlist
+      groups:
+        - name: team-a
+          enforcedLabels: ['team="a"']
+        - name: team-b
+          enforcedLabels: ['team="b"']
+`)
+
+	tests := []struct {
+		name      string
+		request   ExplainRequest
+		decision  audit.Decision
+		status    int
+		groups    []string
+		matchers  []string
+		rewritten string
+		upstream  string
+		body      string
+	}{
+		{
+			name: "allowed",
+			request: ExplainRequest{
+				Host: "loki.example.com", Tenant: "shared", Path: "/loki/api/v1/query_range",
+				Params: url.Values{"query": {`{app="api"}`}},
+				Claims: Claims{Groups: []string{"team-a", "other"}},
+			},
+			decision:  audit.DecisionAllow,
+			status:    http.StatusOK,
+			groups:    []string{"team-a"},
+			matchers:  []string{`team="a"`},
+			rewritten: `{app="api", team="a"}`,
+			upstream:  "GET http://localhost:3100/loki/api/v1/query_range?" + url.Values{"query": {`{app="api", team="a"}`}}.Encode(),
+		},
+		{
+			name: "allowed form",
+			request: ExplainRequest{
+				Host: "loki.example.com", Tenant: "shared", Method: http.MethodPost, Path: "/loki/api/v1/query_range",
+				Params: url.Values{"query": {`{app="api"}`}},
+				Claims: Claims{Groups: []string{"team-b"}},
+			},
+			decision:  audit.DecisionAllow,
+			status:    http.StatusOK,
+			groups:    []string{"team-b"},
+			matchers:  []string{`team="b"`},
+			rewritten: `{app="api", team="b"}`,
+			upstream:  "POST http://localhost:3100/loki/api/v1/query_range",
+			body:      url.Values{"query": {`{app="api", team="b"}`}}.Encode(),
+		},
+		{
+			name: "not in a group of the tenant",
+			request: ExplainRequest{
+				Host: "loki.example.com", Tenant: "shared", Path: "/loki/api/v1/query_range",
+				Params: url.Values{"query": {`{app="api"}`}},
+				Claims: Claims{Groups: []string{"other"}},
+			},
+			decision: audit.DecisionDeny,
+			status:   http.StatusForbidden,
+			groups:   []string{},
+			matchers: []string{},
+		},
+		{
+			name: "undefined tenant",
+			request: ExplainRequest{
+				Host: "loki.example.com", Tenant: "undefined", Path: "/loki/api/v1/query_range",
+				Params: url.Values{"query": {`{app="api"}`}},
+				Claims: Claims{Groups: []string{"team-a"}},
+			},
+			decision: audit.DecisionDeny,
+			status:   http.StatusForbidden,
+			groups:   []string{},
+			matchers: []string{},
+		},
+		{
+			name: "invalid query",
+			request: ExplainRequest{
+				Host: "loki.example.com", Tenant: "shared", Path: "/loki/api/v1/query_range",
+				Params: url.Values{"query": {`{app=`}},
+				Claims: Claims{Groups: []string{"team-a"}},
+			},
+			decision: audit.DecisionError,
+			status:   http.StatusBadRequest,
+			groups:   []string{"team-a"},
+			matchers: []string{`team="a"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			explanation, err := Explain(cfg, tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explanation.Decision != tt.decision || explanation.Status != tt.status {
+				t.Errorf("got %s (%d): %s, want %s (%d)", explanation.Decision, explanation.Status, explanation.Reason, tt.decision, tt.status)
+			}
+			if !slices.Equal(explanation.Groups, tt.groups) {
+				t.Errorf("got groups %v, want %v", explanation.Groups, tt.groups)
+			}
+			if !slices.Equal(explanation.Matchers, tt.matchers) {
+				t.Errorf("got matchers %v, want %v", explanation.Matchers, tt.matchers)
+			}
+			if explanation.Query != tt.request.Params.Get("query") {
+				t.Errorf("got query %q, want %q", explanation.Query, tt.request.Params.Get("query"))
+			}
+			if explanation.RewrittenQuery != tt.rewritten {
+				t.Errorf("got rewritten query %q, want %q", explanation.RewrittenQuery, tt.rewritten)
+			}
+			if explanation.Upstream != tt.upstream {
+				t.Errorf("got upstream %q, want %q", explanation.Upstream, tt.upstream)
+			}
+			if explanation.Body != tt.body {
+				t.Errorf("got body %q, want %q", explanation.Body, tt.body)
+			}
+		})
+	}
+
+	if _, err := Explain(cfg, ExplainRequest{Host: "unknown.example.com"}); err == nil {
+		t.Error("explaining a request to an unknown destination did not fail")
+	}
+}
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/extauthz"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// newAuthorizers returns the external decision service clients of every destination that has one
+func newAuthorizers(destinations map[string]config.Destination) (map[string]*extauthz.Client, error) {
+	authorizers := map[string]*extauthz.Client{}
+	for host, destination := range destinations {
+		if destination.ExternalAuthz == nil {
+			continue
+		}
+
+		authorizer, err := extauthz.New(*destination.ExternalAuthz)
+		if err != nil {
+			return nil, err
+		}
+		authorizers[host] = authorizer
+	}
+
+	return authorizers, nil
+}
+
+// authorizeExternal asks the external decision service of the destination to authorize the request
+// The matchers returned by the service are enforced like the matchers of the tenant rules
+func (h *Handler) authorizeExternal(c echo.Context, destination config.Destination, tenantID string, defined bool, claims *Claims, rules *stacks.RuleResult) (*stacks.RuleResult, error) {
+	host := c.Request().Host
+	authorizer, ok := h.state.Load().authorizers[host]
+	if !ok {
+		return rules, nil
+	}
+
+	start := time.Now()
+	decision, cached, err := authorizer.Decide(c.Request().Context(), policyInput(c, destination, tenantID, claims))
+	if !cached {
+		metrics.ExternalAuthzDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	}
+
+	var matchers []*labels.Matcher
+	if err == nil && decision.Allow {
+		// An allow whose matchers can not be enforced is never allowed, even when failing open
+		matchers, err = parseExternalMatchers(destination.Type, decision.Matchers)
+	}
+
+	if err != nil {
+		log.Printf("external authorization failed: %v", err)
+		metrics.ExternalAuthzDecisions.WithLabelValues(host, "error").Inc()
+
+		// Only a service that can not be reached or does not answer with a decision fails open
+		if authorizer.FailOpen() && errors.Is(err, extauthz.ErrUnavailable) {
+			return rules, nil
+		}
+		return nil, echo.NewHTTPError(http.StatusForbidden, "external authorization failed")
+	}
+
+	if !decision.Allow {
+		metrics.ExternalAuthzDecisions.WithLabelValues(host, "deny").Inc()
+
+		message := "denied by external authorization"
+		if decision.Reason != "" {
+			message += ": " + decision.Reason
+		}
+		return nil, echo.NewHTTPError(http.StatusForbidden, message)
+	}
+
+	metrics.ExternalAuthzDecisions.WithLabelValues(host, "allow").Inc()
+
+	if len(matchers) == 0 {
+		return rules, nil
+	}
+
+	if !defined {
+		// LBAC is not enforced on undefined tenants
+		return nil, echo.NewHTTPError(http.StatusForbidden, "matchers of the external authorization can not be enforced on undefined tenants")
+	}
+
+	if rules == nil {
+		rules = &stacks.RuleResult{}
+	}
+	rules.Matchers = append(rules.Matchers, matchers...)
+
+	return rules, nil
+}
+
+// parseExternalMatchers parses the matchers returned by the decision service with the query language of the stack
+func parseExternalMatchers(stack config.StackType, matchers []string) ([]*labels.Matcher, error) {
+	parsed := make([]*labels.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		m, err := config.ParseMatchers(stack, matcher)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, m...)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestAuthorizeExternal(t *testing.T) {
+	tests := []struct {
+		name        string
+		failureMode string
+		status      int
+		body        string
+		denied      bool
+		matchers    []string
+	}{
+		{name: "allow", status: http.StatusOK, body: `{"allow": true}`, matchers: []string{`team="a"`}},
+		{name: "allow with matchers", status: http.StatusOK, body: `{"result": {"allow": true, "matchers": ["env=\"prod\""]}}`, matchers: []string{`team="a"`, `env="prod"`}},
+		{name: "deny", status: http.StatusOK, body: `{"allow": false, "reason": "no"}`, denied: true},
+		{name: "server error failing closed", failureMode: "closed", status: http.StatusInternalServerError, denied: true},
+		{name: "server error failing open", failureMode: "open", status: http.StatusInternalServerError, matchers: []string{`team="a"`}},
+		{name: "invalid matchers failing open", failureMode: "open", status: http.StatusOK, body: `{"allow": true, "matchers": ["env=~\"(\""]}`, denied: true},
+		{name: "invalid response failing open", failureMode: "open", status: http.StatusOK, body: `allow`, denied: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			cfg := loadConfig(t, fmt.Sprintf(`
+"loki.example.com":
+  type: loki
+  upstream: http://localhost:3100
+  externalAuthz:
+    url: %s
+    failureMode: %s
+  tenants:
+    prod:
+      mode: allowlist
+      groups:
+        - name: team-a
+          enforcedLabels: ['team="a"']
+`, server.URL, tt.failureMode))
+			handler := newTestHandler(t, cfg, Claims{Name: "alice", Groups: []string{"team-a"}})
+
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%7Bapp%3D%22api%22%7D", nil)
+			req.Host = "loki.example.com"
+			req.Header.Set(TenantIDHeader, "prod")
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			var matchers []string
+			err := handler.checkPermissions(func(c echo.Context) error {
+				groups, _, err := stacks.UserGroups(c)
+				if err != nil {
+					return err
+				}
+				for _, m := range stacks.Matchers(groups) {
+					matchers = append(matchers, m.String())
+				}
+				return nil
+			})(c)
+
+			var httpErr *echo.HTTPError
+			if tt.denied {
+				if !errors.As(err, &httpErr) || httpErr.Code != http.StatusForbidden {
+					t.Fatalf("got %v, want the request to be denied", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			slices.Sort(matchers)
+			want := slices.Sorted(slices.Values(tt.matchers))
+			if !slices.Equal(matchers, want) {
+				t.Errorf("got matchers %v, want %v", matchers, want)
+			}
+		})
+	}
+}
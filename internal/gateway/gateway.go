@@ -7,11 +7,15 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/otel"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/providers/entra"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/loki"
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/mimir"
 	"github.com/labstack/echo/v4"
@@ -26,14 +30,18 @@ const (
 
 type Handler struct {
 	provider        *entra.EntraProvider
-	config          *config.Config
+	state           atomic.Pointer[state]
+	auditLogger     *audit.Logger
 	tokenValidation bool
+	// staticClaims replaces the token claims when set
+	staticClaims *Claims
 }
 
 type Claims struct {
 	Groups    []string `json:"groups"`
 	Email     string   `json:"email"`
 	Name      string   `json:"name"`
+	Subject   string   `json:"sub"`
 	Roles     []string `json:"roles"`
 	IssuedAt  int64    `json:"iat"`
 	ExpiresAt int64    `json:"exp"`
@@ -42,7 +50,7 @@ type Claims struct {
 }
 
 func Serve(ctx context.Context, c *cli.Command) error {
-	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	defer stop()
 
 	wg := &sync.WaitGroup{}
@@ -72,31 +80,62 @@ func Serve(ctx context.Context, c *cli.Command) error {
 		}
 	}
 
+	state, err := newState(config, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	auditLogger, err := newAuditLogger(ctx, c)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	handler := &Handler{
 		provider:        provider,
-		config:          config,
+		auditLogger:     auditLogger,
 		tokenValidation: tokenValidation,
 	}
 
-	balancer := NewCustomBalancer(config.Destinations)
+	handler.state.Store(state)
+
+	balancer := NewCustomBalancer(handler)
+
+	// SIGHUP reloads the configuration instead of shutting down the server
+	err = handler.watchConfig(ctx, c.String("config"))
+	if err != nil {
+		log.Panic(err)
+	}
 
 	e.Use(
 		balancer.checkTarget,
+		handler.metrics,
+		handler.audit,
 		handler.checkPermissions,
+		handler.rateLimit,
 		handler.handle,
 		middleware.ProxyWithConfig(
 			middleware.ProxyConfig{
-				Balancer: balancer,
+				Balancer:     balancer,
+				ErrorHandler: upstreamError,
 			},
 		),
 	)
 
+	metrics.ConfigReloaded(nil)
+
 	go func() {
 		if err := e.Start(":" + c.String("port")); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("shutting down server: %v", err)
 		}
 	}()
 
+	admin := newAdminServer(handler)
+	go func() {
+		if err := admin.Start(":" + c.String("admin-port")); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("shutting down admin server: %v", err)
+		}
+	}()
+
 	<-ctx.Done()
 	log.Println("shutting down server...")
 	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("drain-duration"))
@@ -104,6 +143,11 @@ func Serve(ctx context.Context, c *cli.Command) error {
 	if err := e.Shutdown(ctx); err != nil {
 		log.Fatalf("shutting down server: %v", err)
 	}
+	// The drained requests were recorded, nothing writes to the sinks anymore
+	auditLogger.Close()
+	if err := admin.Shutdown(ctx); err != nil {
+		log.Fatalf("shutting down admin server: %v", err)
+	}
 	wg.Wait()
 	log.Println("server shut down gracefully")
 	return nil
@@ -116,6 +160,13 @@ func (h *Handler) handle(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		destination := c.Get("destination").(config.Destination)
 
+		if destination.Timeout > 0 {
+			// Also cancels the upstream request
+			ctx, cancel := context.WithTimeout(c.Request().Context(), destination.Timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+		}
+
 		switch destination.Type {
 		case config.StackLoki:
 			err := loki.Handle(c)
@@ -123,7 +174,7 @@ func (h *Handler) handle(next echo.HandlerFunc) echo.HandlerFunc {
 				return err
 			}
 
-		case config.StackMimir, config.StackPrometheus:
+		case config.StackMimir, config.StackCortex, config.StackThanos, config.StackPrometheus:
 			err := mimir.Handle(c)
 			if err != nil {
 				return err
@@ -137,6 +188,12 @@ func (h *Handler) handle(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.ErrUnprocessableEntity
 		}
 
-		return next(c)
+		err := next(c)
+		if flushErr := stacks.FlushResponse(c); flushErr != nil {
+			log.Print(flushErr)
+			return flushErr
+		}
+
+		return err
 	}
 }
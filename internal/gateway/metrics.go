@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/loki"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/mimir"
+	"github.com/labstack/echo/v4"
+)
+
+// newAdminServer returns the server of the admin port, it is not exposed with the gateway
+func newAdminServer(handler *Handler) *echo.Echo {
+	admin := echo.New()
+	admin.HideBanner = true
+	admin.HidePort = true
+
+	admin.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	admin.GET("/debug/authz", handler.debugAuthz)
+
+	return admin
+}
+
+// MUST be called after the checkTarget middleware
+// This middleware records the request duration and authorization decision metrics
+func (h *Handler) metrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		// The proxy rewrites the request host
+		host := c.Request().Host
+		route := routeLabel(h.state.Load().config.Destinations[host], c.Request().URL.Path)
+
+		err := next(c)
+
+		decision, status, _ := decision(c, err)
+		metrics.RequestDuration.WithLabelValues(host, route, c.Request().Method, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+		metrics.AuthzDecisions.WithLabelValues(host, string(decision), reasonLabel(decision, status)).Inc()
+
+		return err
+	}
+}
+
+// upstreamError records the requests that could not be proxied to the upstream
+func upstreamError(c echo.Context, err error) error {
+	destination, ok := c.Get("destination").(config.Destination)
+	if ok {
+		metrics.UpstreamErrors.WithLabelValues(destination.Upstream).Inc()
+	}
+
+	return err
+}
+
+// routeLabel returns the route of the request without its variable segments
+func routeLabel(destination config.Destination, path string) string {
+	switch destination.Type {
+	case config.StackLoki:
+		return loki.Route(destination, path)
+	case config.StackMimir, config.StackCortex, config.StackThanos, config.StackPrometheus:
+		return mimir.Route(destination, path)
+	default:
+		return stacks.RouteOther
+	}
+}
+
+// reasonLabel returns a reason with a bounded set of values from the decision and status code
+func reasonLabel(decision audit.Decision, status int) string {
+	if decision == audit.DecisionAllow {
+		return "allowed"
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "unauthenticated"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusUnprocessableEntity:
+		return "limit_exceeded"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusNotImplemented:
+		return "not_implemented"
+	default:
+		return "error"
+	}
+}
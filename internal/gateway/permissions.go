@@ -5,8 +5,11 @@ import (
 	"log"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
 	"github.com/labstack/echo/v4"
 )
 
@@ -36,28 +39,22 @@ func (h *Handler) checkPermissions(next echo.HandlerFunc) echo.HandlerFunc {
 			// queryTenants = strings.Split(tenantID, "|")
 		}
 
-		var claims *Claims
-		if h.tokenValidation {
-			// If token validation is enabled, we need to validate the token
-			claims, err = h.validateToken(c.Request().Context(), c.Request().Header.Get("x-id-token"))
-			if err != nil {
-				log.Print(err)
-				return echo.ErrUnauthorized
-			}
-		} else {
-			log.Printf("Token validation is disabled, using mock claims for testing purposes")
-			// Mock the claims for testing purposes
-			claims = &Claims{
-				Groups: []string{"group1", "group2"},
-				Email:  "user@example.com",
-				Name:   "User",
-				Roles:  []string{"role1", "role2"},
-			}
+		claims, err := h.claims(c)
+		if err != nil {
+			return err
 		}
 
 		for _, tenantID := range queryTenants {
-			if tenant, ok := destination.Tenants[tenantID]; ok {
-				found := slicesContains(tenant.Groups, claims.Groups)
+			tenant, defined := destination.Tenants[tenantID]
+			var rules *stacks.RuleResult
+			if defined {
+				rules, err = evaluateRules(c, destination, tenantID, tenant, claims)
+				if err != nil {
+					return err
+				}
+
+				// Groups whose allow rules are not satisfied do not apply
+				found := slicesContains(tenant.Groups, rules.Active(claims.Groups))
 
 				if (tenant.Mode == "allowlist" && !found) || (tenant.Mode == "denylist" && found) {
 					return echo.ErrForbidden
@@ -66,17 +63,58 @@ func (h *Handler) checkPermissions(next echo.HandlerFunc) echo.HandlerFunc {
 				// Deny access if the tenant is not defined
 				return echo.ErrForbidden
 			}
+
+			// The decision service can only restrict what the gateway allows
+			rules, err = h.authorizeExternal(c, destination, tenantID, defined, claims, rules)
+			if err != nil {
+				return err
+			}
+			c.Set("rules", rules)
 		}
 
 		c.Set("tenantNames", queryTenants)
+		c.Set("user", claims.Name)
 		c.Set("groups", claims.Groups)
 		c.Set("email", claims.Email)
+		c.Set("subject", claims.Subject)
+		c.Set("roles", claims.Roles)
 		c.Set("destination", destination)
 
 		return next(c)
 	}
 }
 
+// claims returns the claims of the user making the request
+func (h *Handler) claims(c echo.Context) (*Claims, error) {
+	if h.staticClaims != nil {
+		// The identity is given, e.g. to explain a request
+		return h.staticClaims, nil
+	}
+
+	if !h.tokenValidation {
+		log.Printf("Token validation is disabled, using mock claims for testing purposes")
+		// Mock the claims for testing purposes
+		return &Claims{
+			Groups: []string{"group1", "group2"},
+			Email:  "user@example.com",
+			Name:   "User",
+			Roles:  []string{"role1", "role2"},
+		}, nil
+	}
+
+	// If token validation is enabled, we need to validate the token
+	start := time.Now()
+	claims, err := h.validateToken(c.Request().Context(), c.Request().Header.Get("x-id-token"))
+	metrics.TokenValidationDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Print(err)
+		metrics.TokenValidationFailures.Inc()
+		return nil, echo.ErrUnauthorized
+	}
+
+	return claims, nil
+}
+
 func (h *Handler) validateToken(ctx context.Context, token string) (*Claims, error) {
 	idToken, err := h.provider.Validate(ctx, token)
 	if err != nil {
@@ -110,7 +148,11 @@ func (h *Handler) getDestination(c echo.Context) (config.Destination, error) {
 	}
 
 	// Previous middleware validates that the target exists
-	destination := h.config.Destinations[host]
+	// but the configuration may have been reloaded since
+	destination, ok := h.state.Load().config.Destinations[host]
+	if !ok {
+		return config.Destination{}, echo.ErrNotFound
+	}
 
 	return destination, nil
 }
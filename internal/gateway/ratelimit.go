@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/ratelimit"
+	"github.com/labstack/echo/v4"
+)
+
+// newLimiters returns the rate limiters of every destination that has rate limits
+func newLimiters(destinations map[string]config.Destination) (map[string]*ratelimit.Limiter, error) {
+	limiters := map[string]*ratelimit.Limiter{}
+	for host, destination := range destinations {
+		if len(destination.RateLimiting.Limits) == 0 {
+			continue
+		}
+
+		limiter, err := ratelimit.New(destination.RateLimiting, host, destination.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		limiters[host] = limiter
+	}
+
+	return limiters, nil
+}
+
+// MUST be called after the checkPermissions middleware
+// This middleware enforces the rate and concurrency limits of the destination
+func (h *Handler) rateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limiter, ok := h.state.Load().limiters[c.Request().Host]
+		if !ok {
+			return next(c)
+		}
+
+		destination := c.Get("destination").(config.Destination)
+		tenantNames := c.Get("tenantNames").([]string)
+		userGroups := c.Get("groups").([]string)
+
+		// Only the groups defined in the tenant have their own limits
+		groups := make([]string, 0)
+		for _, group := range destination.Tenants[tenantNames[0]].Groups {
+			if slices.Contains(userGroups, group.Name) {
+				groups = append(groups, group.Name)
+			}
+		}
+
+		release, err := limiter.Take(c.Request().Context(), ratelimit.Request{
+			User:   rateLimitUser(c),
+			Groups: groups,
+			Tenant: tenantNames[0],
+		})
+
+		var limitErr *ratelimit.LimitError
+		if errors.As(err, &limitErr) {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(limitErr.RetryAfterSeconds()))
+			return echo.NewHTTPError(http.StatusTooManyRequests, limitErr.Error())
+		}
+		if err != nil {
+			// Do not take the gateway down with the rate limiting backend
+			log.Printf("failed to check rate limits: %v", err)
+			return next(c)
+		}
+		defer release()
+
+		return next(c)
+	}
+}
+
+// rateLimitUser returns the identity of the user limits
+// Tokens without an email, e.g. of service principals, are identified by their subject and then their name
+func rateLimitUser(c echo.Context) string {
+	for _, key := range []string{"email", "subject", "user"} {
+		if value, _ := c.Get(key).(string); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRateLimitUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		subject string
+		user    string
+		want    string
+	}{
+		{"email", "alice@example.com", "0c7b", "Alice", "alice@example.com"},
+		{"service principal without email", "", "0c7b", "pipeline", "0c7b"},
+		{"name only", "", "", "pipeline", "pipeline"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+			c.Set("email", tt.email)
+			c.Set("subject", tt.subject)
+			c.Set("user", tt.user)
+
+			if got := rateLimitUser(c); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
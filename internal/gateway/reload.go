@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/extauthz"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/ratelimit"
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// reloadDelay groups the file events of a single change, editors and
+// Kubernetes ConfigMap updates generate several events for a single change
+const reloadDelay = 500 * time.Millisecond
+
+// state is derived from the configuration and replaced when it is reloaded
+// The proxy targets are part of it so a request never sees the targets of another configuration
+type state struct {
+	config      *config.Config
+	targets     map[string]*middleware.ProxyTarget
+	limiters    map[string]*ratelimit.Limiter
+	authorizers map[string]*extauthz.Client
+}
+
+// newState builds the state derived from the configuration
+// Limiters of destinations whose rate limits did not change are kept so their buckets are not reset
+// and so are the external authorization clients, with their cached decisions
+func newState(cfg *config.Config, previous *state) (*state, error) {
+	if previous == nil {
+		previous = &state{config: &config.Config{}}
+	}
+
+	targets, err := newTargets(cfg.Destinations)
+	if err != nil {
+		return nil, err
+	}
+
+	limiters := map[string]*ratelimit.Limiter{}
+	authorizers := map[string]*extauthz.Client{}
+	changed := map[string]config.Destination{}
+	changedAuthz := map[string]config.Destination{}
+	for host, destination := range cfg.Destinations {
+		current := previous.config.Destinations[host]
+
+		// The timeout sets how long the concurrency slots are kept
+		if limiter, ok := previous.limiters[host]; ok && reflect.DeepEqual(current.RateLimiting, destination.RateLimiting) && current.Timeout == destination.Timeout {
+			limiters[host] = limiter
+		} else {
+			changed[host] = destination
+		}
+
+		if authorizer, ok := previous.authorizers[host]; ok && reflect.DeepEqual(current.ExternalAuthz, destination.ExternalAuthz) {
+			authorizers[host] = authorizer
+		} else {
+			changedAuthz[host] = destination
+		}
+	}
+
+	createdAuthz, err := newAuthorizers(changedAuthz)
+	if err != nil {
+		return nil, err
+	}
+	for host, authorizer := range createdAuthz {
+		authorizers[host] = authorizer
+	}
+
+	created, err := newLimiters(changed)
+	if err != nil {
+		return nil, err
+	}
+	for host, limiter := range created {
+		limiters[host] = limiter
+	}
+
+	return &state{
+		config:      cfg,
+		targets:     targets,
+		limiters:    limiters,
+		authorizers: authorizers,
+	}, nil
+}
+
+// close closes the limiters of the state that are not kept by next
+// Their Redis clients are closed once the requests in flight released their slots
+func (s *state) close(next *state) {
+	for host, limiter := range s.limiters {
+		if next.limiters[host] != limiter {
+			limiter.Close()
+		}
+	}
+}
+
+// reload loads the configuration and atomically replaces the handler state
+// The current configuration is kept if the new one is invalid
+func (h *Handler) reload(path string) error {
+	err := h.swap(path)
+	metrics.ConfigReloaded(err)
+	if err != nil {
+		log.Printf("failed to reload configuration, keeping the current one: %v", err)
+		return err
+	}
+
+	log.Println("configuration reloaded")
+
+	return nil
+}
+
+func (h *Handler) swap(path string) error {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	previous := h.state.Load()
+	state, err := newState(cfg, previous)
+	if err != nil {
+		return err
+	}
+
+	h.state.Store(state)
+	if previous != nil {
+		previous.close(state)
+	}
+
+	return nil
+}
+
+// watchConfig reloads the configuration when the file changes or the process receives a SIGHUP
+func (h *Handler) watchConfig(ctx context.Context, path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the directory, the file is replaced instead of modified by most editors
+	// and Kubernetes swaps the ..data symlink of ConfigMap volumes
+	dir := filepath.Dir(path)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		dir = path
+	}
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+
+		// Stopped until the first event
+		timer := time.NewTimer(0)
+		<-timer.C
+
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+
+			case <-hup:
+				log.Println("received SIGHUP, reloading configuration")
+				h.reload(path)
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if changed(path, dir, event.Name) {
+					timer.Reset(reloadDelay)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("failed to watch configuration: %v", err)
+
+			case <-timer.C:
+				log.Printf("configuration %s changed, reloading", path)
+				h.reload(path)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// changed reports whether the event on file changes the configuration at path
+func changed(path, dir, file string) bool {
+	name := filepath.Base(file)
+	if name == "..data" {
+		return true
+	}
+
+	if dir == path {
+		// Every configuration file of the directory
+		return !strings.HasPrefix(name, ".") && config.IsConfigFile(name)
+	}
+
+	return name == filepath.Base(path)
+}
@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/ratelimit"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// reloadConfig is a destination proxied to upstream and rate limited with the Redis server at redis
+func reloadConfig(upstream, redis string, rate float64) string {
+	return `
+"loki.example.com":
+  type: loki
+  upstream: ` + upstream + `
+  rateLimiting:
+    redis:
+      address: ` + redis + `
+    limits:
+      - key: user
+        rate: ` + strconv.FormatFloat(rate, 'f', -1, 64) + `
+        maxConcurrent: 10
+  tenants:
+    t1:
+      mode: allowlist
+      groups:
+        - name: team-a
+`
+}
+
+func TestSwap(t *testing.T) {
+	server := miniredis.RunT(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(reloadConfig("http://upstream-a:3100", server.Addr(), 10))
+	handler := newTestHandler(t, loadConfig(t, reloadConfig("http://upstream-a:3100", server.Addr(), 10)), Claims{})
+	balancer := NewCustomBalancer(handler)
+
+	// target returns the upstream host that the balancer selects for the destination
+	target := func() string {
+		t.Helper()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "http://loki.example.com/loki/api/v1/labels", nil), httptest.NewRecorder())
+		err := balancer.checkTarget(func(c echo.Context) error {
+			balancer.Next(c)
+			return nil
+		})(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Request().Host
+	}
+
+	first := handler.state.Load()
+	request := ratelimit.Request{User: "alice", Tenant: "t1"}
+	release, err := first.limiters["loki.example.com"].Take(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the upstream changed, the limiter is kept
+	write(reloadConfig("http://upstream-b:3100", server.Addr(), 10))
+	if err := handler.swap(path); err != nil {
+		t.Fatal(err)
+	}
+	second := handler.state.Load()
+	if got := target(); got != "upstream-b:3100" {
+		t.Errorf("got target %s, want upstream-b:3100", got)
+	}
+	if second.config.Destinations["loki.example.com"].Upstream != "http://upstream-b:3100" {
+		t.Error("the configuration was not replaced with the targets")
+	}
+	if second.limiters["loki.example.com"] != first.limiters["loki.example.com"] {
+		t.Error("the limiter was replaced although its settings did not change")
+	}
+
+	// An invalid configuration keeps the configuration and the targets
+	write("not: [valid")
+	if err := handler.swap(path); err == nil {
+		t.Fatal("an invalid configuration was loaded")
+	}
+	if handler.state.Load() != second || target() != "upstream-b:3100" {
+		t.Error("an invalid configuration replaced the state")
+	}
+
+	// The rate limits changed, the previous limiter is closed once the request in flight released its slot
+	write(reloadConfig("http://upstream-b:3100", server.Addr(), 20))
+	if err := handler.swap(path); err != nil {
+		t.Fatal(err)
+	}
+	previous := second.limiters["loki.example.com"]
+	if handler.state.Load().limiters["loki.example.com"] == previous {
+		t.Fatal("the limiter was kept although its settings changed")
+	}
+
+	release()
+	if server.Exists("inflight:loki.example.com:t1:user:alice") {
+		t.Error("the slot taken before the reload was not released")
+	}
+	if _, err := previous.Take(context.Background(), request); err == nil {
+		t.Error("the Redis client of the replaced limiter was not closed")
+	}
+}
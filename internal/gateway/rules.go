@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/policy"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/loki"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/mimir"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// evaluateRules evaluates the CEL rules of the tenant and of the tenant groups the user is part of
+// It returns nil when there is nothing to evaluate
+func evaluateRules(c echo.Context, destination config.Destination, tenantID string, tenant config.Tenant, claims *Claims) (*stacks.RuleResult, error) {
+	groups := make([]config.Group, 0)
+	hasRules := len(tenant.Rules) > 0
+	for _, group := range tenant.Groups {
+		if slices.Contains(claims.Groups, group.Name) {
+			groups = append(groups, group)
+			hasRules = hasRules || len(group.Rules) > 0
+		}
+	}
+
+	if !hasRules {
+		return nil, nil
+	}
+
+	input := policyInput(c, destination, tenantID, claims)
+
+	result := &stacks.RuleResult{
+		Inactive:      make([]string, 0),
+		GroupMatchers: map[string][]*labels.Matcher{},
+	}
+
+	for _, group := range groups {
+		for _, rule := range group.Rules {
+			matched, err := evaluateRule(rule, input)
+			if err != nil {
+				return nil, err
+			}
+
+			if rule.Effect == config.RuleEffectAllow && !matched {
+				// The group does not apply to this request
+				result.Inactive = append(result.Inactive, group.Name)
+				delete(result.GroupMatchers, group.Name)
+				break
+			}
+
+			if !matched {
+				continue
+			}
+
+			if rule.Effect == config.RuleEffectDeny {
+				return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("denied by rule %s", rule.Name))
+			}
+
+			result.GroupMatchers[group.Name] = append(result.GroupMatchers[group.Name], rule.Matchers...)
+		}
+	}
+
+	for _, rule := range tenant.Rules {
+		matched, err := evaluateRule(rule, input)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case rule.Effect == config.RuleEffectAllow && !matched:
+			return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("not allowed by rule %s", rule.Name))
+		case rule.Effect == config.RuleEffectDeny && matched:
+			return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("denied by rule %s", rule.Name))
+		case matched:
+			result.Matchers = append(result.Matchers, rule.Matchers...)
+		}
+	}
+
+	return result, nil
+}
+
+// policyInput returns the request as seen by the rules and the external decision service
+func policyInput(c echo.Context, destination config.Destination, tenantID string, claims *Claims) policy.Input {
+	return policy.Input{
+		User: policy.User{
+			Name:   claims.Name,
+			Email:  claims.Email,
+			Groups: nonNil(claims.Groups),
+			Roles:  nonNil(claims.Roles),
+		},
+		Request: policy.Request{
+			Host:   c.Request().Host,
+			Method: c.Request().Method,
+			Route:  c.Request().URL.Path,
+			Tenant: tenantID,
+			Time:   time.Now(),
+		},
+		Query: queryInput(c, destination.Type),
+	}
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
+
+// evaluateRule evaluates the expression of the rule, the request is denied when it fails
+func evaluateRule(rule config.Rule, input policy.Input) (bool, error) {
+	matched, err := policy.Eval(rule.Program, input)
+	if err != nil {
+		log.Printf("failed to evaluate rule %s: %v", rule.Name, err)
+		return false, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("failed to evaluate rule %s", rule.Name))
+	}
+
+	return matched, nil
+}
+
+// queryInput returns the query of the request as seen by the rules
+// Queries that can not be parsed are rejected later by the stack, their labels and metrics are empty
+func queryInput(c echo.Context, stack config.StackType) policy.Query {
+	params, err := stacks.Params(c)
+	if err != nil {
+		return policy.Query{}
+	}
+
+	query := policy.Query{
+		Raw:            queryString(params),
+		Labels:         make([]string, 0),
+		Metrics:        make([]string, 0),
+		MetricMatchers: make([]string, 0),
+	}
+
+	for _, name := range queryParameters {
+		for _, q := range params[name] {
+			var matchers []*labels.Matcher
+			switch stack {
+			case config.StackLoki:
+				matchers, err = loki.SelectorMatchers(q)
+			case config.StackMimir, config.StackCortex, config.StackThanos, config.StackPrometheus:
+				matchers, err = mimir.SelectorMatchers(q)
+			default:
+				continue
+			}
+			if err != nil {
+				continue
+			}
+
+			for _, m := range matchers {
+				if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+					if !slices.Contains(query.Metrics, m.Value) {
+						query.Metrics = append(query.Metrics, m.Value)
+					}
+					continue
+				}
+				if m.Name == labels.MetricName && !slices.Contains(query.MetricMatchers, m.String()) {
+					// e.g. {__name__=~"secret_.*"} selects metrics that are not listed by name
+					query.MetricMatchers = append(query.MetricMatchers, m.String())
+				}
+				if !slices.Contains(query.Labels, m.Name) {
+					query.Labels = append(query.Labels, m.Name)
+				}
+			}
+		}
+	}
+
+	return query
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestRules(t *testing.T) {
+	cfg := loadConfig(t, `
+"mimir.example.com":
+  type: mimir
+  upstream: http://localhost:9009
+  tenants:
+    prod:
+      mode: allowlist
+      groups:
+        - name: team-a
+          enforcedLabels: ['team="a"']
+        - name: oncall
+          rules:
+            - name: oncall-only
+              effect: allow
+              expression: '"responder" in user.roles'
+      rules:
+        - name: no-secret-metrics
+          effect: deny
+          expression: '"secret_total" in query.metrics || query.metricMatchers.exists(m, m.contains("secret"))'
+        - name: business-hours
+          effect: allow
+          expression: 'user.email != "night@example.com"'
+        - name: staging-for-contractors
+          expression: '"contractor" in user.roles'
+          enforcedLabels: ['env="staging"']
+`)
+
+	tests := []struct {
+		name     string
+		claims   Claims
+		query    string
+		status   int
+		matchers []string
+	}{
+		{
+			name:     "allowed",
+			claims:   Claims{Email: "a@example.com", Groups: []string{"team-a"}},
+			query:    `up`,
+			matchers: []string{`team="a"`},
+		},
+		{
+			name:   "denied by metric name",
+			claims: Claims{Email: "a@example.com", Groups: []string{"team-a"}},
+			query:  `rate(secret_total[5m])`,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "denied by metric name regex",
+			claims: Claims{Email: "a@example.com", Groups: []string{"team-a"}},
+			query:  `{__name__=~"secret_.*"}`,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "not allowed by tenant rule",
+			claims: Claims{Email: "night@example.com", Groups: []string{"team-a"}},
+			query:  `up`,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "inactive group",
+			claims: Claims{Email: "a@example.com", Groups: []string{"oncall"}},
+			query:  `up`,
+			status: http.StatusForbidden,
+		},
+		{
+			name:     "active group",
+			claims:   Claims{Email: "a@example.com", Groups: []string{"oncall"}, Roles: []string{"responder"}},
+			query:    `up`,
+			matchers: []string{},
+		},
+		{
+			name:     "rule matchers",
+			claims:   Claims{Email: "a@example.com", Groups: []string{"team-a"}, Roles: []string{"contractor"}},
+			query:    `up`,
+			matchers: []string{`team="a"`, `env="staging"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, cfg, tt.claims)
+
+			req := httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/query?"+url.Values{"query": {tt.query}}.Encode(), nil)
+			req.Host = "mimir.example.com"
+			req.Header.Set(TenantIDHeader, "prod")
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			var matchers []string
+			err := handler.checkPermissions(func(c echo.Context) error {
+				groups, _, err := stacks.UserGroups(c)
+				if err != nil {
+					return err
+				}
+				matchers = make([]string, 0)
+				for _, m := range stacks.Matchers(groups) {
+					matchers = append(matchers, m.String())
+				}
+				return nil
+			})(c)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+			if tt.status != 0 {
+				return
+			}
+
+			slices.Sort(matchers)
+			want := slices.Sorted(slices.Values(tt.matchers))
+			if !slices.Equal(matchers, want) {
+				t.Errorf("got matchers %v, want %v", matchers, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "lgtmp_query_gateway"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the requests handled by the gateway, including the upstream request",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"destination", "route", "method", "status"})
+
+	AuthzDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authz_decisions_total",
+		Help:      "Authorization decisions by destination, decision and reason",
+	}, []string{"destination", "decision", "reason"})
+
+	QueryRewriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_rewrite_failures_total",
+		Help:      "Queries that could not be parsed or rewritten to enforce LBAC",
+	}, []string{"stack"})
+
+	TokenValidationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "token_validation_duration_seconds",
+		Help:      "Duration of the OIDC token validation",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	TokenValidationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validation_failures_total",
+		Help:      "OIDC tokens that failed validation",
+	})
+
+	JWKSRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwks_refreshes_total",
+		Help:      "Requests to the OIDC provider key set endpoint by result",
+	}, []string{"result"})
+
+	JWKSLastRefreshSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jwks_last_refresh_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful request to the OIDC provider key set endpoint",
+	})
+
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Requests that could not be proxied to the upstream",
+	}, []string{"upstream"})
+
+	ExternalAuthzDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "external_authz_decisions_total",
+		Help:      "Decisions of the external authorization service by destination and decision",
+	}, []string{"destination", "decision"})
+
+	ExternalAuthzDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "external_authz_duration_seconds",
+		Help:      "Duration of the requests to the external authorization service, cached decisions are not included",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"destination"})
+
+	ConfigReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful",
+	})
+
+	ConfigReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestDuration,
+		AuthzDecisions,
+		QueryRewriteFailures,
+		TokenValidationDuration,
+		TokenValidationFailures,
+		JWKSRefreshes,
+		JWKSLastRefreshSuccess,
+		UpstreamErrors,
+		ExternalAuthzDecisions,
+		ExternalAuthzDuration,
+		ConfigReloadSuccess,
+		ConfigReloadTimestamp,
+	)
+}
+
+// Handler returns the HTTP handler that exposes the gateway metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ConfigReloaded records the result of a configuration (re)load
+func ConfigReloaded(err error) {
+	if err != nil {
+		ConfigReloadSuccess.Set(0)
+		return
+	}
+
+	ConfigReloadSuccess.Set(1)
+	ConfigReloadTimestamp.SetToCurrentTime()
+}
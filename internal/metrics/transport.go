@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+)
+
+// JWKSTransport records the requests to the OIDC provider key set endpoint
+// The discovery document requests are not recorded
+type JWKSTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *JWKSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if strings.HasSuffix(req.URL.Path, "/.well-known/openid-configuration") {
+		return resp, err
+	}
+
+	if err != nil || resp.StatusCode/100 != 2 {
+		JWKSRefreshes.WithLabelValues("failure").Inc()
+		return resp, err
+	}
+
+	JWKSRefreshes.WithLabelValues("success").Inc()
+	JWKSLastRefreshSuccess.SetToCurrentTime()
+
+	return resp, err
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Input is the data available to the rule expressions and sent to the external decision service
+type Input struct {
+	User    User    `json:"user"`
+	Request Request `json:"request"`
+	Query   Query   `json:"query"`
+}
+
+type User struct {
+	Name   string   `json:"name"`
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
+	Roles  []string `json:"roles"`
+}
+
+type Request struct {
+	Host   string    `json:"host"`
+	Method string    `json:"method"`
+	Route  string    `json:"route"`
+	Tenant string    `json:"tenant"`
+	Time   time.Time `json:"time"`
+}
+
+// Query is the query of the request before LBAC is enforced
+type Query struct {
+	Raw string `json:"raw"`
+	// Labels are the label names used by the selectors of the query
+	Labels []string `json:"labels"`
+	// Metrics are the metric names selected by the query
+	Metrics []string `json:"metrics"`
+	// MetricMatchers are the other matchers on the metric name, e.g. __name__=~"node_.*"
+	MetricMatchers []string `json:"metricMatchers"`
+}
+
+var env *cel.Env
+
+func init() {
+	var err error
+	env, err = cel.NewEnv(
+		cel.Variable("user", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("query", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Compile compiles a rule expression, the expression must return a bool
+func Compile(expression string) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("expression must return a bool, got %s", ast.OutputType())
+	}
+
+	return env.Program(ast)
+}
+
+// Eval evaluates a compiled rule expression
+func Eval(program cel.Program, input Input) (bool, error) {
+	out, _, err := program.Eval(map[string]any{
+		"user": map[string]any{
+			"name":   input.User.Name,
+			"email":  input.User.Email,
+			"groups": nonNil(input.User.Groups),
+			"roles":  nonNil(input.User.Roles),
+		},
+		"request": map[string]any{
+			"host":   input.Request.Host,
+			"method": input.Request.Method,
+			"route":  input.Request.Route,
+			"tenant": input.Request.Tenant,
+			"time":   input.Request.Time,
+		},
+		"query": map[string]any{
+			"raw":            input.Query.Raw,
+			"labels":         nonNil(input.Query.Labels),
+			"metrics":        nonNil(input.Query.Metrics),
+			"metricMatchers": nonNil(input.Query.MetricMatchers),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %v instead of a bool", out.Value())
+	}
+
+	return result, nil
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
@@ -0,0 +1,84 @@
+package policytest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:      "test",
+		Usage:     "Test the access policies against fixture files",
+		ArgsUsage: "<fixture file or directory>...",
+		Action:    Test,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to the configuration, replaces the configuration of the fixtures",
+				Aliases: []string{"f"},
+				Sources: cli.EnvVars("CONFIG"),
+			},
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Usage:   "Print the passing tests and the gateway logs",
+				Aliases: []string{"v"},
+			},
+		},
+	}
+}
+
+func Test(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() == 0 {
+		return cli.Exit("missing fixture files", 1)
+	}
+
+	verbose := c.Bool("verbose")
+	if !verbose {
+		// The handlers log why requests are denied, the failing tests already report it
+		log.SetOutput(io.Discard)
+	}
+
+	files, err := Files(c.Args().Slice())
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	passed, failed := 0, 0
+	for _, file := range files {
+		results, err := Run(file, c.String("config"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		for _, result := range results {
+			if result.Passed() {
+				passed++
+				if verbose {
+					fmt.Printf("--- PASS: %s: %s\n", result.File, result.Name)
+				}
+				continue
+			}
+
+			failed++
+			fmt.Printf("--- FAIL: %s: %s\n", result.File, result.Name)
+			if result.Err != nil {
+				fmt.Printf("    error: %v\n", result.Err)
+			}
+			for _, diff := range result.Diffs {
+				fmt.Printf("    %s\n", strings.ReplaceAll(diff, "\n", "\n    "))
+			}
+		}
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package policytest
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/audit"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/gateway"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is a file of policy tests
+type Fixture struct {
+	// Config is the configuration under test, relative to the fixture file
+	Config string `yaml:"config"`
+	Tests  []Case `yaml:"tests"`
+}
+
+// Case is a request made by a user and its expected outcome
+type Case struct {
+	Name     string      `yaml:"name"`
+	Identity Identity    `yaml:"identity"`
+	Request  Request     `yaml:"request"`
+	Expect   Expectation `yaml:"expect"`
+}
+
+// Identity is the user making the request, the claims of the token are merged with the other fields
+type Identity struct {
+	Token  string   `yaml:"token"`
+	Email  string   `yaml:"email"`
+	Groups []string `yaml:"groups"`
+	Roles  []string `yaml:"roles"`
+}
+
+type Request struct {
+	Host   string              `yaml:"host"`
+	Tenant string              `yaml:"tenant"`
+	Method string              `yaml:"method"`
+	Route  string              `yaml:"route"`
+	Query  string              `yaml:"query"`
+	Params map[string][]string `yaml:"params"`
+}
+
+// Expectation lists the expected outcome, fields that are not set are not checked
+type Expectation struct {
+	Decision audit.Decision `yaml:"decision"`
+	Status   int            `yaml:"status"`
+	// Reason must be contained in the reason of the decision
+	Reason         string   `yaml:"reason"`
+	Matchers       []string `yaml:"matchers"`
+	RewrittenQuery *string  `yaml:"rewrittenQuery"`
+}
+
+// Result is the outcome of a test case
+type Result struct {
+	File  string
+	Name  string
+	Diffs []string
+	Err   error
+}
+
+func (r Result) Passed() bool {
+	return r.Err == nil && len(r.Diffs) == 0
+}
+
+// Files returns the fixture files of the paths, directories are searched for YAML files
+func Files(paths []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(file string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && config.IsConfigFile(file) {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// Run runs the tests of the fixture file
+// configPath replaces the configuration of the fixture when set
+func Run(file, configPath string) ([]Result, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture Fixture
+	err = yaml.Unmarshal(data, &fixture)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	if len(fixture.Tests) == 0 {
+		// Not a fixture, e.g. the configuration kept next to the fixtures
+		return nil, nil
+	}
+
+	if configPath == "" {
+		if fixture.Config == "" {
+			return nil, fmt.Errorf("%s: missing config", file)
+		}
+		configPath = filepath.Join(filepath.Dir(file), fixture.Config)
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+
+	results := make([]Result, 0, len(fixture.Tests))
+	for _, test := range fixture.Tests {
+		result := Result{File: file, Name: test.Name}
+		result.Diffs, result.Err = run(cfg, test)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func run(cfg *config.Config, test Case) ([]string, error) {
+	claims := gateway.Claims{}
+	if test.Identity.Token != "" {
+		var err error
+		claims, err = gateway.DecodeToken(test.Identity.Token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token: %w", err)
+		}
+	}
+	claims.Groups = append(claims.Groups, test.Identity.Groups...)
+	claims.Roles = append(claims.Roles, test.Identity.Roles...)
+	if test.Identity.Email != "" {
+		claims.Email = test.Identity.Email
+	}
+
+	params := url.Values{}
+	for name, values := range test.Request.Params {
+		params[name] = slices.Clone(values)
+	}
+	if test.Request.Query != "" {
+		params.Set("query", test.Request.Query)
+	}
+
+	explanation, err := gateway.Explain(cfg, gateway.ExplainRequest{
+		Host:   test.Request.Host,
+		Tenant: test.Request.Tenant,
+		Method: strings.ToUpper(test.Request.Method),
+		Path:   test.Request.Route,
+		Params: params,
+		Claims: claims,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]string, 0)
+	expect := test.Expect
+
+	if expect.Decision != "" && expect.Decision != explanation.Decision {
+		got := fmt.Sprintf("%s (%d)", explanation.Decision, explanation.Status)
+		if explanation.Reason != "" {
+			got += ": " + explanation.Reason
+		}
+		diffs = append(diffs, fmt.Sprintf("decision: expected %s, got %s", expect.Decision, got))
+	}
+
+	if expect.Status != 0 && expect.Status != explanation.Status {
+		diffs = append(diffs, fmt.Sprintf("status: expected %d, got %d", expect.Status, explanation.Status))
+	}
+
+	if expect.Reason != "" && !strings.Contains(explanation.Reason, expect.Reason) {
+		diffs = append(diffs, fmt.Sprintf("reason: expected %q, got %q", expect.Reason, explanation.Reason))
+	}
+
+	if expect.Matchers != nil && !slices.Equal(expect.Matchers, explanation.Matchers) {
+		diffs = append(diffs, fmt.Sprintf("matchers:\n  expected: %v\n  got:      %v", expect.Matchers, explanation.Matchers))
+	}
+
+	if expect.RewrittenQuery != nil && *expect.RewrittenQuery != explanation.RewrittenQuery {
+		diffs = append(diffs, fmt.Sprintf("rewrittenQuery:\n  expected: %s\n  got:      %s", *expect.RewrittenQuery, explanation.RewrittenQuery))
+	}
+
+	return diffs, nil
+}
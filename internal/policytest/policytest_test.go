@@ -0,0 +1,192 @@
+package policytest
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+"loki.example.com":
+  type: loki
+  upstream: http://localhost:3100
+  tenants:
+    shared:
+      mode: allowlist
+      groups:
+        - name: team-a
+          enforcedLabels: ['team="a"']
+`
+
+const testFixture = `
+config: ../config.yaml
+tests:
+  - name: allowed
+    identity:
+      groups: [team-a]
+    request:
+      host: loki.example.com
+      tenant: shared
+      route: /loki/api/v1/query_range
+      query: '{app="api"}'
+    expect:
+      decision: allow
+      status: 200
+      matchers: ['team="a"']
+      rewrittenQuery: '{app="api", team="a"}'
+  - name: denied
+    identity:
+      groups: [team-b]
+    request:
+      host: loki.example.com
+      tenant: shared
+      route: /loki/api/v1/query_range
+      query: '{app="api"}'
+    expect:
+      decision: deny
+      status: 403
+  - name: wrong rewritten query
+    identity:
+      groups: [team-a]
+    request:
+      host: loki.example.com
+      tenant: shared
+      route: /loki/api/v1/query_range
+      query: '{app="api"}'
+    expect:
+      decision: allow
+      rewrittenQuery: '{app="api", team="b"}'
+  - name: wrong decision
+    identity:
+      groups: [team-b]
+    request:
+      host: loki.example.com
+      tenant: shared
+      route: /loki/api/v1/query_range
+      query: '{app="api"}'
+    expect:
+      decision: allow
+      reason: not found
+  - name: invalid token
+    identity:
+      token: invalid
+    request:
+      host: loki.example.com
+      tenant: shared
+      route: /loki/api/v1/query_range
+`
+
+// writeFixtures writes the configuration and the fixture in a new directory and returns its path
+func writeFixtures(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "tests"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tests", "team-a.yaml"), []byte(testFixture), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestRun(t *testing.T) {
+	dir := writeFixtures(t)
+
+	results, err := Run(filepath.Join(dir, "tests", "team-a.yaml"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		passed bool
+		// diffs must be contained, in order, in the diffs of the result
+		diffs []string
+		err   string
+	}{
+		{name: "allowed", passed: true},
+		{name: "denied", passed: true},
+		{name: "wrong rewritten query", diffs: []string{"rewrittenQuery:\n  expected: {app=\"api\", team=\"b\"}\n  got:      {app=\"api\", team=\"a\"}"}},
+		{name: "wrong decision", diffs: []string{"decision: expected allow, got deny (403)", `reason: expected "not found"`}},
+		{name: "invalid token", err: "invalid token"},
+	}
+
+	if len(results) != len(tests) {
+		t.Fatalf("got %d results, want %d", len(results), len(tests))
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := results[i]
+			if result.Name != tt.name {
+				t.Fatalf("got test %q, want %q", result.Name, tt.name)
+			}
+			if result.Passed() != tt.passed {
+				t.Errorf("got passed %t, want %t (diffs %q, error %v)", result.Passed(), tt.passed, result.Diffs, result.Err)
+			}
+
+			if tt.err != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), tt.err)) {
+				t.Errorf("got error %v, want %q", result.Err, tt.err)
+			}
+
+			if len(result.Diffs) != len(tt.diffs) {
+				t.Fatalf("got diffs %q, want %q", result.Diffs, tt.diffs)
+			}
+			for j, diff := range tt.diffs {
+				if !strings.Contains(result.Diffs[j], diff) {
+					t.Errorf("got diff %q, want %q", result.Diffs[j], diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRunConfigOverride(t *testing.T) {
+	dir := writeFixtures(t)
+
+	// Every tenant is denied by the replaced configuration
+	override := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(override, []byte(strings.ReplaceAll(testConfig, "allowlist", "denylist")), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Run(filepath.Join(dir, "tests", "team-a.yaml"), override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Passed() {
+		t.Error("the fixture passed with the replaced configuration")
+	}
+
+	// The configuration is not a fixture
+	results, err = Run(filepath.Join(dir, "config.yaml"), "")
+	if err != nil || results != nil {
+		t.Errorf("got results %v (%v), want none", results, err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := writeFixtures(t)
+
+	files, err := Files([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(dir, "config.yaml"), filepath.Join(dir, "tests", "team-a.yaml")}
+	if !slices.Equal(files, want) {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+
+	if _, err := Files([]string{filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Error("missing fixture file did not fail")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
 	oidc "github.com/coreos/go-oidc"
 )
 
@@ -25,8 +26,12 @@ type EntraProvider struct {
 }
 
 func New(settings *AzureSettings) (*EntraProvider, error) {
+	// The key set is refreshed in the background with the client of this context
+	httpClient := &http.Client{Transport: &metrics.JWKSTransport{}}
+	ctx := oidc.ClientContext(context.Background(), httpClient)
+
 	discovery := fmt.Sprintf(DiscoveryEndpoint, settings.TenantID)
-	provider, err := oidc.NewProvider(context.Background(), discovery)
+	provider, err := oidc.NewProvider(ctx, discovery)
 	if err != nil {
 		return nil, err
 	}
@@ -36,7 +41,7 @@ func New(settings *AzureSettings) (*EntraProvider, error) {
 	return &EntraProvider{
 		oidcVerifier: oidcVerifier,
 		settings:     settings,
-		httpClient:   &http.Client{},
+		httpClient:   httpClient,
 	}, nil
 }
 
@@ -0,0 +1,291 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// Backend stores the rate limiting state
+type Backend interface {
+	// Allow takes a token from the bucket identified by key
+	// When no token is available, retryAfter is how long until the next one
+	Allow(ctx context.Context, key string, limit rate.Limit, burst int) (allowed bool, retryAfter time.Duration, err error)
+	// Acquire reserves one of the max in-flight slots identified by key
+	Acquire(ctx context.Context, key string, max int) (bool, error)
+	// Release frees a slot reserved by Acquire
+	Release(ctx context.Context, key string) error
+	// Close releases the resources of the backend, e.g. its connections
+	Close() error
+}
+
+// Request identifies who is sending a request
+type Request struct {
+	User   string
+	Groups []string
+	Tenant string
+}
+
+// LimitError is returned when a request exceeds a rate or concurrency limit
+type LimitError struct {
+	Key        string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s for %s", e.Reason, e.Key)
+}
+
+// RetryAfterSeconds returns the value of the Retry-After header
+func (e *LimitError) RetryAfterSeconds() int {
+	return max(1, int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// Limiter enforces the rate limits of a destination
+type Limiter struct {
+	backend Backend
+	limits  []config.RateLimit
+	prefix  string
+
+	// active counts the requests that did not release their slots yet
+	// the backend is only closed once they did
+	mu     sync.Mutex
+	active int
+	closed bool
+	once   sync.Once
+}
+
+// New returns a Limiter for the destination identified by name
+// The state is kept in memory unless a shared backend is configured
+// timeout bounds the duration of the requests of the destination, zero when they are not bounded
+func New(settings config.RateLimiting, name string, timeout time.Duration) (*Limiter, error) {
+	for _, limit := range settings.Limits {
+		switch limit.Key {
+		case config.RateLimitUser, config.RateLimitGroup, config.RateLimitTenant:
+		default:
+			// An unknown key would silently disable the limit
+			return nil, fmt.Errorf("invalid rate limit key %q, available options: %v",
+				limit.Key, []config.RateLimitKey{config.RateLimitUser, config.RateLimitGroup, config.RateLimitTenant})
+		}
+	}
+
+	var backend Backend = newLocalBackend()
+	if settings.Redis != nil {
+		var err error
+		backend, err = newRedisBackend(settings.Redis, timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Limiter{
+		backend: backend,
+		limits:  settings.Limits,
+		prefix:  name,
+	}, nil
+}
+
+// Take checks every limit that applies to the request
+// release must be called once the request is done to free the concurrency slots
+func (l *Limiter) Take(ctx context.Context, r Request) (release func(), err error) {
+	l.mu.Lock()
+	l.active++
+	l.mu.Unlock()
+
+	acquired := make([]string, 0)
+	release = func() {
+		for _, key := range acquired {
+			// Use a fresh context, the request one may already be canceled
+			if err := l.backend.Release(context.Background(), key); err != nil {
+				log.Printf("failed to release rate limit slot %s: %v", key, err)
+			}
+		}
+		l.done()
+	}
+
+	for _, limit := range l.limits {
+		for _, b := range l.buckets(limit.Key, r) {
+			if limit.Rate > 0 {
+				allowed, retryAfter, err := l.backend.Allow(ctx, "rate:"+b.key, rate.Limit(limit.Rate), max(limit.Burst, 1))
+				if err != nil {
+					release()
+					return func() {}, err
+				}
+				if !allowed {
+					release()
+					return func() {}, &LimitError{Key: b.name, Reason: "rate limit exceeded", RetryAfter: retryAfter}
+				}
+			}
+
+			if limit.MaxConcurrent > 0 {
+				ok, err := l.backend.Acquire(ctx, "inflight:"+b.key, limit.MaxConcurrent)
+				if err != nil {
+					release()
+					return func() {}, err
+				}
+				if !ok {
+					release()
+					return func() {}, &LimitError{Key: b.name, Reason: "too many concurrent requests", RetryAfter: time.Second}
+				}
+				acquired = append(acquired, "inflight:"+b.key)
+			}
+		}
+	}
+
+	return release, nil
+}
+
+// done records that a request released its slots and closes the backend after the last one
+func (l *Limiter) done() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if l.closed && l.active == 0 {
+		l.closeBackend()
+	}
+}
+
+// Close closes the backend once the requests in flight released their slots
+// The limiter must not be used afterwards, e.g. it was replaced by a configuration reload
+func (l *Limiter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.active == 0 {
+		l.closeBackend()
+	}
+}
+
+func (l *Limiter) closeBackend() {
+	// A request may still take the limiter of a state that was just replaced
+	l.once.Do(func() {
+		if err := l.backend.Close(); err != nil {
+			log.Printf("failed to close rate limiting backend of %s: %v", l.prefix, err)
+		}
+	})
+}
+
+// bucket identifies the state of a limit
+type bucket struct {
+	// key is unique across destinations and tenants
+	key string
+	// name is shown to the user
+	name string
+}
+
+// buckets returns the buckets of the request for a limit
+func (l *Limiter) buckets(key config.RateLimitKey, r Request) []bucket {
+	base := l.prefix + ":" + r.Tenant + ":" + string(key)
+
+	switch key {
+	case config.RateLimitUser:
+		return []bucket{{key: base + ":" + r.User, name: "user " + r.User}}
+	case config.RateLimitGroup:
+		buckets := make([]bucket, 0, len(r.Groups))
+		for _, group := range r.Groups {
+			buckets = append(buckets, bucket{key: base + ":" + group, name: "group " + group})
+		}
+		return buckets
+	case config.RateLimitTenant:
+		return []bucket{{key: base, name: "tenant " + r.Tenant}}
+	default:
+		return nil
+	}
+}
+
+// sweepInterval is how often the local backend evicts the idle buckets
+const sweepInterval = time.Minute
+
+// localBackend keeps the rate limiting state in memory
+// Limits are only enforced per gateway replica
+type localBackend struct {
+	mu       sync.Mutex
+	buckets  map[string]*rate.Limiter
+	inflight map[string]int
+	// swept is when the idle buckets were last evicted
+	swept time.Time
+}
+
+func newLocalBackend() *localBackend {
+	return &localBackend{
+		buckets:  map[string]*rate.Limiter{},
+		inflight: map[string]int{},
+	}
+}
+
+func (b *localBackend) Allow(_ context.Context, key string, limit rate.Limit, burst int) (bool, time.Duration, error) {
+	b.mu.Lock()
+	if now := time.Now(); now.Sub(b.swept) >= sweepInterval {
+		b.sweep(now)
+	}
+	bucket, ok := b.buckets[key]
+	if !ok || bucket.Limit() != limit || bucket.Burst() != burst {
+		bucket = rate.NewLimiter(limit, burst)
+		b.buckets[key] = bucket
+	}
+	b.mu.Unlock()
+
+	now := time.Now()
+	reservation := bucket.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second, nil
+	}
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay, nil
+	}
+
+	return true, 0, nil
+}
+
+// sweep evicts the buckets that refilled, they are recreated full when they are used again
+// Every user, group and tenant that sent a request would otherwise be kept forever
+func (b *localBackend) sweep(now time.Time) {
+	b.swept = now
+	for key, bucket := range b.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+func (b *localBackend) Acquire(_ context.Context, key string, max int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.inflight[key] >= max {
+		return false, nil
+	}
+	b.inflight[key]++
+
+	return true, nil
+}
+
+func (b *localBackend) Release(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inflight[key]--
+	if b.inflight[key] <= 0 {
+		delete(b.inflight, key)
+	}
+
+	return nil
+}
+
+func (b *localBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,230 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/alicebob/miniredis/v2"
+	"golang.org/x/time/rate"
+)
+
+// newLimiters returns a limiter for each backend, the Redis one uses an in-process server
+func newLimiters(t *testing.T, limits ...config.RateLimit) (map[string]*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+
+	local, err := New(config.RateLimiting{Limits: limits}, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := New(config.RateLimiting{Limits: limits, Redis: &config.RedisSettings{Address: server.Addr()}}, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]*Limiter{"local": local, "redis": shared}, server
+}
+
+func TestRateLimit(t *testing.T) {
+	limiters, _ := newLimiters(t, config.RateLimit{Key: config.RateLimitUser, Rate: 0.1, Burst: 2})
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			alice := Request{User: "alice", Tenant: "t1"}
+
+			for i := 0; i < 2; i++ {
+				release, err := limiter.Take(ctx, alice)
+				if err != nil {
+					t.Fatalf("request %d: unexpected error: %v", i, err)
+				}
+				release()
+			}
+
+			_, err := limiter.Take(ctx, alice)
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("got %v, want a rate limit error", err)
+			}
+			if limitErr.RetryAfter <= 0 {
+				t.Errorf("got retry after %s, want a positive duration", limitErr.RetryAfter)
+			}
+
+			// Users do not share buckets
+			release, err := limiter.Take(ctx, Request{User: "bob", Tenant: "t1"})
+			if err != nil {
+				t.Fatalf("unexpected error for another user: %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	limiters, _ := newLimiters(t, config.RateLimit{Key: config.RateLimitGroup, MaxConcurrent: 1})
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			request := Request{User: "alice", Groups: []string{"team-a"}, Tenant: "t1"}
+
+			release, err := limiter.Take(ctx, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var limitErr *LimitError
+			if _, err := limiter.Take(ctx, Request{User: "bob", Groups: []string{"team-a"}, Tenant: "t1"}); !errors.As(err, &limitErr) {
+				t.Fatalf("got %v, want a concurrency limit error", err)
+			}
+
+			release()
+
+			release, err = limiter.Take(ctx, request)
+			if err != nil {
+				t.Fatalf("slot was not released: %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestRedisReleaseAfterExpiry(t *testing.T) {
+	limiters, server := newLimiters(t, config.RateLimit{Key: config.RateLimitUser, MaxConcurrent: 1})
+	limiter := limiters["redis"]
+	ctx := context.Background()
+	alice := Request{User: "alice", Tenant: "t1"}
+
+	release, err := limiter.Take(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replica took longer than the TTL, the slot expired before it was released
+	server.FastForward(defaultInflightTTL + time.Second)
+	release()
+
+	key := "inflight:test:t1:user:alice"
+	if server.Exists(key) {
+		value, _ := server.Get(key)
+		t.Fatalf("release recreated the expired counter with value %s", value)
+	}
+
+	release, err = limiter.Take(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if ttl := server.TTL(key); ttl <= 0 {
+		t.Errorf("counter has no TTL")
+	}
+
+	var limitErr *LimitError
+	if _, err := limiter.Take(ctx, alice); !errors.As(err, &limitErr) {
+		t.Fatalf("got %v, want the concurrency limit to still be enforced", err)
+	}
+}
+
+func TestRedisReleaseKeepsTTL(t *testing.T) {
+	limiters, server := newLimiters(t, config.RateLimit{Key: config.RateLimitUser, MaxConcurrent: 2})
+	limiter := limiters["redis"]
+	ctx := context.Background()
+	alice := Request{User: "alice", Tenant: "t1"}
+
+	first, err := limiter.Take(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := limiter.Take(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second()
+
+	first()
+
+	key := "inflight:test:t1:user:alice"
+	if value, _ := server.Get(key); value != "1" {
+		t.Errorf("got counter %q, want 1", value)
+	}
+	if ttl := server.TTL(key); ttl <= 0 {
+		t.Errorf("release removed the TTL of the counter")
+	}
+}
+
+func TestNewRejectsUnknownKey(t *testing.T) {
+	_, err := New(config.RateLimiting{Limits: []config.RateLimit{{Key: "bogus", Rate: 1}}}, "test", 0)
+	if err == nil {
+		t.Fatal("an unknown key was accepted and would disable the limit")
+	}
+}
+
+func TestRedisInflightTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"unbounded requests", 0, defaultInflightTTL},
+		{"request timeout", 20 * time.Minute, 20*time.Minute + inflightTTLMargin},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := config.RateLimiting{
+				Limits: []config.RateLimit{{Key: config.RateLimitUser, MaxConcurrent: 1}},
+				Redis:  &config.RedisSettings{Address: server.Addr()},
+			}
+			limiter, err := New(settings, "ttl", tt.timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			release, err := limiter.Take(context.Background(), Request{User: "alice", Tenant: "t1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+
+			if ttl := server.TTL("inflight:ttl:t1:user:alice"); ttl != tt.want {
+				t.Errorf("got TTL %s, want %s", ttl, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalBucketsEviction(t *testing.T) {
+	backend := newLocalBackend()
+	ctx := context.Background()
+
+	// Refilled almost immediately
+	if _, _, err := backend.Allow(ctx, "fast", rate.Limit(1000), 1); err != nil {
+		t.Fatal(err)
+	}
+	// Still empty at the next sweep
+	if _, _, err := backend.Allow(ctx, "slow", rate.Limit(0.001), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	backend.sweep(time.Now())
+
+	if _, ok := backend.buckets["fast"]; ok {
+		t.Error("the refilled bucket was not evicted")
+	}
+	if _, ok := backend.buckets["slow"]; !ok {
+		t.Error("the bucket was evicted before it refilled")
+	}
+
+	// The evicted bucket is recreated full
+	if allowed, _, err := backend.Allow(ctx, "fast", rate.Limit(1000), 1); err != nil || !allowed {
+		t.Errorf("got %t (%v), want the request allowed", allowed, err)
+	}
+}
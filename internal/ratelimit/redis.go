@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultInflightTTL expires concurrency slots of replicas that died before releasing them
+	// when the duration of the requests is not bounded
+	defaultInflightTTL = 5 * time.Minute
+	// inflightTTLMargin is how long the slots outlive the timeout of the requests
+	inflightTTLMargin = time.Minute
+)
+
+// tokenBucket refills the bucket based on the elapsed time and takes a token
+// KEYS[1] - bucket key
+// ARGV[1] - refill rate in tokens per second
+// ARGV[2] - bucket size
+// returns {allowed, milliseconds until the next token}
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local last = tonumber(redis.call("HGET", KEYS[1], "ts"))
+if tokens == nil or last == nil then
+	tokens = burst
+	last = now
+end
+
+tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+
+return {allowed, wait}
+`)
+
+// acquire increments the in-flight counter if it is below the maximum
+// KEYS[1] - counter key
+// ARGV[1] - maximum
+// ARGV[2] - counter TTL in seconds
+var acquire = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if current >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+// release decrements the in-flight counter without recreating an expired counter
+// DECR on a missing key would create it at -1 without TTL and raise the maximum forever
+// KEYS[1] - counter key
+var release = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if current <= 1 then
+	redis.call("DEL", KEYS[1])
+	return 0
+end
+-- DECR keeps the TTL
+return redis.call("DECR", KEYS[1])
+`)
+
+// redisBackend shares the rate limiting state between gateway replicas
+// using any server that speaks the Redis protocol and supports Lua scripts
+type redisBackend struct {
+	client *redis.Client
+	// inflightTTL must be longer than the requests, the slots of live requests would expire otherwise
+	inflightTTL time.Duration
+}
+
+func newRedisBackend(settings *config.RedisSettings, timeout time.Duration) (*redisBackend, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     settings.Address,
+		Username: settings.Username,
+		Password: settings.Password,
+		DB:       settings.DB,
+	})
+
+	ttl := defaultInflightTTL
+	if timeout > 0 {
+		ttl = timeout + inflightTTLMargin
+	}
+
+	return &redisBackend{client: client, inflightTTL: ttl}, nil
+}
+
+func (b *redisBackend) Allow(ctx context.Context, key string, limit rate.Limit, burst int) (bool, time.Duration, error) {
+	result, err := tokenBucket.Run(ctx, b.client, []string{key}, float64(limit), burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (b *redisBackend) Acquire(ctx context.Context, key string, max int) (bool, error) {
+	ok, err := acquire.Run(ctx, b.client, []string{key}, max, int(math.Ceil(b.inflightTTL.Seconds()))).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return ok == 1, nil
+}
+
+func (b *redisBackend) Release(ctx context.Context, key string) error {
+	return release.Run(ctx, b.client, []string{key}).Err()
+}
+
+func (b *redisBackend) Close() error {
+	return b.client.Close()
+}
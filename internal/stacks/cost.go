@@ -0,0 +1,96 @@
+package stacks
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	QueryCostHeader        = "X-Query-Cost"
+	QueryCostWarningHeader = "X-Query-Cost-Warning"
+)
+
+// Cost is the estimated cost of a query and the reasons behind it
+type Cost struct {
+	Score   int
+	Reasons []string
+}
+
+// Add increases the cost of the query
+func (c *Cost) Add(score int, format string, args ...any) {
+	c.Score += score
+	c.Reasons = append(c.Reasons, fmt.Sprintf("%s (+%d)", fmt.Sprintf(format, args...), score))
+}
+
+// String returns a human readable explanation of the cost
+func (c Cost) String() string {
+	return fmt.Sprintf("%d: %s", c.Score, strings.Join(c.Reasons, ", "))
+}
+
+// Selective reports whether the matchers select a bounded set of series or streams
+// i.e. at least one matcher only matches a known set of non-empty values
+func Selective(matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		switch m.Type {
+		case labels.MatchEqual:
+			if m.Value != "" {
+				return true
+			}
+		case labels.MatchRegexp:
+			if len(m.SetMatches()) > 0 && !m.Matches("") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Budget returns the cost budget that applies to the user
+// When the user is part of multiple groups the most permissive budget is used
+// and a group without budget means that the queries are not limited
+func Budget(groups []config.Group) (config.CostBudget, bool) {
+	var budget config.CostBudget
+	for i, group := range groups {
+		if group.CostBudget.Max == 0 {
+			return config.CostBudget{}, false
+		}
+		if i == 0 || group.CostBudget.Max > budget.Max {
+			budget = group.CostBudget
+		}
+	}
+
+	return budget, len(groups) > 0
+}
+
+// CheckCost rejects, or warns about, queries that exceed the cost budget of the user
+func CheckCost(c echo.Context, cost Cost) error {
+	groups, ok, err := UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	budget, ok := Budget(groups)
+	if !ok {
+		return nil
+	}
+
+	c.Response().Header().Set(QueryCostHeader, fmt.Sprint(cost.Score))
+
+	if cost.Score <= budget.Max {
+		return nil
+	}
+
+	message := fmt.Sprintf("query cost %s exceeds the budget of %d", cost, budget.Max)
+	if budget.Action == config.CostActionWarn {
+		c.Response().Header().Set(QueryCostWarningHeader, message)
+		return nil
+	}
+
+	return echo.NewHTTPError(http.StatusUnprocessableEntity, message)
+}
@@ -0,0 +1,103 @@
+package stacks
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// Usage is what a query references, it is collected from the query AST by each stack
+type Usage struct {
+	Labels    []string
+	Stages    []string
+	Functions []string
+	// Extractors are the stages that extract every field, e.g. json without parameters
+	// They can extract any label, including the forbidden ones
+	Extractors []string
+}
+
+// AddLabels records label names referenced by the query
+func (u *Usage) AddLabels(names ...string) {
+	for _, name := range names {
+		if name != "" && !slices.Contains(u.Labels, name) {
+			u.Labels = append(u.Labels, name)
+		}
+	}
+}
+
+// AddStage records a pipeline stage used by the query
+func (u *Usage) AddStage(name string) {
+	if !slices.Contains(u.Stages, name) {
+		u.Stages = append(u.Stages, name)
+	}
+}
+
+// AddExtractor records a stage that extracts every field of the log lines
+func (u *Usage) AddExtractor(name string) {
+	if !slices.Contains(u.Extractors, name) {
+		u.Extractors = append(u.Extractors, name)
+	}
+}
+
+// AddFunction records a function or aggregation used by the query
+func (u *Usage) AddFunction(name string) {
+	if !slices.Contains(u.Functions, name) {
+		u.Functions = append(u.Functions, name)
+	}
+}
+
+// Forbidden returns what the groups can not reference in their queries
+// Like the LBAC matchers, the restrictions of all groups are combined
+func Forbidden(groups []config.Group) config.Forbidden {
+	var forbidden config.Forbidden
+	for _, group := range groups {
+		forbidden.Labels = append(forbidden.Labels, group.Forbidden.Labels...)
+		forbidden.Stages = append(forbidden.Stages, group.Forbidden.Stages...)
+		forbidden.Functions = append(forbidden.Functions, group.Forbidden.Functions...)
+	}
+
+	return forbidden
+}
+
+// CheckForbidden rejects queries that reference labels, stages or functions forbidden to the groups
+func CheckForbidden(groups []config.Group, usage Usage) error {
+	forbidden := Forbidden(groups)
+
+	for _, name := range usage.Labels {
+		if slices.Contains(forbidden.Labels, name) {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("label %s is not allowed in queries", name))
+		}
+	}
+
+	if len(usage.Extractors) > 0 && len(forbidden.Labels) > 0 {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("label %s is not allowed in queries and %s extracts every label, list the extracted labels instead",
+			forbidden.Labels[0], usage.Extractors[0]))
+	}
+
+	for _, name := range usage.Stages {
+		if slices.Contains(forbidden.Stages, name) {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("stage %s is not allowed in queries", name))
+		}
+	}
+
+	for _, name := range usage.Functions {
+		if slices.Contains(forbidden.Functions, name) {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("function %s is not allowed in queries", name))
+		}
+	}
+
+	return nil
+}
+
+// CheckLabelName rejects requests for the values of a label forbidden to the user
+func CheckLabelName(c echo.Context, name string) error {
+	groups, ok, err := UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	return CheckForbidden(groups, Usage{Labels: []string{name}})
+}
@@ -0,0 +1,241 @@
+package stacks
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/common/model"
+)
+
+// Limits returns the query limits that apply to the user
+// Group limits override the tenant limits, when the user is part of multiple
+// groups the most permissive value of each limit is used
+func Limits(tenant config.Tenant, groups []config.Group) config.Limits {
+	if len(groups) == 0 {
+		return tenant.Limits
+	}
+
+	limits := tenant.Limits.Merge(groups[0].Limits)
+	for _, group := range groups[1:] {
+		l := tenant.Limits.Merge(group.Limits)
+		limits = config.Limits{
+			MaxRange:       maxLimit(limits.MaxRange, l.MaxRange),
+			MaxLookback:    maxLimit(limits.MaxLookback, l.MaxLookback),
+			MinStep:        minLimit(limits.MinStep, l.MinStep),
+			MaxLimit:       maxLimit(limits.MaxLimit, l.MaxLimit),
+			MaxRangeVector: maxLimit(limits.MaxRangeVector, l.MaxRangeVector),
+		}
+	}
+
+	return limits
+}
+
+// maxLimit returns the most permissive of two maximum limits
+// zero means that the limit is not set
+func maxLimit[T time.Duration | int](a, b T) T {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return max(a, b)
+}
+
+// minLimit returns the most permissive of two minimum limits
+// zero means that the limit is not set
+func minLimit(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return min(a, b)
+}
+
+// Query returns the query of the query APIs
+// The upstreams only execute the first value, repeated values are rejected so that the checked query is the executed one
+func Query(c echo.Context) (string, error) {
+	params, err := Params(c)
+	if err != nil {
+		return "", err
+	}
+
+	if len(params["query"]) != 1 {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "exactly one query is required")
+	}
+
+	return params.Get("query"), nil
+}
+
+// Analysis is what the query checks need to know about a query
+type Analysis struct {
+	// RangeVector is the longest range vector (or subquery) duration found in the query
+	RangeVector time.Duration
+	// Lookback is how far before the evaluation time the query reads, with the ranges and offsets
+	Lookback time.Duration
+	// Earliest is the earliest time read by the selectors pinned with the @ modifier, zero when there is none
+	Earliest time.Time
+	Cost     Cost
+}
+
+// Analyzer parses a query in the query language of a stack and analyzes it
+type Analyzer func(query string) (Analysis, error)
+
+// CheckQuery enforces the query limits and the cost budget of the user on the query of the request
+// defaultSince is how long before the end range queries start when neither start nor since are set (Loki),
+// zero when start is required
+// MUST be called before the query is patched, the enforced matchers would make every query look selective
+func CheckQuery(c echo.Context, analyze Analyzer, defaultSince time.Duration) error {
+	query, err := Query(c)
+	if err != nil {
+		return err
+	}
+
+	analysis, err := analyze(query)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid query")
+	}
+
+	err = CheckLimits(c, analysis, defaultSince)
+	if err != nil {
+		return err
+	}
+
+	return CheckCost(c, analysis.Cost)
+}
+
+// CheckLimits enforces the query limits before the request is sent upstream
+// defaultSince is how long before the end range queries start when neither start nor since are set, zero when start is required
+func CheckLimits(c echo.Context, analysis Analysis, defaultSince time.Duration) error {
+	groups, ok, err := UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	tenant, _ := Tenant(c)
+	limits := Limits(tenant, groups)
+	if limits.IsEmpty() {
+		return nil
+	}
+
+	params, err := Params(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	end, err := parseTime(params.Get("end"), now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid end")
+	}
+	since := defaultSince
+	if value := params.Get("since"); value != "" && defaultSince > 0 {
+		since, err = parseDuration(value)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid since")
+		}
+	}
+
+	// Like Loki, a future end does not move the default start
+	endOrNow := end
+	if end.After(now) {
+		endOrNow = now
+	}
+	start, err := parseTime(params.Get("start"), endOrNow.Add(-since))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid start")
+	}
+	if params.Get("time") != "" {
+		// instant query
+		start, err = parseTime(params.Get("time"), now)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid time")
+		}
+		end = start
+	}
+
+	if limits.MaxRange > 0 && end.Sub(start) > limits.MaxRange {
+		return limitError("query time range of %s exceeds the maximum of %s", end.Sub(start), limits.MaxRange)
+	}
+
+	// Offsets move the selectors further in the past and @ pins them regardless of the query range
+	lookback := now.Sub(start) + max(analysis.Lookback, analysis.RangeVector)
+	if !analysis.Earliest.IsZero() {
+		lookback = max(lookback, now.Sub(analysis.Earliest))
+	}
+	if limits.MaxLookback > 0 && lookback > limits.MaxLookback {
+		return limitError("query lookback of %s exceeds the maximum of %s", lookback, limits.MaxLookback)
+	}
+
+	if limits.MaxRangeVector > 0 && analysis.RangeVector > limits.MaxRangeVector {
+		return limitError("range vector of %s exceeds the maximum of %s", analysis.RangeVector, limits.MaxRangeVector)
+	}
+
+	if step := params.Get("step"); limits.MinStep > 0 && step != "" {
+		d, err := parseDuration(step)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid step")
+		}
+		if d < limits.MinStep {
+			return limitError("query step of %s is lower than the minimum of %s", d, limits.MinStep)
+		}
+	}
+
+	if limit := params.Get("limit"); limits.MaxLimit > 0 && limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+		if n > limits.MaxLimit {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity,
+				fmt.Sprintf("query limit of %d exceeds the maximum of %d", n, limits.MaxLimit))
+		}
+	}
+
+	return nil
+}
+
+func limitError(format string, value, limit time.Duration) error {
+	return echo.NewHTTPError(http.StatusUnprocessableEntity,
+		fmt.Sprintf(format, model.Duration(value.Round(time.Second)), model.Duration(limit)))
+}
+
+// parseTime parses the timestamps accepted by the Prometheus and Loki APIs
+// RFC3339, unix seconds (with optional decimals) or unix nanoseconds
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if strings.Contains(value, ".") {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			s, ns := math.Modf(f)
+			return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+		}
+	}
+
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if len(value) <= 10 {
+			return time.Unix(n, 0), nil
+		}
+		return time.Unix(0, n), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// parseDuration parses the durations accepted by the Prometheus and Loki APIs
+// a duration string (e.g. 5m) or a number of seconds
+func parseDuration(value string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+
+	d, err := model.ParseDuration(value)
+	return time.Duration(d), err
+}
@@ -0,0 +1,57 @@
+package loki
+
+import (
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+const (
+	costUnboundedSelector = 100
+	costTopK              = 50
+	costUnfilteredParser  = 20
+	costRangePerHour      = 1
+
+	// topk and bottomk above this are considered unbounded
+	maxTopK = 100
+)
+
+// EstimateCost statically estimates the cost of a LogQL expression
+func EstimateCost(e syntax.Expr) stacks.Cost {
+	var cost stacks.Cost
+
+	for _, selector := range getSelectors(e) {
+		if !stacks.Selective(selector.Mts) {
+			cost.Add(costUnboundedSelector, "stream selector %s matches every stream", selector)
+		}
+	}
+
+	parsers, filters := 0, 0
+	e.Walk(func(e syntax.Expr) {
+		switch n := e.(type) {
+		case *syntax.LogRange:
+			if hours := int(n.Interval / time.Hour); hours > 0 {
+				cost.Add(hours*costRangePerHour, "range of %s", n.Interval)
+			}
+
+		case *syntax.VectorAggregationExpr:
+			if (n.Operation == syntax.OpTypeTopK || n.Operation == syntax.OpTypeBottomK) && n.Params > maxTopK {
+				cost.Add(costTopK, "%s(%d) is unbounded", n.Operation, n.Params)
+			}
+
+		case *syntax.LabelParserExpr, *syntax.LogfmtParserExpr,
+			*syntax.JSONExpressionParser, *syntax.LogfmtExpressionParser:
+			parsers++
+
+		case *syntax.LineFilterExpr:
+			filters++
+		}
+	})
+
+	if parsers > 0 && filters == 0 {
+		cost.Add(costUnfilteredParser, "every log line is parsed without a line filter")
+	}
+
+	return cost
+}
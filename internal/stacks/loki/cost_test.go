@@ -0,0 +1,102 @@
+package loki
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestEstimateCost(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{`{app="api"}`, 0},
+		{`{app=~".+"}`, costUnboundedSelector},
+		{`{app="api"} | json`, costUnfilteredParser},
+		{`{app="api"} |= "error" | json`, 0},
+		{`count_over_time({app="api"}[3h])`, 3 * costRangePerHour},
+		{`topk(10, count_over_time({app="api"}[5m]))`, 0},
+		{`topk(1000, count_over_time({app="api"}[5m]))`, costTopK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := syntax.ParseExpr(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := EstimateCost(expr); got.Score != tt.want {
+				t.Errorf("got cost %s, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleQueryCost(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackLoki,
+		Upstream: "http://localhost:3100",
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode: config.ModeAllowList,
+				Groups: []config.Group{{
+					Name:       "team-a",
+					Matchers:   []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+					CostBudget: config.CostBudget{Max: 50, Action: config.CostActionReject},
+				}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		cost   string
+		status int
+	}{
+		{"selective", `{app="api"}`, "0", 0},
+		// The enforced team matcher does not make the query of the user selective
+		{"unbounded", `{app=~".+"}`, "", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query="+url.QueryEscape(tt.query), nil)
+			c := echo.New().NewContext(req, rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+
+			err := Handle(c)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+			if tt.status != 0 {
+				return
+			}
+
+			if got := rec.Header().Get(stacks.QueryCostHeader); got != tt.cost {
+				t.Errorf("got cost %q, want %q", got, tt.cost)
+			}
+		})
+	}
+}
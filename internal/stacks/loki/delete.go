@@ -0,0 +1,122 @@
+package loki
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+// deleteRequest is a log deletion request as returned by the list API
+type deleteRequest struct {
+	RequestID string `json:"request_id"`
+	Query     string `json:"query"`
+}
+
+// HandleDelete enforces authorization on the log deletion API
+// POST|PUT /delete?query=<selector>&start=<time>&end=<time> - create a delete request
+// GET      /delete                                          - list delete requests
+// DELETE   /delete?request_id=<id>                          - cancel a delete request
+func HandleDelete(c echo.Context) error {
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The delete role is set by tenant, undefined tenants have none
+		return echo.NewHTTPError(http.StatusForbidden, "log deletion is not allowed on undefined tenants")
+	}
+
+	tenant, _ := stacks.Tenant(c)
+	if !stacks.HasRole(c, tenant.Roles.Delete) {
+		return echo.NewHTTPError(http.StatusForbidden, "missing role to manage log deletion")
+	}
+
+	enforcedLabels := stacks.Matchers(groups)
+
+	switch c.Request().Method {
+	case http.MethodPost, http.MethodPut:
+		// A user can only delete what they can read
+		err := PatchQuery(c, "query")
+		if err != nil {
+			return err
+		}
+
+		// Loki only reads the parameters of delete requests from the URL, even for forms
+		params, err := stacks.Params(c)
+		if err != nil {
+			return err
+		}
+		c.Request().URL.RawQuery = params.Encode()
+		stacks.SetBody(c, nil)
+
+		return nil
+
+	case http.MethodGet:
+		if len(enforcedLabels) == 0 {
+			return nil
+		}
+
+		stacks.ModifyResponse(c, func(body []byte) ([]byte, error) {
+			return stacks.FilterArray(body, func(item json.RawMessage) (json.RawMessage, error) {
+				var request deleteRequest
+				if err := json.Unmarshal(item, &request); err != nil {
+					return nil, err
+				}
+				if ok, err := Permitted(request.Query, groups); err != nil || !ok {
+					return nil, err
+				}
+				return item, nil
+			})
+		})
+		return nil
+
+	case http.MethodDelete:
+		if len(enforcedLabels) == 0 {
+			return nil
+		}
+
+		return checkDeleteRequest(c, c.QueryParam("request_id"), groups)
+
+	default:
+		return echo.ErrMethodNotAllowed
+	}
+}
+
+// checkDeleteRequest looks up an existing delete request and checks that the user could have created it
+func checkDeleteRequest(c echo.Context, id string, groups []config.Group) error {
+	destination := c.Get("destination").(config.Destination)
+
+	body, err := stacks.Get(c, destination.APIPrefix()+RouteDelete, nil)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to lookup delete request")
+	}
+
+	var requests []deleteRequest
+	if err := json.Unmarshal(body, &requests); err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "invalid delete requests")
+	}
+
+	found := false
+	for _, request := range requests {
+		if request.RequestID != id {
+			continue
+		}
+
+		// Large requests are split, every part must be permitted
+		if ok, err := Permitted(request.Query, groups); err != nil || !ok {
+			return echo.ErrNotFound
+		}
+		found = true
+	}
+
+	if !found {
+		return echo.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package loki
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestHandleDeleteKeepsParametersInURL(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackLoki,
+		Upstream: "http://localhost:3100",
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode:  config.ModeAllowList,
+				Roles: config.Roles{Delete: "logs-admin"},
+				Groups: []config.Group{{
+					Name:     "team-a",
+					Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+				}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{"url", "/loki/api/v1/delete?query=%7Bapp%3D%22api%22%7D&start=1&end=2", ""},
+		{"form", "/loki/api/v1/delete", `query=%7Bapp%3D%22api%22%7D&start=1&end=2`},
+		{"form and url", "/loki/api/v1/delete?start=1&end=2", `query=%7Bapp%3D%22api%22%7D`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.url, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+			c.Set("roles", []string{"logs-admin"})
+
+			if err := HandleDelete(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			query := c.Request().URL.Query()
+			if got, want := query.Get("query"), `{app="api", team="a"}`; got != want {
+				t.Errorf("got query %q, want %q", got, want)
+			}
+			if query.Get("start") != "1" || query.Get("end") != "2" {
+				t.Errorf("start and end are not in the URL: %s", c.Request().URL.RawQuery)
+			}
+
+			body, _ := io.ReadAll(c.Request().Body)
+			if params, _ := url.ParseQuery(string(body)); params.Has("query") {
+				t.Errorf("the unenforced query is still in the body: %s", body)
+			}
+		})
+	}
+}
+
+func TestHandleDeleteUndefinedTenant(t *testing.T) {
+	destination := config.Destination{
+		Type:           config.StackLoki,
+		Upstream:       "http://localhost:3100",
+		AllowUndefined: true,
+		Tenants:        map[string]config.Tenant{},
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodGet, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			req := httptest.NewRequest(method, "/loki/api/v1/delete?query=%7Bapp%3D%22api%22%7D&request_id=1", nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"undefined"})
+			c.Set("groups", []string{"team-a"})
+
+			err := HandleDelete(c)
+			var httpErr *echo.HTTPError
+			if !errors.As(err, &httpErr) || httpErr.Code != http.StatusForbidden {
+				t.Fatalf("got %v, want status %d", err, http.StatusForbidden)
+			}
+		})
+	}
+}
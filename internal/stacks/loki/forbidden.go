@@ -0,0 +1,225 @@
+package loki
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// Stages are the pipeline stages that can be forbidden
+var Stages = []string{
+	syntax.OpParserTypeJSON, syntax.OpParserTypeLogfmt, syntax.OpParserTypeRegexp,
+	syntax.OpParserTypeUnpack, syntax.OpParserTypePattern,
+	syntax.OpFmtLine, syntax.OpFmtLabel, syntax.OpDecolorize,
+	syntax.OpDrop, syntax.OpKeep, syntax.OpUnwrap,
+}
+
+var (
+	// templateField matches the labels referenced by line_format and label_format templates, e.g. {{ .user_ip }}
+	templateField = regexp.MustCompile(`\.([a-zA-Z_][a-zA-Z0-9_]*)`)
+	// identifier matches the fields of json and logfmt extraction expressions, e.g. user.password
+	identifier = regexp.MustCompile(`[a-zA-Z_][a-zA-Z0-9_]*`)
+	// patternCapture matches the named captures of a pattern expression, e.g. <user_ip>
+	patternCapture = regexp.MustCompile(`<([a-zA-Z_][a-zA-Z0-9_]*)>`)
+)
+
+// QueryUsage returns the labels and pipeline stages referenced by the expression
+func QueryUsage(e syntax.Expr) stacks.Usage {
+	var usage stacks.Usage
+
+	e.Walk(func(e syntax.Expr) {
+		switch n := e.(type) {
+		case *syntax.MatchersExpr:
+			for _, m := range n.Mts {
+				usage.AddLabels(m.Name)
+			}
+
+		case *syntax.LabelFilterExpr:
+			labelFilterUsage(&usage, n.LabelFilterer)
+
+		case *syntax.LabelParserExpr:
+			usage.AddStage(n.Op)
+			if n.Op == syntax.OpParserTypeRegexp || n.Op == syntax.OpParserTypePattern {
+				// Named captures become labels
+				usage.AddLabels(captureNames(n)...)
+			} else {
+				// json, logfmt and unpack without parameters extract every field
+				usage.AddExtractor(n.Op)
+			}
+
+		case *syntax.LogfmtParserExpr:
+			usage.AddStage(syntax.OpParserTypeLogfmt)
+			usage.AddExtractor(syntax.OpParserTypeLogfmt)
+
+		case *syntax.JSONExpressionParser:
+			usage.AddStage(syntax.OpParserTypeJSON)
+			extractionUsage(&usage, n.Expressions)
+
+		case *syntax.LogfmtExpressionParser:
+			usage.AddStage(syntax.OpParserTypeLogfmt)
+			extractionUsage(&usage, n.Expressions)
+
+		case *syntax.LineFmtExpr:
+			usage.AddStage(syntax.OpFmtLine)
+			templateUsage(&usage, n.Value)
+
+		case *syntax.LabelFmtExpr:
+			usage.AddStage(syntax.OpFmtLabel)
+			for _, f := range n.Formats {
+				usage.AddLabels(f.Name)
+				if f.Rename {
+					usage.AddLabels(f.Value)
+				} else {
+					templateUsage(&usage, f.Value)
+				}
+			}
+
+		case *syntax.DecolorizeExpr:
+			usage.AddStage(syntax.OpDecolorize)
+
+		case *syntax.DropLabelsExpr:
+			usage.AddStage(syntax.OpDrop)
+
+		case *syntax.KeepLabelsExpr:
+			usage.AddStage(syntax.OpKeep)
+
+		case *syntax.LogRange:
+			if n.Unwrap != nil {
+				usage.AddStage(syntax.OpUnwrap)
+				usage.AddLabels(n.Unwrap.Identifier)
+				for _, f := range n.Unwrap.PostFilters {
+					labelFilterUsage(&usage, f)
+				}
+			}
+
+		case *syntax.RangeAggregationExpr:
+			if n.Grouping != nil {
+				usage.AddLabels(n.Grouping.Groups...)
+			}
+
+		case *syntax.VectorAggregationExpr:
+			if n.Grouping != nil {
+				usage.AddLabels(n.Grouping.Groups...)
+			}
+
+		case *syntax.BinOpExpr:
+			if n.Opts != nil && n.Opts.VectorMatching != nil {
+				usage.AddLabels(n.Opts.VectorMatching.MatchingLabels...)
+				usage.AddLabels(n.Opts.VectorMatching.Include...)
+			}
+
+		case *syntax.LabelReplaceExpr:
+			usage.AddLabels(n.Dst, n.Src)
+		}
+	})
+
+	return usage
+}
+
+// CheckCopiedLabels rejects queries that copy the values of a masked label into another label or the log line
+func CheckCopiedLabels(c echo.Context) error {
+	params, err := stacks.Params(c)
+	if err != nil {
+		return err
+	}
+
+	expr, err := ParseQuery(params.Get("query"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid query")
+	}
+
+	return stacks.CheckCopiedLabels(c, CopiedLabels(expr))
+}
+
+// CopiedLabels returns the labels whose values are copied by label_format, line_format and label_replace
+// e.g. | label_format leak="{{ .customer_id }}" copies customer_id
+func CopiedLabels(e syntax.Expr) []string {
+	var usage stacks.Usage
+
+	e.Walk(func(e syntax.Expr) {
+		switch n := e.(type) {
+		case *syntax.LineFmtExpr:
+			templateUsage(&usage, n.Value)
+
+		case *syntax.LabelFmtExpr:
+			for _, f := range n.Formats {
+				if f.Rename {
+					usage.AddLabels(f.Value)
+				} else {
+					templateUsage(&usage, f.Value)
+				}
+			}
+
+		case *syntax.LabelReplaceExpr:
+			usage.AddLabels(n.Src)
+		}
+	})
+
+	return usage.Labels
+}
+
+// labelFilterUsage records the labels compared by a label filter, e.g. | user_ip = "1.2.3.4"
+func labelFilterUsage(usage *stacks.Usage, f log.LabelFilterer) {
+	switch n := f.(type) {
+	case *log.BinaryLabelFilter:
+		labelFilterUsage(usage, n.Left)
+		labelFilterUsage(usage, n.Right)
+	case *log.StringLabelFilter:
+		usage.AddLabels(n.Name)
+	case *log.LineFilterLabelFilter:
+		usage.AddLabels(n.Name)
+	case *log.NoopLabelFilter:
+		if n.Matcher != nil {
+			usage.AddLabels(n.Name)
+		}
+	case *log.NumericLabelFilter:
+		usage.AddLabels(n.Name)
+	case *log.DurationLabelFilter:
+		usage.AddLabels(n.Name)
+	case *log.BytesLabelFilter:
+		usage.AddLabels(n.Name)
+	case *log.IPLabelFilter:
+		usage.AddLabels(n.Label)
+	}
+}
+
+// extractionUsage records the labels created by json and logfmt expressions and the fields they read
+// e.g. | json pw="user.password" references pw, user and password
+func extractionUsage(usage *stacks.Usage, expressions []log.LabelExtractionExpr) {
+	for _, e := range expressions {
+		usage.AddLabels(e.Identifier)
+		usage.AddLabels(identifier.FindAllString(e.Expression, -1)...)
+	}
+}
+
+// templateUsage records the labels referenced by a template
+func templateUsage(usage *stacks.Usage, template string) {
+	for _, m := range templateField.FindAllStringSubmatch(template, -1) {
+		usage.AddLabels(m[1])
+	}
+}
+
+// captureNames returns the labels extracted by a regexp or pattern parser
+func captureNames(e *syntax.LabelParserExpr) []string {
+	if e.Op == syntax.OpParserTypeRegexp {
+		re, err := regexp.Compile(e.Param)
+		if err != nil {
+			return nil
+		}
+		return re.SubexpNames()
+	}
+
+	// <name> captures of the pattern, <_> is not captured
+	names := make([]string, 0)
+	for _, m := range patternCapture.FindAllStringSubmatch(e.Param, -1) {
+		if m[1] != "_" {
+			names = append(names, m[1])
+		}
+	}
+
+	return names
+}
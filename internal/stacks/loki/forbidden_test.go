@@ -0,0 +1,61 @@
+package loki
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCheckForbidden(t *testing.T) {
+	groups := []config.Group{{Name: "team-a", Forbidden: config.Forbidden{Labels: []string{"user_ip"}}}}
+
+	tests := []struct {
+		name    string
+		query   string
+		denied  bool
+		noLimit bool
+	}{
+		{name: "selector", query: `{app="api", user_ip="10.0.0.1"}`, denied: true},
+		{name: "json extraction", query: `{app="api"} | json user_ip="client.ip"`, denied: true},
+		{name: "json extraction of other fields", query: `{app="api"} | json path="request.path"`},
+		{name: "json", query: `{app="api"} | json`, denied: true},
+		{name: "logfmt", query: `{app="api"} | logfmt`, denied: true},
+		{name: "strict logfmt", query: `{app="api"} | logfmt --strict`, denied: true},
+		{name: "unpack", query: `{app="api"} | unpack`, denied: true},
+		{name: "json in a metric query", query: `sum by (path) (count_over_time({app="api"} | json [5m]))`, denied: true},
+		{name: "logfmt extraction", query: `{app="api"} | logfmt path`},
+		{name: "regexp", query: `{app="api"} | regexp "(?P<path>/\\S+)"`},
+		{name: "json without forbidden labels", query: `{app="api"} | json`, noLimit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g := groups
+			if tt.noLimit {
+				g = []config.Group{{Name: "team-b"}}
+			}
+
+			err = stacks.CheckForbidden(g, QueryUsage(expr))
+
+			var httpErr *echo.HTTPError
+			if tt.denied {
+				if !errors.As(err, &httpErr) || httpErr.Code != http.StatusForbidden {
+					t.Fatalf("got %v, want the query to be denied", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package loki
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCheckQueryLimits(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackLoki,
+		Upstream: "http://localhost:3100",
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode:   config.ModeAllowList,
+				Groups: []config.Group{{Name: "team-a"}},
+				Limits: config.Limits{MaxRange: 7 * 24 * time.Hour, MaxLookback: 30 * 24 * time.Hour},
+			},
+			"short": {
+				Mode:   config.ModeAllowList,
+				Groups: []config.Group{{Name: "team-a"}},
+				Limits: config.Limits{MaxRange: 30 * time.Minute},
+			},
+		},
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name   string
+		tenant string
+		query  string
+		status int
+	}{
+		{"default since", "t1", "query=%7Bapp%3D%22api%22%7D", 0},
+		{"since within the limits", "t1", "query=%7Bapp%3D%22api%22%7D&since=24h", 0},
+		{"since over the range", "t1", "query=%7Bapp%3D%22api%22%7D&since=90d", http.StatusUnprocessableEntity},
+		{"default since over the range", "short", "query=%7Bapp%3D%22api%22%7D", http.StatusUnprocessableEntity},
+		{"start overrides since", "short", "query=%7Bapp%3D%22api%22%7D&since=90d&start=" + time.Now().Add(-10*time.Minute).Format(time.RFC3339), 0},
+		{"invalid since", "t1", "query=%7Bapp%3D%22api%22%7D&since=x", http.StatusBadRequest},
+		{"repeated query", "t1", "query=%7Bapp%3D%22api%22%7D&query=%7Bapp%3D%22db%22%7D", http.StatusBadRequest},
+		{"offset within the lookback", "t1", "query=" + url.QueryEscape(`count_over_time({a="b"}[1h] offset 1d)`) + "&time=" + now, 0},
+		{"offset over the lookback", "t1", "query=" + url.QueryEscape(`count_over_time({a="b"}[1h] offset 89d)`) + "&time=" + now, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?"+tt.query, nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{tt.tenant})
+			c.Set("groups", []string{"team-a"})
+
+			err := stacks.CheckQuery(c, Analyze, DefaultSince)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
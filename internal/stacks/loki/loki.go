@@ -4,42 +4,184 @@ import (
 	"log"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/prometheus/model/labels"
 )
 
+// Routes are relative to the destination API prefix
 const (
-	RouteInstantQuery      = "/loki/api/v1/query"
-	RouteRangeQuery        = "/loki/api/v1/query_range"
-	RouteLabels            = "/loki/api/v1/labels"
-	RouteLabelValuesPrefix = "/loki/api/v1/label/"
-	RouteSeries            = "/loki/api/v1/series"
-	RouteIndexStats        = "/loki/api/v1/index/stats"
-	RouteInstantLogVolume  = "/loki/api/v1/index/volume"
-	RouteRangeLogVolume    = "/loki/api/v1/index/volume_range"
-	RoutePattern           = "/loki/api/v1/patterns"
-	RouteTailStream        = "/loki/api/v1/tail" // WebSocket
+	RouteInstantQuery        = "/api/v1/query"
+	RouteRangeQuery          = "/api/v1/query_range"
+	RouteLabels              = "/api/v1/labels"
+	RouteLabelValuesPrefix   = "/api/v1/label/"
+	RouteSeries              = "/api/v1/series"
+	RouteIndexStats          = "/api/v1/index/stats"
+	RouteInstantLogVolume    = "/api/v1/index/volume"
+	RouteRangeLogVolume      = "/api/v1/index/volume_range"
+	RoutePattern             = "/api/v1/patterns"
+	RouteDetectedFields      = "/api/v1/detected_fields"
+	RouteDetectedLabels      = "/api/v1/detected_labels"
+	RouteDetectedFieldPrefix = "/api/v1/detected_field/" // /api/v1/detected_field/<name>/values
+	RouteIndexShards         = "/api/v1/index/shards"
+	RouteTailStream          = "/api/v1/tail" // WebSocket
+	RouteRulerConfig         = "/api/v1/rules"
+	RouteDelete              = "/api/v1/delete"
+	RouteBuildInfo           = "/api/v1/status/buildinfo"
+
+	// Prometheus compatible ruler routes, these are not served under the API prefix
+	RoutePrometheusRules  = "/prometheus/api/v1/rules"
+	RoutePrometheusAlerts = "/prometheus/api/v1/alerts"
 )
 
+// DefaultSince is how long before end Loki range queries start when start is not set
+const DefaultSince = time.Hour
+
 type Label struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 }
 
 func Handle(c echo.Context) error {
-	path := c.Request().URL.Path
+	switch c.Request().URL.Path {
+	case RoutePrometheusRules:
+		err := stacks.FilterPrometheusRules(c, Permitted)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RoutePrometheusAlerts:
+		err := stacks.FilterPrometheusAlerts(c, RoutePrometheusRules, Permitted)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+	}
+
+	destination := c.Get("destination").(config.Destination)
+	path, ok := strings.CutPrefix(c.Request().URL.Path, destination.APIPrefix())
+	if !ok {
+		return stacks.UnknownRoute(c)
+	}
 
 	if strings.HasPrefix(path, RouteLabelValuesPrefix) {
-		// We cant enforce LBAC here
+		// /label/<name>/values
+		name, _, _ := strings.Cut(strings.TrimPrefix(path, RouteLabelValuesPrefix), "/")
+		err := stacks.CheckLabelName(c, name)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		// query: query=<selector> (optional)
+		err = PatchOptionalQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = RedactLabelValues(c, name, []string{"data"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = stacks.MaskLabelValues(c, name, []string{"data"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+	}
+
+	if strings.HasPrefix(path, RouteDetectedFieldPrefix) {
+		// /detected_field/<name>/values
+		name, _, _ := strings.Cut(strings.TrimPrefix(path, RouteDetectedFieldPrefix), "/")
+		err := stacks.CheckLabelName(c, name)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = PatchQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = RedactLabelValues(c, name, []string{"values"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = stacks.MaskLabelValues(c, name, []string{"values"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+	}
+
+	if path == RouteRulerConfig || strings.HasPrefix(path, RouteRulerConfig+"/") {
+		err := stacks.HandleRulerConfig(c, destination.APIPrefix()+RouteRulerConfig, Permitted, Enforce)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
 		return nil
 	}
 
 	switch path {
-	case RouteInstantQuery, RouteRangeQuery, RouteLabels,
-		RouteIndexStats, RouteInstantLogVolume, RouteRangeLogVolume, RoutePattern:
+	case RouteInstantQuery, RouteRangeQuery:
+
+		// The cost is estimated on the query of the user, range queries start at end - since when start is not set
+		err := stacks.CheckQuery(c, Analyze, DefaultSince)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = PatchQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = CheckCopiedLabels(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = RedactResponse(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		// After the redactions, label_format can not bring back a masked label
+		err = stacks.MaskResult(c, []string{"data", "result"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteInstantLogVolume, RouteRangeLogVolume:
 
 		err := PatchQuery(c, "query")
 		if err != nil {
@@ -47,6 +189,89 @@ func Handle(c echo.Context) error {
 			return err
 		}
 
+		// The volumes are vector and matrix results labeled by stream
+		err = RedactResponse(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = stacks.MaskResult(c, []string{"data", "result"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteIndexStats, RouteIndexShards:
+
+		err := PatchQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RoutePattern:
+
+		err := PatchQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		// The patterns are built from the log lines
+		err = RedactPatterns(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteDetectedFields:
+
+		err := PatchQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		// The cardinality of a dropped label is not returned
+		err = stacks.DropMaskedLabels(c, []string{"fields"}, "label")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteLabels:
+		// query: query=<selector> (optional)
+		err := PatchOptionalQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteDetectedLabels:
+		// query: query=<selector> (optional)
+		err := PatchOptionalQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = stacks.DropMaskedLabels(c, []string{"detectedLabels"}, "label")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
 		return nil
 
 	case RouteSeries:
@@ -54,13 +279,29 @@ func Handle(c echo.Context) error {
 		// query: match[]=<selector> (can be repeated)
 		// You can URL-encode these parameters directly in the request body by using
 		// the POST method and Content-Type: application/x-www-form-urlencoded header.
-		// Get the query from the request
-		if c.Request().Method == "POST" {
-			// TODO
-			return echo.ErrNotImplemented
+		// Loki also accepts match=<selector> and returns every series if none is set
+		err := PatchOptionalQuery(c, "match[]", "match")
+		if err != nil {
+			log.Println(err)
+			return err
 		}
 
-		err := PatchQuery(c, "match")
+		err = RedactSeries(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = stacks.MaskSeries(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteDelete:
+		err := HandleDelete(c)
 		if err != nil {
 			log.Println(err)
 			return err
@@ -73,8 +314,12 @@ func Handle(c echo.Context) error {
 		// TODO
 		return echo.ErrNotImplemented
 
+	case RouteBuildInfo:
+		// Does not expose any tenant data
+		return nil
+
 	default:
-		return echo.ErrBadRequest
+		return stacks.UnknownRoute(c)
 	}
 }
 
@@ -84,67 +329,120 @@ func ParseQuery(query string) (syntax.Expr, error) {
 }
 
 func PatchQuery(c echo.Context, parameterName string) error {
-	// Parse the query
-	expr, err := ParseQuery(c.Request().URL.Query().Get(parameterName))
+	params, err := stacks.Params(c)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+
+	// Parse the queries, the parameter can be repeated
+	queries := params[parameterName]
+	if len(queries) == 0 {
 		return echo.NewHTTPError(400, "invalid query")
 	}
 
-	// Get the tenant from the request
-	destination := c.Get("destination").(config.Destination)
-	tenantNames := c.Get("tenantNames").([]string)
+	exprs := make([]syntax.Expr, 0, len(queries))
+	for _, query := range queries {
+		expr, err := ParseQuery(query)
+		if err != nil {
+			log.Println(err)
+			stacks.RewriteFailed(c)
+			return echo.NewHTTPError(400, "invalid query")
+		}
+		exprs = append(exprs, expr)
+	}
 
-	// We dont support multi tenant requests for now
-	tenant, ok := destination.Tenants[tenantNames[0]]
-	if !ok {
-		if destination.AllowUndefined {
-			// Allow access if the tenant is not defined
-			return nil
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	for i, expr := range exprs {
+		// Checked before LBAC is enforced, the enforced matchers may use forbidden labels
+		err = stacks.CheckForbidden(groups, QueryUsage(expr))
+		if err != nil {
+			return err
+		}
+
+		err = EnforceLBAC(expr, stacks.Matchers(groups))
+		if err != nil {
+			log.Printf("failed to enforce LBAC: %v", err)
+			stacks.RewriteFailed(c)
+			return echo.NewHTTPError(400, "invalid query: %v", err)
 		}
-		return echo.ErrBadRequest
+
+		// patch the query with the new one
+		queries[i] = expr.String()
 	}
 
-	userGroups := c.Get("groups").([]string)
+	stacks.SetParams(c, params)
+
+	return nil
+}
+
+// Analyze parses a LogQL query for the query limits and cost checks
+func Analyze(query string) (stacks.Analysis, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return stacks.Analysis{}, err
+	}
+
+	rangeVector, lookback := maxRangeVector(expr)
+
+	return stacks.Analysis{RangeVector: rangeVector, Lookback: lookback, Cost: EstimateCost(expr)}, nil
+}
+
+// maxRangeVector returns the longest range vector duration of the expression
+// and how far before the evaluation time it reads, with the offsets
+func maxRangeVector(e syntax.Expr) (time.Duration, time.Duration) {
+	var longest, lookback time.Duration
+
+	e.Walk(func(e syntax.Expr) {
+		if r, ok := e.(*syntax.LogRange); ok {
+			longest = max(longest, r.Interval)
+			lookback = max(lookback, r.Interval+r.Offset)
+		}
+	})
+
+	return longest, lookback
+}
+
+// PatchOptionalQuery enforces LBAC on query parameters that may be omitted
+// When all of them are, a selector with the enforced labels is injected in the first one
+func PatchOptionalQuery(c echo.Context, parameterNames ...string) error {
+	params, err := stacks.Params(c)
+	if err != nil {
+		return err
+	}
 
 	found := false
-	enforcedLabels := make([]*labels.Matcher, 0)
-	// A user can be part of multiple groups, so we need to check all of them
-	// and see if any of them match any of the groups in the tenant
-	for _, group := range tenant.Groups {
-		if !slices.Contains(userGroups, group.Name) {
+	for _, name := range parameterNames {
+		if len(params[name]) == 0 {
 			continue
 		}
-		if len(group.Matchers) > 0 {
-			// if we get here, it means that the user is part of a group
-			// that has LBAC rules
-			enforcedLabels = append(enforcedLabels, group.Matchers...)
+
+		if err := PatchQuery(c, name); err != nil {
+			return err
 		}
 		found = true
 	}
 
-	if tenant.Mode == config.ModeAllowList {
-		// This tenant requires that the user is part of at least one of the groups
-		if !found {
-			return echo.ErrForbidden
-		}
-	} else {
-		// This tenant requires that the user is not part of any of the groups
-		if found {
-			return echo.ErrForbidden
-		}
+	if found {
+		return nil
 	}
 
-	err = EnforceLBAC(expr, enforcedLabels)
-	if err != nil {
-		log.Printf("failed to enforce LBAC: %v", err)
-		return echo.NewHTTPError(400, "invalid query: %v", err)
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	enforcedLabels := stacks.Matchers(groups)
+	if len(enforcedLabels) == 0 {
+		// Nothing to enforce, the user can see every stream
+		return nil
 	}
 
-	// patch the query with the new one
-	patchedQuery := c.Request().URL.Query() // this returns a copy and not a reference
-	patchedQuery.Set(parameterName, expr.String())
-	c.Request().URL.RawQuery = patchedQuery.Encode()
+	params.Set(parameterNames[0], (&syntax.MatchersExpr{Mts: enforcedLabels}).String())
+	stacks.SetParams(c, params)
 
 	return nil
 }
@@ -153,45 +451,78 @@ func EnforceLBAC(e syntax.Expr, lbac []*labels.Matcher) error {
 	// must check if any labels are already set in the expression
 	// if so, we must rewrite them instead of adding them
 
-	selector := getSelector(e)
+	for _, selector := range getSelectors(e) {
+		// user already set these labels, we must rewrite them instead of adding them
+		selector.Mts = slices.DeleteFunc(selector.Mts, func(m *labels.Matcher) bool {
+			return slices.ContainsFunc(lbac, func(l *labels.Matcher) bool { return l.Name == m.Name })
+		})
+		selector.AppendMatchers(lbac)
+	}
 
-OUTER:
-	for _, l := range lbac {
-		for _, m := range selector.Matchers() {
-			if m.Name == l.Name {
-				// user already set this label, we must rewrite it instead of adding it
-				m = l
-				continue OUTER
+	return nil
+}
+
+// Permitted reports whether every selector of the query already enforces the LBAC matchers of the groups
+// i.e. enforcing them would not change the data selected by the query
+func Permitted(query string, groups []config.Group) (bool, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return false, err
+	}
+
+	lbac := stacks.Matchers(groups)
+	for _, selector := range getSelectors(expr) {
+		for _, l := range lbac {
+			if !stacks.ContainsMatcher(selector.Mts, l) {
+				return false, nil
 			}
 		}
-		appendMatcher(selector, l)
 	}
 
-	log.Println(e.String())
-
-	return nil
+	return true, nil
 }
 
-func appendMatcher(selector syntax.LogSelectorExpr, matcher *labels.Matcher) {
-	visitor := &syntax.DepthFirstTraversal{
-		VisitMatchersFn: func(_ syntax.RootVisitor, m *syntax.MatchersExpr) {
-			m.AppendMatchers([]*labels.Matcher{matcher})
-		},
+// Enforce returns the query with the LBAC matchers of the groups enforced
+func Enforce(query string, groups []config.Group) (string, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return "", err
 	}
-	selector.Accept(visitor)
+
+	err = EnforceLBAC(expr, stacks.Matchers(groups))
+	if err != nil {
+		return "", err
+	}
+
+	return expr.String(), nil
 }
 
-// getSelector returns the selector from the expression
-// an expression can have multiple levels of nesting
-func getSelector(e syntax.Expr) syntax.LogSelectorExpr {
-	var selector syntax.LogSelectorExpr
+// getSelectors returns the selectors from the expression
+// an expression can have multiple levels of nesting and multiple selectors (e.g. binary operations)
+func getSelectors(e syntax.Expr) []*syntax.MatchersExpr {
+	var selectors []*syntax.MatchersExpr
 
 	visitor := &syntax.DepthFirstTraversal{
 		VisitMatchersFn: func(_ syntax.RootVisitor, m *syntax.MatchersExpr) {
-			selector = m
+			selectors = append(selectors, m)
 		},
 	}
 	e.Accept(visitor)
 
-	return selector
+	return selectors
+}
+
+// SelectorMatchers returns the matchers of every selector of the query
+func SelectorMatchers(query string) ([]*labels.Matcher, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := make([]*labels.Matcher, 0)
+	for _, selector := range getSelectors(expr) {
+		matchers = append(matchers, selector.Mts...)
+	}
+
+	return matchers, nil
 }
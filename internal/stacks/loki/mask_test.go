@@ -0,0 +1,143 @@
+package loki
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMaskedLabelRoutes(t *testing.T) {
+	destination := config.Destination{
+		Type:       config.StackLoki,
+		Upstream:   "http://localhost:3100",
+		MaskSecret: "secret",
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Groups: []config.Group{
+				{Name: "team-a", MaskLabels: config.LabelMask{Labels: []string{"customer_id"}, Action: config.MaskActionHash}},
+				{Name: "team-b", MaskLabels: config.LabelMask{Labels: []string{"internal_id"}}},
+			}},
+		},
+	}
+	hashed := stacks.HashLabelValue("secret", "acme")
+
+	tests := []struct {
+		name     string
+		target   string
+		upstream string
+		want     string
+	}{
+		{
+			name:     "detected field values of a hashed label",
+			target:   "/loki/api/v1/detected_field/customer_id/values?query=%7Bapp%3D%22api%22%7D",
+			upstream: `{"values":["acme"]}`,
+			want:     `{"values":["` + hashed + `"]}`,
+		},
+		{
+			name:     "detected field values of a dropped label",
+			target:   "/loki/api/v1/detected_field/internal_id/values?query=%7Bapp%3D%22api%22%7D",
+			upstream: `{"values":["42"]}`,
+			want:     `{"values":[]}`,
+		},
+		{
+			name:     "detected labels",
+			target:   "/loki/api/v1/detected_labels",
+			upstream: `{"detectedLabels":[{"label":"internal_id","cardinality":2},{"label":"customer_id","cardinality":3}]}`,
+			want:     `{"detectedLabels":[{"label":"customer_id","cardinality":3}]}`,
+		},
+		{
+			name:     "detected fields",
+			target:   "/loki/api/v1/detected_fields?query=%7Bapp%3D%22api%22%7D",
+			upstream: `{"fields":[{"label":"internal_id","type":"int","cardinality":2}],"limit":1000}`,
+			want:     `{"fields":[],"limit":1000}`,
+		},
+		{
+			name:     "label values",
+			target:   "/loki/api/v1/label/customer_id/values",
+			upstream: `{"status":"success","data":["acme"]}`,
+			want:     `{"status":"success","data":["` + hashed + `"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.target, nil), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a", "team-b"})
+
+			if err := Handle(c); err != nil {
+				t.Fatal(err)
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopiedMaskedLabels(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackLoki,
+		Upstream: "http://localhost:3100",
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Groups: []config.Group{
+				{Name: "team-a", MaskLabels: config.LabelMask{Labels: []string{"customer_id"}, Action: config.MaskActionHash}},
+				{Name: "team-b", MaskLabels: config.LabelMask{Labels: []string{"internal_id"}}},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"label_format template", `{app="api"} | label_format leak="{{.customer_id}}"`, http.StatusForbidden},
+		{"label_format rename", `{app="api"} | label_format leak=internal_id`, http.StatusForbidden},
+		{"line_format template", `{app="api"} | line_format "{{ .internal_id }}"`, http.StatusForbidden},
+		{"label_replace", `label_replace(count_over_time({app="api"}[5m]), "leak", "$1", "customer_id", "(.*)")`, http.StatusForbidden},
+		{"label_format of an unmasked label", `{app="api"} | label_format leak="{{.pod}}"`, 0},
+		{"no copy", `{app="api"}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/loki/api/v1/query_range?query=" + url.QueryEscape(tt.query)
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a", "team-b"})
+
+			err := Handle(c)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
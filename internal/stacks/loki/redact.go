@@ -0,0 +1,337 @@
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// stream is an element of a streams result
+type stream struct {
+	Stream map[string]string   `json:"stream"`
+	Values [][]json.RawMessage `json:"values"`
+}
+
+// RedactResponse rewrites the log lines of the streams returned to the user with the redactions of their groups
+// The patterns and label formats also apply to the stream labels, the structured metadata and the labels of metric results
+// so extracting a field with a parser does not bypass them
+// The response is processed one stream at a time, see stacks.StreamResponse
+func RedactResponse(c echo.Context) error {
+	redactions, err := userRedactions(c)
+	if err != nil || len(redactions) == 0 {
+		return err
+	}
+
+	stacks.StreamResponse(c, []string{"data", "result"}, func(element json.RawMessage) (json.RawMessage, error) {
+		if len(element) == 0 || element[0] != '{' {
+			// Scalar results are an array of values
+			return element, nil
+		}
+
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(element, &fields)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fields["stream"]; !ok {
+			// Samples of metric queries are not log lines but their labels can be extracted from them
+			return redactMetric(fields, redactions)
+		}
+
+		var s stream
+		err = json.Unmarshal(element, &s)
+		if err != nil {
+			return nil, err
+		}
+
+		err = redactStream(&s, redactions)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(s)
+	})
+
+	return nil
+}
+
+// RedactLabelValues applies the redactions to the values of the label returned in the array at path
+// e.g. []string{"data"} for the label values API
+// A value removed by a label format is not returned
+func RedactLabelValues(c echo.Context, name string, path []string) error {
+	redactions, err := userRedactions(c)
+	if err != nil || len(redactions) == 0 {
+		return err
+	}
+
+	stacks.StreamResponse(c, path, func(element json.RawMessage) (json.RawMessage, error) {
+		var value string
+		err := json.Unmarshal(element, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		// The label formats only see the label itself
+		values, err := redactLabels(map[string]string{name: value}, redactions)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := values[name]
+		if !ok {
+			return nil, nil
+		}
+
+		return json.Marshal(value)
+	})
+
+	return nil
+}
+
+// RedactSeries applies the redactions to the labels of the series returned by the series API
+func RedactSeries(c echo.Context) error {
+	redactions, err := userRedactions(c)
+	if err != nil || len(redactions) == 0 {
+		return err
+	}
+
+	stacks.StreamResponse(c, []string{"data"}, func(element json.RawMessage) (json.RawMessage, error) {
+		var lbls map[string]string
+		err := json.Unmarshal(element, &lbls)
+		if err != nil {
+			return nil, err
+		}
+
+		lbls, err = redactLabels(lbls, redactions)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(lbls)
+	})
+
+	return nil
+}
+
+// RedactPatterns applies the redaction patterns to the log patterns detected by the patterns API
+// Patterns are built from the log lines but line formats can not be applied to them, they are denied instead
+func RedactPatterns(c echo.Context) error {
+	redactions, err := userRedactions(c)
+	if err != nil || len(redactions) == 0 {
+		return err
+	}
+
+	for _, r := range redactions {
+		if r.LineFormat != "" {
+			return echo.NewHTTPError(http.StatusForbidden, "log patterns are not available with line format redactions")
+		}
+	}
+
+	// e.g. {"status": "success", "data": [{"pattern": "<_> user=<_>", "samples": [[1711839260, 1]]}]}
+	stacks.StreamResponse(c, []string{"data"}, func(element json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(element, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		var pattern string
+		if raw, ok := fields["pattern"]; ok {
+			if err := json.Unmarshal(raw, &pattern); err != nil {
+				return nil, err
+			}
+		}
+		fields["pattern"], err = json.Marshal(redactValue(pattern, redactions))
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(fields)
+	})
+
+	return nil
+}
+
+// userRedactions returns the redactions of the groups of the user
+// Like the LBAC matchers, the redactions of all groups are applied
+func userRedactions(c echo.Context) ([]config.Redaction, error) {
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	redactions := make([]config.Redaction, 0)
+	for _, group := range groups {
+		redactions = append(redactions, group.Redact...)
+	}
+
+	return redactions, nil
+}
+
+// redactMetric applies the redactions to the labels of a vector or matrix element
+func redactMetric(fields map[string]json.RawMessage, redactions []config.Redaction) (json.RawMessage, error) {
+	raw, ok := fields["metric"]
+	if !ok {
+		return json.Marshal(fields)
+	}
+
+	var metric map[string]string
+	err := json.Unmarshal(raw, &metric)
+	if err != nil {
+		return nil, err
+	}
+
+	metric, err = redactLabels(metric, redactions)
+	if err != nil {
+		return nil, err
+	}
+
+	fields["metric"], err = json.Marshal(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+// redactLabels applies the label formats and then the patterns to the label values
+func redactLabels(values map[string]string, redactions []config.Redaction) (map[string]string, error) {
+	for _, r := range redactions {
+		if len(r.LabelFormat) == 0 {
+			continue
+		}
+
+		// Formatters are not safe for concurrent use, they are created for each set of labels
+		f, err := log.NewLabelsFormatter(r.LabelFmts())
+		if err != nil {
+			return nil, err
+		}
+		lbls := labels.FromMap(values)
+		builder := log.NewBaseLabelsBuilder().ForLabels(lbls, lbls.Hash())
+		f.Process(0, nil, builder)
+		values = builder.LabelsResult().Labels().Map()
+	}
+
+	for name, value := range values {
+		if value == "" {
+			// e.g. set by a label format referencing a label the stream does not have
+			delete(values, name)
+			continue
+		}
+		values[name] = redactValue(value, redactions)
+	}
+
+	return values, nil
+}
+
+// redactValue replaces the matches of the patterns in the value
+func redactValue(value string, redactions []config.Redaction) string {
+	for _, r := range redactions {
+		if r.Regexp != nil {
+			value = r.Regexp.ReplaceAllString(value, r.Replacement)
+		}
+	}
+
+	return value
+}
+
+// redactMetadata replaces the matches of the patterns in the values of the structured metadata
+// The metadata is either a map of values or, when the labels are categorized, maps of values by category
+func redactMetadata(metadata any, redactions []config.Redaction) any {
+	switch m := metadata.(type) {
+	case string:
+		return redactValue(m, redactions)
+	case map[string]any:
+		for k, v := range m {
+			m[k] = redactMetadata(v, redactions)
+		}
+	case []any:
+		for i, v := range m {
+			m[i] = redactMetadata(v, redactions)
+		}
+	}
+
+	return metadata
+}
+
+// redactStream applies the redactions to the labels, lines and structured metadata of the stream
+func redactStream(s *stream, redactions []config.Redaction) error {
+	var err error
+	s.Stream, err = redactLabels(s.Stream, redactions)
+	if err != nil {
+		return err
+	}
+
+	// Formatters are not safe for concurrent use, they are created for each stream
+	lineFormatters := make(map[int]*log.LineFormatter)
+	for i, r := range redactions {
+		if r.LineFormat != "" {
+			f, err := log.NewFormatter(r.LineFormat)
+			if err != nil {
+				return err
+			}
+			lineFormatters[i] = f
+		}
+	}
+
+	// line_format templates only see the redacted labels
+	lbls := labels.FromMap(s.Stream)
+	for _, value := range s.Values {
+		if len(value) < 2 {
+			return fmt.Errorf("invalid stream value")
+		}
+
+		var timestamp, line string
+		err := json.Unmarshal(value[0], &timestamp)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(value[1], &line)
+		if err != nil {
+			return err
+		}
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		for i, r := range redactions {
+			switch {
+			case r.Regexp != nil:
+				line = r.Regexp.ReplaceAllString(line, r.Replacement)
+
+			case r.LineFormat != "":
+				builder := log.NewBaseLabelsBuilder().ForLabels(lbls, lbls.Hash())
+				b, _ := lineFormatters[i].Process(ts, []byte(line), builder)
+				line = string(b)
+			}
+		}
+
+		value[1], err = json.Marshal(line)
+		if err != nil {
+			return err
+		}
+
+		if len(value) < 3 {
+			continue
+		}
+
+		var metadata any
+		err = json.Unmarshal(value[2], &metadata)
+		if err != nil {
+			return err
+		}
+		value[2], err = json.Marshal(redactMetadata(metadata, redactions))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
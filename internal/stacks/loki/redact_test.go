@@ -0,0 +1,214 @@
+package loki
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestRedactResponse(t *testing.T) {
+	redactions := []config.Redaction{
+		{Pattern: `(\d+)\.\d+\.\d+\.\d+`, Replacement: "$1.x.x.x"},
+		{LabelFormat: map[string]string{"pod": `{{ .pod | trunc 3 }}`}},
+	}
+	for i := range redactions {
+		if err := redactions[i].Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destination := config.Destination{
+		Type:     config.StackLoki,
+		Upstream: "http://localhost:3100",
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Groups: []config.Group{{Name: "team-a", Redact: redactions}}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		upstream string
+		want     string
+	}{
+		{
+			name:     "line",
+			upstream: `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1","client 10.1.2.3"]]}]}}`,
+			want:     `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1","client 10.x.x.x"]]}]}}`,
+		},
+		{
+			name:     "extracted label",
+			upstream: `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api","ip":"10.1.2.3","pod":"api-7f9c"},"values":[["1","ok"]]}]}}`,
+			want:     `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api","ip":"10.x.x.x","pod":"api"},"values":[["1","ok"]]}]}}`,
+		},
+		{
+			name:     "structured metadata",
+			upstream: `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1","ok",{"ip":"10.1.2.3"}]]}]}}`,
+			want:     `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1","ok",{"ip":"10.x.x.x"}]]}]}}`,
+		},
+		{
+			name:     "categorized labels",
+			upstream: `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1","ok",{"structuredMetadata":{"ip":"10.1.2.3"},"parsed":{"client":"10.4.5.6"}}]]}]}}`,
+			want:     `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1","ok",{"parsed":{"client":"10.x.x.x"},"structuredMetadata":{"ip":"10.x.x.x"}}]]}]}}`,
+		},
+		{
+			name:     "matrix",
+			upstream: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"ip":"10.1.2.3","pod":"api-7f9c"},"values":[[1,"2"]]}]}}`,
+			want:     `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"ip":"10.x.x.x","pod":"api"},"values":[[1,"2"]]}]}}`,
+		},
+		{
+			name:     "vector",
+			upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"ip":"10.1.2.3"},"value":[1,"2"]}]}}`,
+			want:     `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"ip":"10.x.x.x"},"value":[1,"2"]}]}}`,
+		},
+		{
+			name:     "scalar",
+			upstream: `{"status":"success","data":{"resultType":"scalar","result":[1,"10.1.2.3"]}}`,
+			want:     `{"status":"success","data":{"resultType":"scalar","result":[1,"10.1.2.3"]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+
+			if err := RedactResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactedRoutes(t *testing.T) {
+	redactions := []config.Redaction{
+		{Pattern: `(\d+)\.\d+\.\d+\.\d+`, Replacement: "$1.x.x.x"},
+		{LabelFormat: map[string]string{"pod": `{{ .pod | trunc 3 }}`}},
+	}
+	lineFormat := []config.Redaction{{LineFormat: `{{ .app }}`}}
+	for _, r := range [][]config.Redaction{redactions, lineFormat} {
+		for i := range r {
+			if err := r[i].Compile(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	destination := config.Destination{
+		Type:     config.StackLoki,
+		Upstream: "http://localhost:3100",
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Groups: []config.Group{
+				{Name: "team-a", Redact: redactions},
+				{Name: "team-b", Redact: lineFormat},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		group    string
+		upstream string
+		want     string
+		status   int
+	}{
+		{
+			name:     "label values",
+			target:   "/loki/api/v1/label/ip/values",
+			group:    "team-a",
+			upstream: `{"status":"success","data":["10.1.2.3","api"]}`,
+			want:     `{"status":"success","data":["10.x.x.x","api"]}`,
+		},
+		{
+			name:     "formatted label values",
+			target:   "/loki/api/v1/label/pod/values",
+			group:    "team-a",
+			upstream: `{"status":"success","data":["api-7f9c"]}`,
+			want:     `{"status":"success","data":["api"]}`,
+		},
+		{
+			name:     "detected field values",
+			target:   "/loki/api/v1/detected_field/ip/values?query=%7Bapp%3D%22api%22%7D",
+			group:    "team-a",
+			upstream: `{"values":["10.1.2.3"]}`,
+			want:     `{"values":["10.x.x.x"]}`,
+		},
+		{
+			name:     "series",
+			target:   "/loki/api/v1/series?match[]=%7Bapp%3D%22api%22%7D",
+			group:    "team-a",
+			upstream: `{"status":"success","data":[{"app":"api","ip":"10.1.2.3","pod":"api-7f9c"}]}`,
+			want:     `{"status":"success","data":[{"app":"api","ip":"10.x.x.x","pod":"api"}]}`,
+		},
+		{
+			name:     "patterns",
+			target:   "/loki/api/v1/patterns?query=%7Bapp%3D%22api%22%7D",
+			group:    "team-a",
+			upstream: `{"status":"success","data":[{"pattern":"client 10.1.2.3 <_>","samples":[[1711839260,1]]}]}`,
+			want:     `{"status":"success","data":[{"pattern":"client 10.x.x.x \u003c_\u003e","samples":[[1711839260,1]]}]}`,
+		},
+		{
+			name:   "patterns with a line format",
+			target: "/loki/api/v1/patterns?query=%7Bapp%3D%22api%22%7D",
+			group:  "team-b",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.target, nil), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{tt.group})
+
+			err := Handle(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
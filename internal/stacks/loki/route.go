@@ -0,0 +1,41 @@
+package loki
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+)
+
+// routes are the routes without variable segments
+var routes = []string{
+	RouteInstantQuery, RouteRangeQuery, RouteLabels, RouteSeries, RouteIndexStats,
+	RouteInstantLogVolume, RouteRangeLogVolume, RoutePattern, RouteDetectedFields,
+	RouteDetectedLabels, RouteIndexShards, RouteTailStream, RouteDelete, RouteBuildInfo,
+}
+
+// Route returns the route of the request path without its variable segments
+// so it can be used as a metric label
+func Route(destination config.Destination, path string) string {
+	if path == RoutePrometheusRules || path == RoutePrometheusAlerts {
+		return path
+	}
+
+	prefix := destination.APIPrefix()
+	p, ok := strings.CutPrefix(path, prefix)
+	switch {
+	case !ok:
+		return stacks.RouteOther
+	case strings.HasPrefix(p, RouteLabelValuesPrefix):
+		return prefix + RouteLabelValuesPrefix + "{name}/values"
+	case strings.HasPrefix(p, RouteDetectedFieldPrefix):
+		return prefix + RouteDetectedFieldPrefix + "{name}/values"
+	case p == RouteRulerConfig || strings.HasPrefix(p, RouteRulerConfig+"/"):
+		return prefix + RouteRulerConfig
+	case slices.Contains(routes, p):
+		return path
+	default:
+		return stacks.RouteOther
+	}
+}
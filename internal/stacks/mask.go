@@ -0,0 +1,244 @@
+package stacks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// resultLabels are the fields of a query result element that hold its labels
+var resultLabels = []string{"metric", "stream", "seriesLabels"}
+
+// LabelMasks returns the labels masked for the groups and how they are masked
+// Like the LBAC matchers, the masks of all groups are combined, a label hashed by a group and dropped by another is dropped
+func LabelMasks(groups []config.Group) map[string]config.MaskAction {
+	masks := make(map[string]config.MaskAction)
+	for _, group := range groups {
+		action := group.MaskLabels.Action
+		if action != config.MaskActionHash {
+			action = config.MaskActionDrop
+		}
+
+		for _, name := range group.MaskLabels.Labels {
+			if masks[name] != config.MaskActionDrop {
+				masks[name] = action
+			}
+		}
+	}
+
+	return masks
+}
+
+// AggregatedLabels returns the masked labels that the groups require to be aggregated away
+func AggregatedLabels(groups []config.Group) []string {
+	names := make([]string, 0)
+	for _, group := range groups {
+		if group.MaskLabels.RequireAggregation {
+			names = append(names, group.MaskLabels.Labels...)
+		}
+	}
+
+	return names
+}
+
+// HashLabelValue returns the value that replaces a hashed label value
+// It is keyed with the mask secret of the destination so the values can not be guessed by hashing candidates
+func HashLabelValue(secret, value string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// userMasks returns the label masks of the groups of the user and the secret of the hashes
+func userMasks(c echo.Context) (map[string]config.MaskAction, string, error) {
+	groups, ok, err := UserGroups(c)
+	if err != nil || !ok {
+		return nil, "", err
+	}
+
+	destination := c.Get("destination").(config.Destination)
+
+	return LabelMasks(groups), destination.MaskSecret, nil
+}
+
+// LabelMask returns how the label is masked for the user, ok is false when it is not masked
+func LabelMask(c echo.Context, name string) (config.MaskAction, string, bool, error) {
+	masks, secret, err := userMasks(c)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	action, ok := masks[name]
+
+	return action, secret, ok, nil
+}
+
+// CheckCopiedLabels rejects queries that copy the values of a masked label into another label or the log line
+// The masks apply to the labels by name, e.g. label_replace(up, "leak", "$1", "customer_id", "(.*)") would return them unmasked
+// sources are the labels whose values the query copies
+func CheckCopiedLabels(c echo.Context, sources []string) error {
+	masks, _, err := userMasks(c)
+	if err != nil || len(masks) == 0 {
+		return err
+	}
+
+	for _, name := range sources {
+		if _, ok := masks[name]; ok {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("label %s is masked and can not be copied", name))
+		}
+	}
+
+	return nil
+}
+
+// MaskResult masks the labels of the elements of the query result at path, see StreamResponse
+// e.g. []string{"data", "result"} for vector, matrix and streams results
+func MaskResult(c echo.Context, path []string) error {
+	masks, secret, err := userMasks(c)
+	if err != nil || len(masks) == 0 {
+		return err
+	}
+
+	StreamResponse(c, path, func(element json.RawMessage) (json.RawMessage, error) {
+		if len(element) == 0 || element[0] != '{' {
+			// Scalar results are an array of values
+			return element, nil
+		}
+
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(element, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range resultLabels {
+			raw, ok := fields[name]
+			if !ok {
+				continue
+			}
+
+			var lbls map[string]string
+			err := json.Unmarshal(raw, &lbls)
+			if err != nil {
+				return nil, err
+			}
+
+			fields[name], err = json.Marshal(maskLabels(lbls, masks, secret))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(fields)
+	})
+
+	return nil
+}
+
+// MaskSeries masks the labels of the series returned by the series and active series APIs
+func MaskSeries(c echo.Context) error {
+	masks, secret, err := userMasks(c)
+	if err != nil || len(masks) == 0 {
+		return err
+	}
+
+	StreamResponse(c, []string{"data"}, func(element json.RawMessage) (json.RawMessage, error) {
+		var lbls map[string]string
+		err := json.Unmarshal(element, &lbls)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(maskLabels(lbls, masks, secret))
+	})
+
+	return nil
+}
+
+// MaskLabelValues masks the values of the label returned in the array at path
+// e.g. []string{"data"} for the label values API
+// The values of a dropped label are not returned
+func MaskLabelValues(c echo.Context, name string, path []string) error {
+	action, secret, ok, err := LabelMask(c, name)
+	if err != nil || !ok {
+		return err
+	}
+
+	StreamResponse(c, path, func(element json.RawMessage) (json.RawMessage, error) {
+		if action == config.MaskActionDrop {
+			return nil, nil
+		}
+
+		var value string
+		err := json.Unmarshal(element, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(HashLabelValue(secret, value))
+	})
+
+	return nil
+}
+
+// DropMaskedLabels removes the elements of the array at path that describe a dropped label
+// field is the key of the label name in the elements, e.g. "label"
+func DropMaskedLabels(c echo.Context, path []string, field string) error {
+	masks, _, err := userMasks(c)
+	if err != nil {
+		return err
+	}
+
+	dropped := make([]string, 0)
+	for name, action := range masks {
+		if action == config.MaskActionDrop {
+			dropped = append(dropped, name)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	StreamResponse(c, path, func(element json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(element, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		var name string
+		if raw, ok := fields[field]; ok {
+			if err := json.Unmarshal(raw, &name); err != nil {
+				return nil, err
+			}
+		}
+		if slices.Contains(dropped, name) {
+			return nil, nil
+		}
+
+		return element, nil
+	})
+
+	return nil
+}
+
+// maskLabels drops or hashes the masked labels
+func maskLabels(lbls map[string]string, masks map[string]config.MaskAction, secret string) map[string]string {
+	for name, value := range lbls {
+		switch masks[name] {
+		case config.MaskActionDrop:
+			delete(lbls, name)
+		case config.MaskActionHash:
+			lbls[name] = HashLabelValue(secret, value)
+		}
+	}
+
+	return lbls
+}
@@ -0,0 +1,27 @@
+package stacks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHashLabelValue(t *testing.T) {
+	hash := HashLabelValue("secret", "acme")
+
+	if hash != HashLabelValue("secret", "acme") {
+		t.Error("hashes of the same value differ")
+	}
+	if len(hash) != 16 {
+		t.Errorf("got hash %q, want 16 hex characters", hash)
+	}
+	if hash == HashLabelValue("other", "acme") {
+		t.Error("the hash does not depend on the secret")
+	}
+
+	// Without the secret, hashing the candidates does not find the value
+	sum := sha256.Sum256([]byte("acme"))
+	if hash == hex.EncodeToString(sum[:8]) {
+		t.Error("the hash is an unkeyed SHA-256")
+	}
+}
@@ -0,0 +1,238 @@
+package mimir
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Alertmanager routes are relative to the destination alertmanager prefix
+const (
+	RouteAlertmanagerAlerts      = "/api/v2/alerts"
+	RouteAlertmanagerAlertGroups = "/api/v2/alerts/groups"
+	RouteAlertmanagerSilences    = "/api/v2/silences"
+	RouteAlertmanagerSilence     = "/api/v2/silence/"
+)
+
+// alertmanagerMatcher is a silence matcher as represented by the Alertmanager API v2
+type alertmanagerMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+type silence struct {
+	ID       string                `json:"id"`
+	Matchers []alertmanagerMatcher `json:"matchers"`
+}
+
+type alert struct {
+	Labels map[string]string `json:"labels"`
+}
+
+func (m alertmanagerMatcher) matchType() labels.MatchType {
+	equal := m.IsEqual == nil || *m.IsEqual
+	switch {
+	case m.IsRegex && equal:
+		return labels.MatchRegexp
+	case m.IsRegex:
+		return labels.MatchNotRegexp
+	case equal:
+		return labels.MatchEqual
+	default:
+		return labels.MatchNotEqual
+	}
+}
+
+// inScope reports whether the silence can only mute alerts allowed by the enforced labels
+// i.e. every enforced matcher is also a matcher of the silence
+func (s silence) inScope(lbac []*labels.Matcher) bool {
+	for _, l := range lbac {
+		found := false
+		for _, m := range s.Matchers {
+			if m.Name == l.Name && m.matchType() == l.Type && m.Value == l.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HandleAlertmanager enforces LBAC on the Alertmanager API
+// path must be relative to the alertmanager prefix
+func HandleAlertmanager(c echo.Context, path string) error {
+	switch {
+	case path == RouteAlertmanagerAlerts, path == RouteAlertmanagerAlertGroups,
+		path == RouteAlertmanagerSilences, strings.HasPrefix(path, RouteAlertmanagerSilence):
+	default:
+		return stacks.UnknownRoute(c)
+	}
+
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	enforcedLabels := stacks.Matchers(groups)
+	if len(enforcedLabels) == 0 {
+		// Nothing to enforce
+		return nil
+	}
+
+	method := c.Request().Method
+
+	switch {
+	case path == RouteAlertmanagerAlerts && method == http.MethodGet:
+		stacks.ModifyResponse(c, func(body []byte) ([]byte, error) {
+			return stacks.FilterArray(body, func(item json.RawMessage) (json.RawMessage, error) {
+				var a alert
+				if err := json.Unmarshal(item, &a); err != nil {
+					return nil, err
+				}
+				if !stacks.LabelsMatch(a.Labels, enforcedLabels) {
+					return nil, nil
+				}
+				return item, nil
+			})
+		})
+		return nil
+
+	case path == RouteAlertmanagerAlerts && method == http.MethodPost:
+		var alerts []alert
+		if err := readJSON(c, &alerts); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid alerts")
+		}
+		for _, a := range alerts {
+			if !stacks.LabelsMatch(a.Labels, enforcedLabels) {
+				return echo.NewHTTPError(http.StatusForbidden, "alert labels are outside of the allowed scope")
+			}
+		}
+		return nil
+
+	case path == RouteAlertmanagerAlertGroups && method == http.MethodGet:
+		stacks.ModifyResponse(c, func(body []byte) ([]byte, error) {
+			return filterAlertGroups(body, enforcedLabels)
+		})
+		return nil
+
+	case path == RouteAlertmanagerSilences && method == http.MethodGet:
+		stacks.ModifyResponse(c, func(body []byte) ([]byte, error) {
+			return stacks.FilterArray(body, func(item json.RawMessage) (json.RawMessage, error) {
+				var s silence
+				if err := json.Unmarshal(item, &s); err != nil {
+					return nil, err
+				}
+				if !s.inScope(enforcedLabels) {
+					return nil, nil
+				}
+				return item, nil
+			})
+		})
+		return nil
+
+	case path == RouteAlertmanagerSilences && method == http.MethodPost:
+		var s silence
+		if err := readJSON(c, &s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid silence")
+		}
+		if !s.inScope(enforcedLabels) {
+			return echo.NewHTTPError(http.StatusForbidden, "silence could mute alerts outside of the allowed scope")
+		}
+		if s.ID != "" {
+			// Updating an existing silence, the user must also be able to see it
+			return checkSilence(c, s.ID, enforcedLabels)
+		}
+		return nil
+
+	case strings.HasPrefix(path, RouteAlertmanagerSilence) && (method == http.MethodGet || method == http.MethodDelete):
+		return checkSilence(c, strings.TrimPrefix(path, RouteAlertmanagerSilence), enforcedLabels)
+
+	default:
+		return stacks.UnknownRoute(c)
+	}
+}
+
+// checkSilence fetches an existing silence and checks that it is in the user scope
+func checkSilence(c echo.Context, id string, lbac []*labels.Matcher) error {
+	destination := c.Get("destination").(config.Destination)
+
+	body, err := stacks.Get(c, destination.AlertmanagerPrefix()+RouteAlertmanagerSilence+id, nil)
+	if err != nil {
+		log.Println(err)
+		return echo.ErrNotFound
+	}
+
+	var s silence
+	if err := json.Unmarshal(body, &s); err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "invalid silence")
+	}
+
+	if !s.inScope(lbac) {
+		return echo.ErrNotFound
+	}
+
+	return nil
+}
+
+// filterAlertGroups removes the alerts that the user can not see from each alert group
+// and drops the groups without any alerts left
+func filterAlertGroups(body []byte, lbac []*labels.Matcher) ([]byte, error) {
+	return stacks.FilterArray(body, func(item json.RawMessage) (json.RawMessage, error) {
+		var group map[string]json.RawMessage
+		if err := json.Unmarshal(item, &group); err != nil {
+			return nil, err
+		}
+
+		var alerts []json.RawMessage
+		if err := json.Unmarshal(group["alerts"], &alerts); err != nil {
+			return nil, err
+		}
+
+		visible := make([]json.RawMessage, 0, len(alerts))
+		for _, item := range alerts {
+			var a alert
+			if err := json.Unmarshal(item, &a); err != nil {
+				return nil, err
+			}
+			if stacks.LabelsMatch(a.Labels, lbac) {
+				visible = append(visible, item)
+			}
+		}
+
+		if len(visible) == 0 {
+			return nil, nil
+		}
+
+		var err error
+		if group["alerts"], err = json.Marshal(visible); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(group)
+	})
+}
+
+// readJSON decodes the request body and restores it so it can still be proxied
+func readJSON(c echo.Context, v any) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,258 @@
+package mimir
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestSilenceInScope(t *testing.T) {
+	lbac := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "team", "a"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "env", "prod.*"),
+	}
+	notEqual := false
+
+	tests := []struct {
+		name     string
+		matchers []alertmanagerMatcher
+		want     bool
+	}{
+		{
+			name: "every enforced matcher",
+			matchers: []alertmanagerMatcher{
+				{Name: "team", Value: "a"},
+				{Name: "env", Value: "prod.*", IsRegex: true, IsEqual: &notEqual},
+			},
+			want: true,
+		},
+		{
+			name: "narrower than the enforced matchers",
+			matchers: []alertmanagerMatcher{
+				{Name: "alertname", Value: "Down"},
+				{Name: "team", Value: "a"},
+				{Name: "env", Value: "prod.*", IsRegex: true, IsEqual: &notEqual},
+			},
+			want: true,
+		},
+		{
+			name:     "missing enforced matcher",
+			matchers: []alertmanagerMatcher{{Name: "team", Value: "a"}},
+			want:     false,
+		},
+		{
+			name: "other value",
+			matchers: []alertmanagerMatcher{
+				{Name: "team", Value: "b"},
+				{Name: "env", Value: "prod.*", IsRegex: true, IsEqual: &notEqual},
+			},
+			want: false,
+		},
+		{
+			// team=~"a" also mutes team="a|b" alerts
+			name: "regex instead of equal",
+			matchers: []alertmanagerMatcher{
+				{Name: "team", Value: "a", IsRegex: true},
+				{Name: "env", Value: "prod.*", IsRegex: true, IsEqual: &notEqual},
+			},
+			want: false,
+		},
+		{
+			name: "equal instead of not equal",
+			matchers: []alertmanagerMatcher{
+				{Name: "team", Value: "a"},
+				{Name: "env", Value: "prod.*", IsRegex: true},
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (silence{Matchers: tt.matchers}).inScope(lbac); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterAlertGroups(t *testing.T) {
+	lbac := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")}
+
+	body := `[` +
+		`{"labels":{"alertname":"Down"},"alerts":[{"labels":{"alertname":"Down","team":"a"}},{"labels":{"alertname":"Down","team":"b"}}]},` +
+		`{"labels":{"alertname":"Full"},"alerts":[{"labels":{"alertname":"Full","team":"b"}}]}]`
+	want := `[{"alerts":[{"labels":{"alertname":"Down","team":"a"}}],"labels":{"alertname":"Down"}}]`
+
+	got, err := filterAlertGroups([]byte(body), lbac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(got)) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	if _, err := filterAlertGroups([]byte(`[{"alerts":{}}]`), lbac); err == nil {
+		t.Error("invalid alerts did not fail")
+	}
+}
+
+func TestHandleAlertmanager(t *testing.T) {
+	silences := map[string]string{
+		"own":   `{"id":"own","matchers":[{"name":"team","value":"a","isRegex":false}]}`,
+		"other": `{"id":"other","matchers":[{"name":"team","value":"b","isRegex":false}]}`,
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		silence, ok := silences[strings.TrimPrefix(r.URL.Path, "/alertmanager/api/v2/silence/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, silence)
+	}))
+	defer upstream.Close()
+
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: upstream.URL,
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode: config.ModeAllowList,
+				Groups: []config.Group{{
+					Name:     "team-a",
+					Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+				}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		upstream string
+		want     string
+		status   int
+	}{
+		{
+			name:   "get own silence",
+			method: http.MethodGet,
+			target: "/alertmanager/api/v2/silence/own",
+		},
+		{
+			name:   "get silence of another team",
+			method: http.MethodGet,
+			target: "/alertmanager/api/v2/silence/other",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "delete silence of another team",
+			method: http.MethodDelete,
+			target: "/alertmanager/api/v2/silence/other",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "delete missing silence",
+			method: http.MethodDelete,
+			target: "/alertmanager/api/v2/silence/missing",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "create silence in scope",
+			method: http.MethodPost,
+			target: "/alertmanager/api/v2/silences",
+			body:   `{"matchers":[{"name":"team","value":"a","isRegex":false},{"name":"alertname","value":"Down","isRegex":false}]}`,
+		},
+		{
+			name:   "create silence out of scope",
+			method: http.MethodPost,
+			target: "/alertmanager/api/v2/silences",
+			body:   `{"matchers":[{"name":"alertname","value":"Down","isRegex":false}]}`,
+			status: http.StatusForbidden,
+		},
+		{
+			// The new matchers are in scope but the replaced silence is not
+			name:   "update silence of another team",
+			method: http.MethodPost,
+			target: "/alertmanager/api/v2/silences",
+			body:   `{"id":"other","matchers":[{"name":"team","value":"a","isRegex":false}]}`,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "invalid silence",
+			method: http.MethodPost,
+			target: "/alertmanager/api/v2/silences",
+			body:   `{`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:     "list silences",
+			method:   http.MethodGet,
+			target:   "/alertmanager/api/v2/silences",
+			upstream: `[` + silences["own"] + `,` + silences["other"] + `]`,
+			want:     `[` + silences["own"] + `]`,
+		},
+		{
+			name:     "list alert groups",
+			method:   http.MethodGet,
+			target:   "/alertmanager/api/v2/alerts/groups",
+			upstream: `[{"alerts":[{"labels":{"team":"a"}}]},{"alerts":[{"labels":{"team":"b"}}]}]`,
+			want:     `[{"alerts":[{"labels":{"team":"a"}}]}]`,
+		},
+		{
+			name:   "post alerts out of scope",
+			method: http.MethodPost,
+			target: "/alertmanager/api/v2/alerts",
+			body:   `[{"labels":{"team":"a"}},{"labels":{"team":"b"}}]`,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+
+			err := Handle(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.upstream == "" {
+				return
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package mimir
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestPatchLabelValuesCardinality(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: "http://localhost:9009",
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode: config.ModeAllowList,
+				Groups: []config.Group{
+					{
+						Name:         "team-a",
+						Matchers:     []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+						HiddenLabels: []string{"customer_id"},
+					},
+					{Name: "admins"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		group    string
+		method   string
+		params   url.Values
+		selector []string
+		status   int
+	}{
+		{
+			name:     "selector injected when missing",
+			group:    "team-a",
+			params:   url.Values{"label_names[]": {"job"}},
+			selector: []string{`{team="a"}`},
+		},
+		{
+			name:     "selector injected in the form body",
+			group:    "team-a",
+			method:   http.MethodPost,
+			params:   url.Values{"label_names[]": {"job"}},
+			selector: []string{`{team="a"}`},
+		},
+		{
+			name:     "no selector without enforced labels",
+			group:    "admins",
+			params:   url.Values{"label_names[]": {"job"}},
+			selector: nil,
+		},
+		{
+			name:     "selector of the user",
+			group:    "team-a",
+			params:   url.Values{"label_names[]": {"job"}, "selector": {`{job="api"}`}},
+			selector: []string{`{job="api",team="a"}`},
+		},
+		{
+			name:     "enforced label set by the user",
+			group:    "team-a",
+			params:   url.Values{"label_names[]": {"job"}, "selector": {`{team="b"}`}},
+			selector: []string{`{team="a"}`},
+		},
+		{
+			name:   "hidden label",
+			group:  "team-a",
+			params: url.Values{"label_names[]": {"job", "customer_id"}},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "missing label names",
+			group:  "team-a",
+			params: url.Values{},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/prometheus/api/v1/cardinality/label_values"
+			var req *http.Request
+			if tt.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, target, strings.NewReader(tt.params.Encode()))
+				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			} else {
+				req = httptest.NewRequest(http.MethodGet, target+"?"+tt.params.Encode(), nil)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{tt.group})
+
+			err := Handle(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			params, err := stacks.Params(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := params["selector"]; strings.Join(got, "\n") != strings.Join(tt.selector, "\n") {
+				t.Errorf("got selector %q, want %q", got, tt.selector)
+			}
+		})
+	}
+}
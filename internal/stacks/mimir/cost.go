@@ -0,0 +1,78 @@
+package mimir
+
+import (
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	costUnboundedSelector = 100
+	costMissingMetricName = 10
+	costCountValues       = 50
+	costTopK              = 50
+	costSubquery          = 25
+	costRangePerHour      = 1
+
+	// topk and bottomk above this are considered unbounded
+	maxTopK = 100
+)
+
+// EstimateCost statically estimates the cost of a PromQL expression
+func EstimateCost(e parser.Expr) stacks.Cost {
+	var cost stacks.Cost
+
+	parser.Inspect(e, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			if !stacks.Selective(n.LabelMatchers) {
+				cost.Add(costUnboundedSelector, "selector %s matches every series", n)
+			} else if !hasMetricName(n.LabelMatchers) {
+				cost.Add(costMissingMetricName, "selector %s has no metric name", n)
+			}
+
+		case *parser.MatrixSelector:
+			if hours := int(n.Range / time.Hour); hours > 0 {
+				cost.Add(hours*costRangePerHour, "range vector of %s", n.Range)
+			}
+
+		case *parser.SubqueryExpr:
+			// nested subqueries are exponentially more expensive
+			depth := 1
+			for _, p := range path {
+				if _, ok := p.(*parser.SubqueryExpr); ok {
+					depth++
+				}
+			}
+			cost.Add(costSubquery*depth*depth, "subquery at depth %d", depth)
+
+		case *parser.AggregateExpr:
+			switch n.Op {
+			case parser.COUNT_VALUES:
+				cost.Add(costCountValues, "count_values creates one series per distinct value")
+			case parser.TOPK, parser.BOTTOMK:
+				if k, ok := n.Param.(*parser.NumberLiteral); !ok || k.Val > maxTopK {
+					cost.Add(costTopK, "%s is unbounded", n.Op)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return cost
+}
+
+// hasMetricName reports whether the matchers select a single metric name
+// The name can be written as a matcher, e.g. {__name__="x"}
+func hasMetricName(matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value != "" {
+			return true
+		}
+	}
+
+	return false
+}
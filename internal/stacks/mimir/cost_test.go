@@ -0,0 +1,109 @@
+package mimir
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestEstimateCost(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{`up{job="api"}`, 0},
+		{`{__name__="up", job="api"}`, 0},
+		{`{job="api"}`, costMissingMetricName},
+		{`{__name__=~"up|down", job="api"}`, costMissingMetricName},
+		{`{job=~".+"}`, costUnboundedSelector},
+		{`up`, 0},
+		{`rate(up{job="api"}[3h])`, 3 * costRangePerHour},
+		{`max_over_time(rate(up{job="api"}[5m])[1h:1m])`, costSubquery},
+		{`max_over_time(max_over_time(up{job="api"}[5m:1m])[5m:1m])`, costSubquery + 4*costSubquery},
+		{`count_values("v", up{job="api"})`, costCountValues},
+		{`topk(10, up{job="api"})`, 0},
+		{`topk(1000, up{job="api"})`, costTopK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := EstimateCost(expr); got.Score != tt.want {
+				t.Errorf("got cost %s, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleQueryCost(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: "http://localhost:9009",
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode: config.ModeAllowList,
+				Groups: []config.Group{{
+					Name:       "team-a",
+					Matchers:   []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+					CostBudget: config.CostBudget{Max: 50, Action: config.CostActionReject},
+				}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		cost   string
+		status int
+	}{
+		{"selective", `up{job="api"}`, "0", 0},
+		// The enforced team matcher does not make the query of the user selective
+		{"unbounded", `{job=~".+"}`, "", http.StatusUnprocessableEntity},
+		{"name matcher", `{__name__="up"}`, "0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/prometheus/api/v1/query?query=" + url.QueryEscape(tt.query) + "&time=" + strconv.FormatInt(time.Now().Unix(), 10)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+
+			err := Handle(c)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+			if tt.status != 0 {
+				return
+			}
+
+			if got := rec.Header().Get(stacks.QueryCostHeader); got != tt.cost {
+				t.Errorf("got cost %q, want %q", got, tt.cost)
+			}
+		})
+	}
+}
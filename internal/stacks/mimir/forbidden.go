@@ -0,0 +1,86 @@
+package mimir
+
+import (
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// KnownFunction reports whether name is a PromQL function or aggregation
+func KnownFunction(name string) bool {
+	if _, ok := parser.Functions[name]; ok {
+		return true
+	}
+
+	for item, s := range parser.ItemTypeStr {
+		if item.IsAggregator() && s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueryUsage returns the labels, functions and aggregations referenced by the expression
+func QueryUsage(e parser.Expr) stacks.Usage {
+	var usage stacks.Usage
+
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			for _, m := range n.LabelMatchers {
+				usage.AddLabels(m.Name)
+			}
+
+		case *parser.AggregateExpr:
+			usage.AddFunction(n.Op.String())
+			usage.AddLabels(n.Grouping...)
+			if n.Op == parser.COUNT_VALUES {
+				// The output label of count_values
+				if s, ok := n.Param.(*parser.StringLiteral); ok {
+					usage.AddLabels(s.Val)
+				}
+			}
+
+		case *parser.Call:
+			usage.AddFunction(n.Func.Name)
+			switch n.Func.Name {
+			case "label_replace":
+				// label_replace(v, dst, replacement, src, regex)
+				usage.AddLabels(stringArg(n.Args, 1), stringArg(n.Args, 3))
+			case "label_join":
+				// label_join(v, dst, separator, src...)
+				usage.AddLabels(stringArg(n.Args, 1))
+				for i := 3; i < len(n.Args); i++ {
+					usage.AddLabels(stringArg(n.Args, i))
+				}
+			case "sort_by_label", "sort_by_label_desc":
+				// sort_by_label(v, label...)
+				for i := 1; i < len(n.Args); i++ {
+					usage.AddLabels(stringArg(n.Args, i))
+				}
+			}
+
+		case *parser.BinaryExpr:
+			if n.VectorMatching != nil {
+				usage.AddLabels(n.VectorMatching.MatchingLabels...)
+				usage.AddLabels(n.VectorMatching.Include...)
+			}
+		}
+		return nil
+	})
+
+	return usage
+}
+
+// stringArg returns the value of a string literal argument, or an empty string
+func stringArg(args parser.Expressions, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+
+	if s, ok := args[i].(*parser.StringLiteral); ok {
+		return s.Val
+	}
+
+	return ""
+}
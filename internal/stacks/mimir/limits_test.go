@@ -0,0 +1,72 @@
+package mimir
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCheckQueryLookback(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: "http://localhost:9009",
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode:   config.ModeAllowList,
+				Groups: []config.Group{{Name: "team-a"}},
+				Limits: config.Limits{MaxLookback: 30 * 24 * time.Hour, MaxRangeVector: 24 * time.Hour},
+			},
+		},
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		query  string
+		time   time.Time
+		status int
+	}{
+		{"range within the lookback", "rate(x[5m])", now, 0},
+		{"offset within the lookback", "rate(x[5m] offset 1d)", now, 0},
+		{"offset over the lookback", "rate(x[5m] offset 89d)", now, http.StatusUnprocessableEntity},
+		{"vector selector offset", "x offset 89d", now, http.StatusUnprocessableEntity},
+		{"pinned in the past", "x @ 0", now, http.StatusUnprocessableEntity},
+		{"pinned within the lookback", "x @ " + strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), now, 0},
+		{"pinned range", "rate(x[5m] @ " + strconv.FormatInt(now.Add(-29*24*time.Hour).Unix(), 10) + " offset 2d)", now, http.StatusUnprocessableEntity},
+		{"subquery within the lookback", "max_over_time(rate(x[20h])[20h:1h] offset 20d)", now, 0},
+		{"subquery ranges add up", "max_over_time(rate(x[20h])[20h:1h] offset 29d)", now, http.StatusUnprocessableEntity},
+		{"pinned subquery", "max_over_time(rate(x[5m])[1h:1m] @ 0)", now, http.StatusUnprocessableEntity},
+		{"past evaluation time", "x", now.Add(-31 * 24 * time.Hour), http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/prometheus/api/v1/query?query=" + url.QueryEscape(tt.query) + "&time=" + strconv.FormatInt(tt.time.Unix(), 10)
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+
+			err := stacks.CheckQuery(c, Analyze, 0)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
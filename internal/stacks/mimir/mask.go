@@ -0,0 +1,251 @@
+package mimir
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// CheckAggregation rejects queries whose results can have a label that the groups of the user require to be aggregated away
+func CheckAggregation(c echo.Context) error {
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	names := stacks.AggregatedLabels(groups)
+	if len(names) == 0 {
+		return nil
+	}
+
+	params, err := stacks.Params(c)
+	if err != nil {
+		return err
+	}
+
+	expr, err := ParseQuery(params.Get("query"))
+	if err != nil {
+		return echo.NewHTTPError(400, "invalid query")
+	}
+
+	for _, name := range names {
+		if KeepsLabel(expr, name) {
+			return echo.NewHTTPError(http.StatusForbidden,
+				fmt.Sprintf("label %s must be aggregated away, e.g. sum without(%s)", name, name))
+		}
+	}
+
+	return nil
+}
+
+// CheckCopiedLabels rejects queries that copy the values of a masked label into another label
+func CheckCopiedLabels(c echo.Context) error {
+	params, err := stacks.Params(c)
+	if err != nil {
+		return err
+	}
+
+	expr, err := ParseQuery(params.Get("query"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid query")
+	}
+
+	return stacks.CheckCopiedLabels(c, CopiedLabels(expr))
+}
+
+// CopiedLabels returns the source labels of the label_replace and label_join calls of the expression
+func CopiedLabels(e parser.Expr) []string {
+	sources := make([]string, 0)
+
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		call, ok := node.(*parser.Call)
+		if !ok {
+			return nil
+		}
+
+		var args parser.Expressions
+		switch call.Func.Name {
+		case "label_replace":
+			// label_replace(v, dst, replacement, src, regex)
+			args = call.Args[3:4]
+		case "label_join":
+			// label_join(v, dst, separator, src...)
+			args = call.Args[3:]
+		}
+		for _, arg := range args {
+			if s, ok := arg.(*parser.StringLiteral); ok {
+				sources = append(sources, s.Val)
+			}
+		}
+		return nil
+	})
+
+	return sources
+}
+
+// KeepsLabel reports whether the series returned by the expression can have the label
+// It errs on the side of keeping the label when the result depends on the data
+func KeepsLabel(e parser.Expr, name string) bool {
+	switch n := e.(type) {
+	case *parser.VectorSelector, *parser.MatrixSelector:
+		return true
+
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return false
+
+	case *parser.AggregateExpr:
+		if n.Op == parser.COUNT_VALUES {
+			// The parameter is the name of the label that holds the values
+			if s, ok := n.Param.(*parser.StringLiteral); !ok || s.Val == name {
+				return true
+			}
+		}
+		switch {
+		case n.Op == parser.TOPK || n.Op == parser.BOTTOMK || n.Op == parser.LIMITK || n.Op == parser.LIMIT_RATIO:
+			// The series are returned with all their labels
+			return KeepsLabel(n.Expr, name)
+		case n.Without:
+			return !slices.Contains(n.Grouping, name) && KeepsLabel(n.Expr, name)
+		default:
+			return slices.Contains(n.Grouping, name) && KeepsLabel(n.Expr, name)
+		}
+
+	case *parser.Call:
+		if n.Type() == parser.ValueTypeScalar {
+			return false
+		}
+		switch n.Func.Name {
+		case "label_replace", "label_join":
+			// The destination label can be set to anything
+			if dst, ok := n.Args[1].(*parser.StringLiteral); !ok || dst.Val == name {
+				return true
+			}
+		case "info":
+			// The labels of the info metrics are added
+			return true
+		case "absent", "absent_over_time":
+			// The labels come from the equality matchers of the query
+			return false
+		}
+		for _, arg := range n.Args {
+			if t := arg.Type(); (t == parser.ValueTypeVector || t == parser.ValueTypeMatrix) && KeepsLabel(arg, name) {
+				return true
+			}
+		}
+		return false
+
+	case *parser.BinaryExpr:
+		lhs := n.LHS.Type() == parser.ValueTypeVector && KeepsLabel(n.LHS, name)
+		rhs := n.RHS.Type() == parser.ValueTypeVector && KeepsLabel(n.RHS, name)
+		if n.LHS.Type() != parser.ValueTypeVector || n.RHS.Type() != parser.ValueTypeVector {
+			// Operations with scalars keep the labels of the vector
+			return lhs || rhs
+		}
+
+		matching := n.VectorMatching
+		if matching == nil {
+			matching = &parser.VectorMatching{Card: parser.CardOneToOne}
+		}
+		switch {
+		case n.Op == parser.LOR:
+			return lhs || rhs
+		case n.Op == parser.LAND || n.Op == parser.LUNLESS:
+			return lhs
+		case matching.Card == parser.CardManyToOne:
+			// group_left copies the included labels of the right side
+			return lhs || (rhs && slices.Contains(matching.Include, name))
+		case matching.Card == parser.CardOneToMany:
+			return rhs || (lhs && slices.Contains(matching.Include, name))
+		case matching.On:
+			// One-to-one matching only keeps the labels of on()
+			return lhs && slices.Contains(matching.MatchingLabels, name)
+		default:
+			return lhs && !slices.Contains(matching.MatchingLabels, name)
+		}
+
+	case *parser.ParenExpr:
+		return KeepsLabel(n.Expr, name)
+
+	case *parser.UnaryExpr:
+		return KeepsLabel(n.Expr, name)
+
+	case *parser.SubqueryExpr:
+		return KeepsLabel(n.Expr, name)
+
+	case *parser.StepInvariantExpr:
+		return KeepsLabel(n.Expr, name)
+	}
+
+	return true
+}
+
+// MaskLabelValuesCardinality masks the values returned by the label values cardinality API
+// The values of a dropped label can not be requested, the values of a hashed label are hashed
+func MaskLabelValuesCardinality(c echo.Context, labelNames []string) error {
+	hashed := make([]string, 0)
+	secret := ""
+	for _, name := range labelNames {
+		action, s, ok, err := stacks.LabelMask(c, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if action == config.MaskActionDrop {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("the values of label %s are masked", name))
+		}
+		hashed = append(hashed, name)
+		secret = s
+	}
+
+	if len(hashed) == 0 {
+		return nil
+	}
+
+	// e.g. {"label_name": "pod", "label_values_count": 1, "series_count": 1, "cardinality": [{"label_value": "a", "series_count": 1}]}
+	stacks.StreamResponse(c, []string{"labels"}, func(element json.RawMessage) (json.RawMessage, error) {
+		var label struct {
+			LabelName   string                       `json:"label_name"`
+			Cardinality []map[string]json.RawMessage `json:"cardinality"`
+		}
+		err := json.Unmarshal(element, &label)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(hashed, label.LabelName) {
+			return element, nil
+		}
+
+		for _, value := range label.Cardinality {
+			var v string
+			if err := json.Unmarshal(value["label_value"], &v); err != nil {
+				return nil, err
+			}
+			value["label_value"], err = json.Marshal(stacks.HashLabelValue(secret, v))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(element, &fields)
+		if err != nil {
+			return nil, err
+		}
+		fields["cardinality"], err = json.Marshal(label.Cardinality)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(fields)
+	})
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package mimir
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMaskedLabelRoutes(t *testing.T) {
+	destination := config.Destination{
+		Type:       config.StackMimir,
+		Upstream:   "http://localhost:9009",
+		MaskSecret: "secret",
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Groups: []config.Group{
+				{Name: "team-a", MaskLabels: config.LabelMask{Labels: []string{"customer_id"}, Action: config.MaskActionHash}},
+				{Name: "team-b", MaskLabels: config.LabelMask{Labels: []string{"internal_id"}}},
+			}},
+		},
+	}
+	hashed := stacks.HashLabelValue("secret", "acme")
+
+	tests := []struct {
+		name     string
+		target   string
+		upstream string
+		want     string
+		status   int
+	}{
+		{
+			name:     "active series",
+			target:   "/prometheus/api/v1/cardinality/active_series?selector=up",
+			upstream: `{"data":[{"__name__":"up","customer_id":"acme","internal_id":"42"}]}`,
+			want:     `{"data":[{"__name__":"up","customer_id":"` + hashed + `"}]}`,
+		},
+		{
+			name:     "label values cardinality of a hashed label",
+			target:   "/prometheus/api/v1/cardinality/label_values?label_names[]=customer_id&label_names[]=job",
+			upstream: `{"series_count_total":3,"labels":[{"label_name":"customer_id","label_values_count":1,"series_count":2,"cardinality":[{"label_value":"acme","series_count":2}]},{"label_name":"job","label_values_count":1,"series_count":1,"cardinality":[{"label_value":"api","series_count":1}]}]}`,
+			want:     `{"series_count_total":3,"labels":[{"cardinality":[{"label_value":"` + hashed + `","series_count":2}],"label_name":"customer_id","label_values_count":1,"series_count":2},{"label_name":"job","label_values_count":1,"series_count":1,"cardinality":[{"label_value":"api","series_count":1}]}]}`,
+		},
+		{
+			name:   "label values cardinality of a dropped label",
+			target: "/prometheus/api/v1/cardinality/label_values?label_names[]=internal_id",
+			status: http.StatusForbidden,
+		},
+		{
+			name:     "label values",
+			target:   "/prometheus/api/v1/label/customer_id/values",
+			upstream: `{"status":"success","data":["acme"]}`,
+			want:     `{"status":"success","data":["` + hashed + `"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.target, nil), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a", "team-b"})
+
+			err := Handle(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopiedMaskedLabels(t *testing.T) {
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: "http://localhost:9009",
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Groups: []config.Group{
+				{Name: "team-a", MaskLabels: config.LabelMask{Labels: []string{"customer_id"}, Action: config.MaskActionHash, RequireAggregation: true}},
+				{Name: "team-b", MaskLabels: config.LabelMask{Labels: []string{"internal_id"}}},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"aggregated copy of a hashed label", `sum by (leak) (label_replace(up, "leak", "$1", "customer_id", "(.*)"))`, http.StatusForbidden},
+		{"copy of a dropped label", `label_replace(up, "leak", "$1", "internal_id", "(.*)")`, http.StatusForbidden},
+		{"join of a masked label", `label_join(up, "leak", ",", "job", "internal_id")`, http.StatusForbidden},
+		{"copy of an unmasked label", `sum by (leak) (label_replace(up, "leak", "$1", "job", "(.*)"))`, 0},
+		{"no copy", `sum(up)`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/prometheus/api/v1/query?query=" + url.QueryEscape(tt.query)
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a", "team-b"})
+
+			err := Handle(c)
+
+			status := 0
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package mimir
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	defaultMetadataCacheTTL = time.Minute
+)
+
+var (
+	metricNames = &metricNameCache{entries: map[string]metricNameCacheEntry{}}
+)
+
+// metricNameCache caches the metric names visible through a selector
+type metricNameCache struct {
+	mu      sync.Mutex
+	entries map[string]metricNameCacheEntry
+}
+
+type metricNameCacheEntry struct {
+	names   map[string]struct{}
+	expires time.Time
+}
+
+func (m *metricNameCache) get(key string) (map[string]struct{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.names, true
+}
+
+func (m *metricNameCache) set(key string, names map[string]struct{}, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range m.entries {
+		if now.After(entry.expires) {
+			delete(m.entries, k)
+		}
+	}
+
+	m.entries[key] = metricNameCacheEntry{names: names, expires: now.Add(ttl)}
+}
+
+// FilterMetadata filters the metadata API response to the metrics that the user can see
+// The metadata API does not accept selectors so we cant enforce LBAC on the request
+func FilterMetadata(c echo.Context) error {
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	destination := c.Get("destination").(config.Destination)
+	enforcedLabels := stacks.Matchers(groups)
+
+	filterSeries := destination.FilterMetadata && len(enforcedLabels) > 0
+	if !filterSeries && !stacks.HasMetricFilters(groups) {
+		return nil
+	}
+
+	var visible map[string]struct{}
+	if filterSeries {
+		visible, err = visibleMetricNames(c, enforcedLabels)
+		if err != nil {
+			return echo.NewHTTPError(502, "failed to lookup visible metrics")
+		}
+	}
+
+	stacks.ModifyResponse(c, func(body []byte) ([]byte, error) {
+		// {"status": "success", "data": {"<metric>": [{"type": "", "help": "", "unit": ""}]}}
+		var response map[string]json.RawMessage
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, err
+		}
+
+		var metadata map[string]json.RawMessage
+		if err := json.Unmarshal(response["data"], &metadata); err != nil {
+			return nil, err
+		}
+
+		for name := range metadata {
+			if _, ok := visible[name]; filterSeries && !ok {
+				delete(metadata, name)
+				continue
+			}
+			if !stacks.AllowsMetric(groups, name) {
+				delete(metadata, name)
+			}
+		}
+
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, err
+		}
+		response["data"] = data
+
+		return json.Marshal(response)
+	})
+
+	return nil
+}
+
+// visibleMetricNames returns the name of the metrics that have series matching the enforced labels
+// Looking up the values of __name__ is the cheapest way to list the metrics of the matching series
+func visibleMetricNames(c echo.Context, enforcedLabels []*labels.Matcher) (map[string]struct{}, error) {
+	destination := c.Get("destination").(config.Destination)
+	tenantNames := c.Get("tenantNames").([]string)
+
+	selector := newSelector(enforcedLabels)
+
+	key := destination.Upstream + "|" + tenantNames[0] + "|" + selector.String()
+	if names, ok := metricNames.get(key); ok {
+		return names, nil
+	}
+
+	body, err := stacks.Get(c,
+		destination.APIPrefix()+RouteLabelValuesPrefix+labels.MetricName+"/values",
+		url.Values{"match[]": []string{selector.String()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// {"status": "success", "data": ["<metric>"]}
+	var response struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(response.Data))
+	for _, name := range response.Data {
+		names[name] = struct{}{}
+	}
+
+	ttl := destination.MetadataCacheTTL
+	if ttl == 0 {
+		ttl = defaultMetadataCacheTTL
+	}
+	metricNames.set(key, names, ttl)
+
+	return names, nil
+}
@@ -0,0 +1,106 @@
+package mimir
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestFilterMetadata(t *testing.T) {
+	lookups := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prometheus/api/v1/label/__name__/values" || r.URL.Query().Get("match[]") != `{team="a"}` {
+			http.NotFound(w, r)
+			return
+		}
+		lookups++
+		fmt.Fprint(w, `{"status":"success","data":["node_load1","node_secret_token","up"]}`)
+	}))
+	defer upstream.Close()
+
+	metadata := `{"status":"success","data":{` +
+		`"node_load1":[{"type":"gauge","help":"","unit":""}],` +
+		`"node_secret_token":[{"type":"gauge","help":"","unit":""}],` +
+		`"node_cpu_seconds_total":[{"type":"counter","help":"","unit":""}],` +
+		`"up":[{"type":"gauge","help":"","unit":""}]}}`
+
+	lbac := config.Group{Name: "team-lbac", Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")}}
+
+	tests := []struct {
+		name    string
+		filter  bool
+		groups  []config.Group
+		want    string
+		lookups int
+	}{
+		{
+			name:   "metric filters",
+			groups: metricGroups(t),
+			want:   `{"data":{"node_cpu_seconds_total":[{"type":"counter","help":"","unit":""}],"node_load1":[{"type":"gauge","help":"","unit":""}]},"status":"success"}`,
+		},
+		{
+			name:    "series of the enforced labels",
+			filter:  true,
+			groups:  []config.Group{lbac},
+			want:    `{"data":{"node_load1":[{"type":"gauge","help":"","unit":""}],"node_secret_token":[{"type":"gauge","help":"","unit":""}],"up":[{"type":"gauge","help":"","unit":""}]},"status":"success"}`,
+			lookups: 1,
+		},
+		{
+			name:    "series of the enforced labels and metric filters",
+			filter:  true,
+			groups:  metricGroups(t),
+			want:    `{"data":{"node_load1":[{"type":"gauge","help":"","unit":""}]},"status":"success"}`,
+			lookups: 1, // cached
+		},
+		{
+			name:    "metadata not filtered by series",
+			groups:  []config.Group{lbac},
+			want:    metadata,
+			lookups: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destination := config.Destination{
+				Type:           config.StackMimir,
+				Upstream:       upstream.URL,
+				FilterMetadata: tt.filter,
+				Tenants:        map[string]config.Tenant{"t1": {Mode: config.ModeAllowList, Groups: tt.groups}},
+			}
+
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/metadata", nil), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{tt.groups[0].Name})
+
+			if err := Handle(c); err != nil {
+				t.Fatal(err)
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(metadata)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if lookups != tt.lookups {
+				t.Errorf("got %d lookups of the visible metrics, want %d", lookups, tt.lookups)
+			}
+		})
+	}
+}
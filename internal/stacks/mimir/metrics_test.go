@@ -0,0 +1,230 @@
+package mimir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// metricGroups returns a group that only allows the node metrics, http_requests_total and the /.*_seconds/ metrics
+// and denies node_secret_*
+func metricGroups(t *testing.T) []config.Group {
+	t.Helper()
+
+	group := config.Group{
+		Name:     "team-a",
+		Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+		Metrics: config.MetricFilter{
+			Allow: []string{"node_*", "http_requests_total", "/.*_seconds/"},
+			Deny:  []string{"node_secret_*"},
+		},
+	}
+	if err := group.Metrics.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	return []config.Group{group}
+}
+
+func TestEnforceMetricFilters(t *testing.T) {
+	groups := metricGroups(t)
+	restriction := `__name__!~"(?:node_secret_.*)",__name__=~"(?:node_.*)|(?:http_requests_total)|(?:.*_seconds)"`
+
+	tests := []struct {
+		name   string
+		query  string
+		want   string
+		status int
+	}{
+		{"exact", `http_requests_total`, `http_requests_total`, 0},
+		{"prefix", `rate(node_cpu_seconds_total[5m])`, `rate(node_cpu_seconds_total[5m])`, 0},
+		{"regex", `histogram_quantile(0.9, rate(request_duration_seconds[5m]))`, `histogram_quantile(0.9, rate(request_duration_seconds[5m]))`, 0},
+		{"not allowed", `up`, "", http.StatusForbidden},
+		{"denied", `node_secret_token`, "", http.StatusForbidden},
+		{"one of the selectors not allowed", `node_load1 / up`, "", http.StatusForbidden},
+		{"name regex", `{__name__=~"node_.*"}`, `{` + restriction + `,__name__=~"node_.*"}`, 0},
+		{"without name", `{job="x"}`, `{` + restriction + `,job="x"}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = EnforceMetricFilters(expr, groups)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := expr.String(); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+
+			// Enforcing the filters again does not change the query
+			if err := EnforceMetricFilters(expr, groups); err != nil || expr.String() != tt.want {
+				t.Errorf("enforcing again returned %s (%v)", expr, err)
+			}
+		})
+	}
+}
+
+func TestPermittedMetricFilters(t *testing.T) {
+	groups := metricGroups(t)
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{`node_load1{team="a"}`, true},
+		{`node_load1`, false},
+		{`up{team="a"}`, false},
+		{`node_secret_token{team="a"}`, false},
+		{`{job="x", team="a"}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := Permitted(tt.query, groups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	// The enforced query of a name-less selector is permitted
+	query, err := Enforce(`{job="x"}`, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Permitted(query, groups); err != nil || !ok {
+		t.Errorf("enforced query %s is not permitted (%v)", query, err)
+	}
+}
+
+func TestRulesMetricFilters(t *testing.T) {
+	rules := `{"status":"success","data":{"groups":[` +
+		`{"name":"allowed","rules":[{"name":"NodeDown","type":"alerting","query":"node_up{team=\"a\"} == 0"}]},` +
+		`{"name":"filtered","rules":[{"name":"Down","type":"alerting","query":"up{team=\"a\"} == 0"}]}]}}`
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/prometheus/api/v1/rules":
+			fmt.Fprint(w, rules)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: upstream.URL,
+		Tenants: map[string]config.Tenant{
+			"t1": {Mode: config.ModeAllowList, Roles: config.Roles{RulerWrite: "rules-admin"}, Groups: metricGroups(t)},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		upstream string
+		want     string
+		status   int
+	}{
+		{
+			name:     "rules",
+			method:   http.MethodGet,
+			target:   "/prometheus/api/v1/rules",
+			upstream: rules,
+			want:     `{"data":{"groups":[{"name":"allowed","rules":[{"name":"NodeDown","type":"alerting","query":"node_up{team=\"a\"} == 0"}]}]},"status":"success"}`,
+		},
+		{
+			name:     "alerts",
+			method:   http.MethodGet,
+			target:   "/prometheus/api/v1/alerts",
+			upstream: `{"status":"success","data":{"alerts":[{"labels":{"alertname":"NodeDown","team":"a"}},{"labels":{"alertname":"Down","team":"a"}}]}}`,
+			want:     `{"data":{"alerts":[{"labels":{"alertname":"NodeDown","team":"a"}}]},"status":"success"}`,
+		},
+		{
+			name:   "write a rule of a metric that is not allowed",
+			method: http.MethodPost,
+			target: "/prometheus/config/v1/rules/ns",
+			body:   "name: g1\nrules:\n  - record: a\n    expr: sum(up)\n",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "write a rule of an allowed metric",
+			method: http.MethodPost,
+			target: "/prometheus/config/v1/rules/ns",
+			body:   "name: g1\nrules:\n  - record: a\n    expr: sum(node_load1)\n",
+			want:   "name: g1\nrules:\n    - record: a\n      expr: sum(node_load1{team=\"a\"})\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)), rec)
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+			c.Set("roles", []string{"rules-admin"})
+
+			err := Handle(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.method == http.MethodPost {
+				body, _ := io.ReadAll(c.Request().Body)
+				if got := string(body); got != tt.want {
+					t.Errorf("got  %s\nwant %s", got, tt.want)
+				}
+				return
+			}
+
+			// The proxied upstream response
+			c.Response().Writer.WriteHeader(http.StatusOK)
+			if _, err := c.Response().Writer.Write([]byte(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stacks.FlushResponse(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
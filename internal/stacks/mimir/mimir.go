@@ -1,30 +1,37 @@
 package mimir
 
 import (
+	"fmt"
 	"log"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
+// Routes are relative to the destination API prefix
 const (
-	RouteInstantQuery           = "/prometheus/api/v1/query"
-	RouteRangeQuery             = "/prometheus/api/v1/query_range"
-	RouteQueryExemplars         = "/prometheus/api/v1/query_exemplars"
-	RouteSeries                 = "/prometheus/api/v1/series"
-	RouteActiveSeries           = "/prometheus/api/v1/cardinality/active_series"
-	RouteLabels                 = "/prometheus/api/v1/labels"
-	RouteLabelValuesPrefix      = "/prometheus/api/v1/label/"
-	RouteMetadata               = "/prometheus/api/v1/metadata"
-	RouteRemoteRead             = "/prometheus/api/v1/read"
-	RouteLabelNamesCardinality  = "/prometheus/api/v1/cardinality/label_names"
-	RouteLabelValuesCardinality = "/prometheus/api/v1/cardinality/label_values"
-	RouteFormatQuery            = "/prometheus/api/v1/format_query"
-	RouteBuildInfo              = "/prometheus/api/v1/status/buildinfo"
+	RouteInstantQuery           = "/api/v1/query"
+	RouteRangeQuery             = "/api/v1/query_range"
+	RouteQueryExemplars         = "/api/v1/query_exemplars"
+	RouteSeries                 = "/api/v1/series"
+	RouteActiveSeries           = "/api/v1/cardinality/active_series"
+	RouteLabels                 = "/api/v1/labels"
+	RouteLabelValuesPrefix      = "/api/v1/label/"
+	RouteMetadata               = "/api/v1/metadata"
+	RouteRemoteRead             = "/api/v1/read"
+	RouteLabelNamesCardinality  = "/api/v1/cardinality/label_names"
+	RouteLabelValuesCardinality = "/api/v1/cardinality/label_values"
+	RouteFormatQuery            = "/api/v1/format_query"
+	RouteBuildInfo              = "/api/v1/status/buildinfo"
+	RouteRules                  = "/api/v1/rules"
+	RouteAlerts                 = "/api/v1/alerts"
+	RouteRulerConfig            = "/config/v1/rules"
 )
 
 type Label struct {
@@ -33,20 +40,99 @@ type Label struct {
 }
 
 func Handle(c echo.Context) error {
-	if c.Request().Method == "POST" {
-		// TODO
-		return nil
+	destination := c.Get("destination").(config.Destination)
+
+	if prefix := destination.AlertmanagerPrefix(); prefix != "" {
+		if path, ok := strings.CutPrefix(c.Request().URL.Path, prefix); ok && strings.HasPrefix(path, "/api/v2/") {
+			err := HandleAlertmanager(c, path)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+
+			return nil
+		}
 	}
 
-	path := c.Request().URL.Path
+	path, ok := strings.CutPrefix(c.Request().URL.Path, destination.APIPrefix())
+	if !ok {
+		return stacks.UnknownRoute(c)
+	}
 
 	if strings.HasPrefix(path, RouteLabelValuesPrefix) {
-		// We cant enforce LBAC here
+		// /label/<name>/values
+		name, _, _ := strings.Cut(strings.TrimPrefix(path, RouteLabelValuesPrefix), "/")
+		err := stacks.CheckLabelName(c, name)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		// query: match[]=<selector> (optional, can be repeated)
+		err = PatchOptionalQuery(c, "match[]")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = stacks.MaskLabelValues(c, name, []string{"data"})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+	}
+
+	if path == RouteRulerConfig || strings.HasPrefix(path, RouteRulerConfig+"/") {
+		err := stacks.HandleRulerConfig(c, destination.APIPrefix()+RouteRulerConfig, Permitted, Enforce)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
 		return nil
 	}
 
 	switch path {
-	case RouteInstantQuery, RouteRangeQuery, RouteQueryExemplars, RouteFormatQuery:
+	case RouteInstantQuery, RouteRangeQuery, RouteQueryExemplars:
+
+		// The cost is estimated on the query of the user, range queries require start
+		err := stacks.CheckQuery(c, Analyze, 0)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = PatchQuery(c, "query")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		err = CheckCopiedLabels(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		if path == RouteQueryExemplars {
+			// Exemplars are returned with the labels of their series even for aggregations
+			err = stacks.MaskResult(c, []string{"data"})
+		} else {
+			err = CheckAggregation(c)
+			if err == nil {
+				err = stacks.MaskResult(c, []string{"data", "result"})
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteFormatQuery:
 
 		err := PatchQuery(c, "query")
 		if err != nil {
@@ -56,7 +142,7 @@ func Handle(c echo.Context) error {
 
 		return nil
 
-	case RouteSeries, RouteLabels:
+	case RouteSeries:
 		// This can be either a GET or POST request
 		// query: match[]=<selector> (can be repeated)
 		// You can URL-encode these parameters directly in the request body by using
@@ -68,9 +154,25 @@ func Handle(c echo.Context) error {
 			return err
 		}
 
+		err = stacks.MaskSeries(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
 		return nil
 
-	case RouteActiveSeries, RouteLabelNamesCardinality:
+	case RouteLabels:
+		// query: match[]=<selector> (optional, can be repeated)
+		err := PatchOptionalQuery(c, "match[]")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteActiveSeries:
 		// This can be either a GET or POST request
 		// query: selector=<selector>
 		err := PatchQuery(c, "selector")
@@ -79,11 +181,56 @@ func Handle(c echo.Context) error {
 			return err
 		}
 
+		err = stacks.MaskSeries(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteLabelNamesCardinality:
+		// This can be either a GET or POST request
+		// query: selector=<selector> (optional)
+		err := PatchOptionalQuery(c, "selector")
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteBuildInfo:
+		// Does not expose any tenant data
 		return nil
 
 	case RouteMetadata:
 		// query: metric=<metric name>
-		// We cant enforce LBAC here
+		// We cant enforce LBAC here, the response is filtered instead
+		err := FilterMetadata(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteRules:
+		err := stacks.FilterPrometheusRules(c, Permitted)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
+
+	case RouteAlerts:
+		err := stacks.FilterPrometheusAlerts(c, destination.APIPrefix()+RouteRules, Permitted)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
 		return nil
 
 	case RouteRemoteRead:
@@ -93,10 +240,16 @@ func Handle(c echo.Context) error {
 	case RouteLabelValuesCardinality:
 		// label_names[] - required - specifies labels for which cardinality must be provided.
 		// selector - optional - specifies PromQL selector that will be used to filter series that must be analyzed.
-		return echo.ErrNotImplemented
+		err := PatchLabelValuesCardinality(c)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		return nil
 
 	default:
-		return echo.ErrBadRequest
+		return stacks.UnknownRoute(c)
 	}
 }
 
@@ -106,72 +259,223 @@ func ParseQuery(query string) (parser.Expr, error) {
 }
 
 func PatchQuery(c echo.Context, parameterName string) error {
-	// Parse the query
-	query := c.Request().URL.Query().Get(parameterName)
-	expr, err := ParseQuery(query)
+	params, err := stacks.Params(c)
 	if err != nil {
-		log.Println(err)
-		return echo.NewHTTPError(400, "invalid query")
+		return err
 	}
 
-	// Get the tenant from the request
-	destination := c.Get("destination").(config.Destination)
-	tenantNames := c.Get("tenantNames").([]string)
+	// Parse the queries, the parameter can be repeated
+	queries := params[parameterName]
+	if len(queries) == 0 {
+		return echo.NewHTTPError(400, "invalid query")
+	}
 
-	// We dont support multi tenant requests for now
-	tenant, ok := destination.Tenants[tenantNames[0]]
-	if !ok {
-		if destination.AllowUndefined {
-			// Allow access if the tenant is not defined
-			return nil
+	exprs := make([]parser.Expr, 0, len(queries))
+	for _, query := range queries {
+		expr, err := ParseQuery(query)
+		if err != nil {
+			log.Println(err)
+			stacks.RewriteFailed(c)
+			return echo.NewHTTPError(400, "invalid query")
 		}
-		return echo.ErrBadRequest
+		exprs = append(exprs, expr)
 	}
 
-	userGroups := c.Get("groups").([]string)
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
 
-	found := false
-	enforcedLabels := make([]*labels.Matcher, 0)
-	// A user can be part of multiple groups, so we need to check all of them
-	// and see if any of them match any of the groups in the tenant
-	for _, group := range tenant.Groups {
-		if !slices.Contains(userGroups, group.Name) {
-			continue
-		}
-		if len(group.Matchers) > 0 {
-			// if we get here, it means that the user is part of a group
-			// that has LBAC rules
-			enforcedLabels = append(enforcedLabels, group.Matchers...)
+	for i, expr := range exprs {
+		// Checked before LBAC is enforced, the enforced matchers may use forbidden labels
+		err = stacks.CheckForbidden(groups, QueryUsage(expr))
+		if err != nil {
+			return err
 		}
-		found = true
-	}
 
-	if tenant.Mode == config.ModeAllowList {
-		// This tenant requires that the user is part of at least one of the groups
-		if !found {
-			return echo.ErrForbidden
+		err = EnforceLBAC(expr, stacks.Matchers(groups))
+		if err != nil {
+			log.Printf("failed to enforce LBAC: %v", err)
+			stacks.RewriteFailed(c)
+			return echo.NewHTTPError(400, "invalid query: %v", err)
 		}
-	} else {
-		// This tenant requires that the user is not part of any of the groups
-		if found {
-			return echo.ErrForbidden
+
+		// After LBAC, which replaces the matchers of the enforced labels
+		err = EnforceMetricFilters(expr, groups)
+		if err != nil {
+			return err
 		}
+
+		// patch the query with the new one
+		queries[i] = expr.String()
 	}
 
-	err = EnforceLBAC(expr, enforcedLabels)
+	stacks.SetParams(c, params)
+
+	return nil
+}
+
+// PatchOptionalQuery enforces LBAC on a query parameter that may be omitted
+// When it is, a selector with the enforced labels is injected
+func PatchOptionalQuery(c echo.Context, parameterName string) error {
+	params, err := stacks.Params(c)
 	if err != nil {
-		log.Printf("failed to enforce LBAC: %v", err)
-		return echo.NewHTTPError(400, "invalid query: %v", err)
+		return err
+	}
+
+	if len(params[parameterName]) > 0 {
+		return PatchQuery(c, parameterName)
+	}
+
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	enforcedLabels := append(stacks.Matchers(groups), stacks.MetricMatchers(groups)...)
+	if len(enforcedLabels) == 0 {
+		// Nothing to enforce, the user can see every series
+		return nil
 	}
 
-	// patch the query with the new one
-	patchedQuery := c.Request().URL.Query() // this returns a copy and not a reference
-	patchedQuery.Set(parameterName, expr.String())
-	c.Request().URL.RawQuery = patchedQuery.Encode()
+	params.Set(parameterName, newSelector(enforcedLabels).String())
+	stacks.SetParams(c, params)
 
 	return nil
 }
 
+// PatchLabelValuesCardinality enforces LBAC on the label values cardinality API
+// The selector is optional, so we inject one with the enforced matchers if it is missing
+func PatchLabelValuesCardinality(c echo.Context) error {
+	groups, ok, err := stacks.UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	params, err := stacks.Params(c)
+	if err != nil {
+		return err
+	}
+
+	labelNames := params["label_names[]"]
+	if len(labelNames) == 0 {
+		return echo.NewHTTPError(400, "label_names[] is required")
+	}
+
+	hidden := stacks.HiddenLabels(groups)
+	for _, name := range labelNames {
+		if slices.Contains(hidden, name) {
+			return echo.NewHTTPError(403, fmt.Sprintf("label %s is not allowed", name))
+		}
+	}
+
+	err = stacks.CheckForbidden(groups, stacks.Usage{Labels: labelNames})
+	if err != nil {
+		return err
+	}
+
+	err = PatchOptionalQuery(c, "selector")
+	if err != nil {
+		return err
+	}
+
+	return MaskLabelValuesCardinality(c, labelNames)
+}
+
+// Analyze parses a PromQL query for the query limits and cost checks
+func Analyze(query string) (stacks.Analysis, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return stacks.Analysis{}, err
+	}
+
+	lookback, earliest := maxLookback(expr)
+
+	return stacks.Analysis{RangeVector: maxRangeVector(expr), Lookback: lookback, Earliest: earliest, Cost: EstimateCost(expr)}, nil
+}
+
+// maxRangeVector returns the longest range vector or subquery duration of the expression
+func maxRangeVector(e parser.Expr) time.Duration {
+	var longest time.Duration
+
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			longest = max(longest, n.Range)
+		case *parser.SubqueryExpr:
+			longest = max(longest, n.Range)
+		}
+		return nil
+	})
+
+	return longest
+}
+
+// maxLookback returns how far before the evaluation time the selectors of the expression read
+// and the earliest time read by the selectors pinned with @, zero when there is none
+// The ranges and offsets of the enclosing subqueries add up until one of them is pinned
+// @ start() and @ end() are relative to the query range and counted as such
+func maxLookback(e parser.Expr) (time.Duration, time.Time) {
+	var longest time.Duration
+	var earliest time.Time
+
+	parser.Inspect(e, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		lookback := vs.OriginalOffset
+		at := vs.Timestamp
+	ancestors:
+		for i := len(path) - 1; i >= 0; i-- {
+			switch n := path[i].(type) {
+			case *parser.MatrixSelector:
+				lookback += n.Range
+			case *parser.SubqueryExpr:
+				if at != nil {
+					break ancestors
+				}
+				lookback += n.Range + n.OriginalOffset
+				at = n.Timestamp
+			}
+		}
+
+		if at == nil {
+			longest = max(longest, lookback)
+			return nil
+		}
+		if t := time.UnixMilli(*at).Add(-lookback); earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+		return nil
+	})
+
+	return longest, earliest
+}
+
+// newSelector returns a vector selector with the given matchers
+func newSelector(matchers []*labels.Matcher) *parser.VectorSelector {
+	selector := &parser.VectorSelector{LabelMatchers: slices.Clone(matchers)}
+	if !matchesNonEmpty(matchers) {
+		// Prometheus rejects selectors where every matcher matches the empty string
+		selector.LabelMatchers = append(selector.LabelMatchers,
+			labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	}
+
+	return selector
+}
+
+func matchesNonEmpty(matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return true
+		}
+	}
+
+	return false
+}
+
 func EnforceLBAC(e parser.Expr, lbac []*labels.Matcher) error {
 	// must check if any labels are already set in the expression
 	// if so, we must rewrite them instead of adding them
@@ -179,23 +483,108 @@ func EnforceLBAC(e parser.Expr, lbac []*labels.Matcher) error {
 	selectors := getSelectors(e)
 
 	for _, selector := range selectors {
-	OUTER:
-		for _, l := range lbac {
-			for _, m := range selector.LabelMatchers {
-				if m.Name == l.Name {
-					// user already set this label, we must rewrite it instead of adding it
-					m = l
-					continue OUTER
-				}
+		// user already set these labels, we must rewrite them instead of adding them
+		selector.LabelMatchers = slices.DeleteFunc(selector.LabelMatchers, func(m *labels.Matcher) bool {
+			return slices.ContainsFunc(lbac, func(l *labels.Matcher) bool { return l.Name == m.Name })
+		})
+		selector.LabelMatchers = append(selector.LabelMatchers, lbac...)
+	}
+
+	return nil
+}
+
+// EnforceMetricFilters restricts the selectors of the expression to the metrics allowed to the groups
+// Selectors of a single metric are rejected when it is not allowed, the others (e.g. __name__=~"...")
+// are restricted with __name__ matchers
+func EnforceMetricFilters(e parser.Expr, groups []config.Group) error {
+	matchers := stacks.MetricMatchers(groups)
+	if len(matchers) == 0 {
+		return nil
+	}
+
+	for _, selector := range getSelectors(e) {
+		if name, ok := metricName(selector); ok {
+			if !stacks.AllowsMetric(groups, name) {
+				return echo.NewHTTPError(403, fmt.Sprintf("metric %s is not allowed", name))
 			}
-			selector.LabelMatchers = append(selector.LabelMatchers, l)
+			continue
 		}
 
-		log.Println(e.String())
+		for _, m := range matchers {
+			// Rule expressions are enforced again when they are written back
+			if !stacks.ContainsMatcher(selector.LabelMatchers, m) {
+				selector.LabelMatchers = append(selector.LabelMatchers, m)
+			}
+		}
 	}
+
 	return nil
 }
 
+// metricName returns the metric selected by the selector, if it selects a single one
+func metricName(selector *parser.VectorSelector) (string, bool) {
+	for _, m := range selector.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Permitted reports whether every selector of the query already enforces the LBAC matchers and the metric filters of the groups
+// i.e. enforcing them would not change the data selected by the query
+func Permitted(query string, groups []config.Group) (bool, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return false, err
+	}
+
+	lbac := stacks.Matchers(groups)
+	metrics := stacks.MetricMatchers(groups)
+	for _, selector := range getSelectors(expr) {
+		for _, l := range lbac {
+			if !stacks.ContainsMatcher(selector.LabelMatchers, l) {
+				return false, nil
+			}
+		}
+
+		if name, ok := metricName(selector); ok {
+			if !stacks.AllowsMetric(groups, name) {
+				return false, nil
+			}
+			continue
+		}
+		for _, m := range metrics {
+			if !stacks.ContainsMatcher(selector.LabelMatchers, m) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Enforce returns the query with the LBAC matchers and the metric filters of the groups enforced
+func Enforce(query string, groups []config.Group) (string, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	err = EnforceLBAC(expr, stacks.Matchers(groups))
+	if err != nil {
+		return "", err
+	}
+
+	err = EnforceMetricFilters(expr, groups)
+	if err != nil {
+		return "", err
+	}
+
+	return expr.String(), nil
+}
+
 // getSelector returns the selector from the expression
 // an expression can have multiple levels of nesting
 func getSelectors(e parser.Expr) []*parser.VectorSelector {
@@ -213,3 +602,18 @@ func getSelectors(e parser.Expr) []*parser.VectorSelector {
 
 	return selectors
 }
+
+// SelectorMatchers returns the matchers of every selector of the query
+func SelectorMatchers(query string) ([]*labels.Matcher, error) {
+	expr, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := make([]*labels.Matcher, 0)
+	for _, selector := range getSelectors(expr) {
+		matchers = append(matchers, selector.LabelMatchers...)
+	}
+
+	return matchers, nil
+}
@@ -0,0 +1,46 @@
+package mimir
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks"
+)
+
+// routes are the routes without variable segments
+var routes = []string{
+	RouteInstantQuery, RouteRangeQuery, RouteQueryExemplars, RouteSeries, RouteActiveSeries,
+	RouteLabels, RouteMetadata, RouteRemoteRead, RouteLabelNamesCardinality,
+	RouteLabelValuesCardinality, RouteFormatQuery, RouteBuildInfo, RouteRules, RouteAlerts,
+}
+
+// Route returns the route of the request path without its variable segments
+// so it can be used as a metric label
+func Route(destination config.Destination, path string) string {
+	if prefix := destination.AlertmanagerPrefix(); prefix != "" {
+		if p, ok := strings.CutPrefix(path, prefix); ok {
+			switch {
+			case p == RouteAlertmanagerAlerts, p == RouteAlertmanagerAlertGroups, p == RouteAlertmanagerSilences:
+				return path
+			case strings.HasPrefix(p, RouteAlertmanagerSilence):
+				return prefix + RouteAlertmanagerSilence + "{id}"
+			}
+		}
+	}
+
+	prefix := destination.APIPrefix()
+	p, ok := strings.CutPrefix(path, prefix)
+	switch {
+	case !ok:
+		return stacks.RouteOther
+	case strings.HasPrefix(p, RouteLabelValuesPrefix):
+		return prefix + RouteLabelValuesPrefix + "{name}/values"
+	case p == RouteRulerConfig || strings.HasPrefix(p, RouteRulerConfig+"/"):
+		return prefix + RouteRulerConfig
+	case slices.Contains(routes, p):
+		return path
+	default:
+		return stacks.RouteOther
+	}
+}
@@ -0,0 +1,105 @@
+package stacks
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Params returns the request parameters
+// Query APIs also accept the parameters URL-encoded in the body of POST requests
+// (Content-Type: application/x-www-form-urlencoded), in this case the URL query is merged
+// into the body parameters so that every parameter is enforced in a single place
+// Other bodies are rejected, the upstream could read parameters from them (e.g. multipart forms)
+func Params(c echo.Context) (url.Values, error) {
+	if params, ok := c.Get("params").(url.Values); ok {
+		return params, nil
+	}
+
+	form, err := isForm(c.Request())
+	if err != nil {
+		return nil, err
+	}
+	if !form {
+		params := c.Request().URL.Query()
+		keepOriginal(c, params)
+		return params, nil
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid form body")
+	}
+
+	for name, values := range c.Request().URL.Query() {
+		params[name] = append(params[name], values...)
+	}
+
+	keepOriginal(c, params)
+
+	// From now on the parameters are only sent in the body
+	c.Request().URL.RawQuery = ""
+	SetBody(c, []byte(params.Encode()))
+	c.Set("params", params)
+
+	return params, nil
+}
+
+// OriginalParams returns the request parameters before they were rewritten
+// ok is false when the parameters were never read, e.g. the request was denied before its handler
+func OriginalParams(c echo.Context) (params url.Values, ok bool) {
+	params, ok = c.Get("originalParams").(url.Values)
+	return params, ok
+}
+
+// keepOriginal keeps a copy of the parameters the first time they are read, the handlers rewrite them in place
+func keepOriginal(c echo.Context, params url.Values) {
+	if _, ok := c.Get("originalParams").(url.Values); ok {
+		return
+	}
+
+	original := make(url.Values, len(params))
+	for name, values := range params {
+		original[name] = slices.Clone(values)
+	}
+	c.Set("originalParams", original)
+}
+
+// SetParams replaces the request parameters returned by Params
+func SetParams(c echo.Context, params url.Values) {
+	if _, ok := c.Get("params").(url.Values); !ok {
+		c.Request().URL.RawQuery = params.Encode()
+		return
+	}
+
+	SetBody(c, []byte(params.Encode()))
+	c.Set("params", params)
+}
+
+// isForm reports whether the parameters are URL-encoded in the request body
+// The media type is case-insensitive, like in the Go upstreams
+func isForm(r *http.Request) (bool, error) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return false, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mediaType == "application/x-www-form-urlencoded" {
+		return true, nil
+	}
+	if r.ContentLength == 0 {
+		// Nothing is sent upstream
+		return false, nil
+	}
+
+	return false, echo.NewHTTPError(http.StatusUnsupportedMediaType, "request parameters must be sent in the URL or as application/x-www-form-urlencoded")
+}
@@ -0,0 +1,69 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestParams(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		query       string
+		status      int
+	}{
+		{"url", http.MethodGet, "", "", "url", 0},
+		{"form", http.MethodPost, "application/x-www-form-urlencoded", "query=body", "body", 0},
+		{"form with charset", http.MethodPost, "application/x-www-form-urlencoded; charset=utf-8", "query=body", "body", 0},
+		{"form mixed case", http.MethodPost, "Application/X-WWW-Form-Urlencoded", "query=body", "body", 0},
+		{"form patch", http.MethodPatch, "application/x-www-form-urlencoded", "query=body", "body", 0},
+		{"no content type", http.MethodPost, "", "", "url", 0},
+		{"no content type with body", http.MethodPost, "", "query=body", "", http.StatusUnsupportedMediaType},
+		{"empty json body", http.MethodPost, "application/json", "", "url", 0},
+		{"multipart", http.MethodPost, "multipart/form-data; boundary=x", "--x\r\nContent-Disposition: form-data; name=\"query\"\r\n\r\nbody\r\n--x--\r\n", "", http.StatusUnsupportedMediaType},
+		{"json", http.MethodPut, "application/json", `{"query":"body"}`, "", http.StatusUnsupportedMediaType},
+		{"invalid content type", http.MethodPost, "application/x-www-form-urlencoded; ;", "query=body", "", http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/query?query=url", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			params, err := Params(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != tt.status {
+					t.Fatalf("got error %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := params.Get("query"); got != tt.query {
+				t.Errorf("got query %q, want %q", got, tt.query)
+			}
+
+			// Every value of a form is enforced, the URL query is moved to the body
+			params.Set("query", "enforced")
+			SetParams(c, params)
+			body, _ := io.ReadAll(c.Request().Body)
+			if strings.Contains(c.Request().URL.RawQuery, "url") || strings.Contains(string(body), "body") {
+				t.Errorf("unenforced query sent upstream: url %q body %q", c.Request().URL.RawQuery, body)
+			}
+		})
+	}
+}
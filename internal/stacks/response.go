@@ -0,0 +1,124 @@
+package stacks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ResponseModifier rewrites the body of a successful upstream response
+type ResponseModifier func(body []byte) ([]byte, error)
+
+// responseBuffer holds the upstream response so it can be rewritten
+// before being sent to the client
+type responseBuffer struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	modifiers []ResponseModifier
+}
+
+func (r *responseBuffer) WriteHeader(code int) {
+	r.status = code
+}
+
+func (r *responseBuffer) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// Flush is a no-op, the body is only sent after being rewritten
+func (r *responseBuffer) Flush() {}
+
+// ModifyResponse buffers the upstream response so that fn can rewrite it
+// FlushResponse must be called after the request was proxied to send the response to the client
+func ModifyResponse(c echo.Context, fn ResponseModifier) {
+	if rb, ok := c.Get("responseBuffer").(*responseBuffer); ok {
+		rb.modifiers = append(rb.modifiers, fn)
+		return
+	}
+
+	// We need a plain body to be able to rewrite it
+	c.Request().Header.Del("Accept-Encoding")
+
+	rb := &responseBuffer{
+		ResponseWriter: c.Response().Writer,
+		modifiers:      []ResponseModifier{fn},
+	}
+	c.Response().Writer = rb
+	c.Set("responseBuffer", rb)
+}
+
+// FlushResponse rewrites the buffered upstream response and sends it to the client
+// and waits for the responses rewritten by StreamResponse to be sent
+// It does nothing if the response was not buffered by ModifyResponse
+func FlushResponse(c echo.Context) error {
+	if err := closeStream(c); err != nil {
+		return err
+	}
+
+	rb, ok := c.Get("responseBuffer").(*responseBuffer)
+	if !ok {
+		return nil
+	}
+
+	c.Response().Writer = rb.ResponseWriter
+	c.Set("responseBuffer", nil)
+
+	if rb.status == 0 {
+		// Nothing was written, let the error handler write the response
+		c.Response().Committed = false
+		return nil
+	}
+
+	body := rb.body.Bytes()
+	if rb.status >= 200 && rb.status < 300 {
+		for _, fn := range rb.modifiers {
+			var err error
+			body, err = fn(body)
+			if err != nil {
+				c.Response().Committed = false
+				if he, ok := err.(*echo.HTTPError); ok {
+					return he
+				}
+				return echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("failed to process upstream response: %v", err))
+			}
+		}
+	}
+
+	header := c.Response().Header()
+	header.Del("Content-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	rb.ResponseWriter.WriteHeader(rb.status)
+	_, err := rb.ResponseWriter.Write(body)
+	return err
+}
+
+// FilterArray replaces the items of a JSON array by the result of fn
+// items are dropped when fn returns nil
+func FilterArray(body []byte, fn func(json.RawMessage) (json.RawMessage, error)) ([]byte, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+
+	visible := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		item, err := fn(item)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			visible = append(visible, item)
+		}
+	}
+
+	return json.Marshal(visible)
+}
@@ -0,0 +1,479 @@
+package stacks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v3"
+)
+
+// QueryPermitted reports whether a rule expression only touches data allowed to the groups
+// i.e. it enforces their LBAC matchers and only selects the metrics they allow
+type QueryPermitted func(query string, groups []config.Group) (bool, error)
+
+// QueryEnforcer rewrites a rule expression to enforce the LBAC matchers and the metric filters of the groups
+type QueryEnforcer func(query string, groups []config.Group) (string, error)
+
+// restricted reports whether the groups can not see every rule, i.e. they enforce LBAC matchers or metric filters
+func restricted(groups []config.Group) bool {
+	return len(Matchers(groups)) > 0 || HasMetricFilters(groups)
+}
+
+// HandleRulerConfig enforces LBAC on the ruler configuration API
+// GET    <prefix>/rules                     - list all rule groups
+// GET    <prefix>/rules/{namespace}         - list the rule groups of a namespace
+// GET    <prefix>/rules/{namespace}/{group} - get a single rule group
+// POST   <prefix>/rules/{namespace}         - create or update a rule group
+// DELETE <prefix>/rules/{namespace}[/{group}]
+// Writes are only allowed when the user can see every rule group they replace or delete
+// and are denied on undefined tenants
+func HandleRulerConfig(c echo.Context, prefix string, permitted QueryPermitted, enforce QueryEnforcer) error {
+	groups, ok, err := UserGroups(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if c.Request().Method != http.MethodGet {
+			// The ruler write role is set by tenant, undefined tenants have none
+			return echo.NewHTTPError(http.StatusForbidden, "rules can not be written on undefined tenants")
+		}
+		return nil
+	}
+
+	tenant, _ := Tenant(c)
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(c.Request().URL.Path, prefix), "/"), "/")
+	if segments[0] == "" {
+		segments = segments[:0]
+	}
+
+	switch c.Request().Method {
+	case http.MethodGet:
+		if !restricted(groups) {
+			// The user can see every rule
+			return nil
+		}
+
+		ModifyResponse(c, filterRuleGroups(permitted, groups, len(segments) == 2))
+		return nil
+
+	case http.MethodPost:
+		if !HasRole(c, tenant.Roles.RulerWrite) {
+			return echo.NewHTTPError(http.StatusForbidden, "missing role to write rules")
+		}
+		if len(segments) != 1 {
+			return echo.ErrBadRequest
+		}
+
+		return patchRuleGroup(c, prefix+"/"+segments[0], permitted, enforce, groups)
+
+	case http.MethodDelete:
+		if !HasRole(c, tenant.Roles.RulerWrite) {
+			return echo.NewHTTPError(http.StatusForbidden, "missing role to write rules")
+		}
+		if len(segments) != 1 && len(segments) != 2 {
+			return echo.ErrBadRequest
+		}
+
+		return checkExistingRules(c, prefix+"/"+strings.Join(segments, "/"), len(segments) == 2, permitted, groups)
+
+	default:
+		return echo.ErrMethodNotAllowed
+	}
+}
+
+// filterRuleGroups removes the rule groups that the user can not see from the YAML response
+func filterRuleGroups(permitted QueryPermitted, groups []config.Group, single bool) ResponseModifier {
+	return func(body []byte) ([]byte, error) {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(body, &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			return body, nil
+		}
+		root := doc.Content[0]
+
+		if single {
+			// <prefix>/rules/{namespace}/{group} returns a single rule group
+			ok, err := ruleGroupPermitted(root, permitted, groups)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, echo.ErrNotFound
+			}
+
+			return body, nil
+		}
+
+		// namespace: [rule groups...]
+		namespaces := make([]*yaml.Node, 0, len(root.Content))
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			ruleGroups := root.Content[i+1]
+
+			visible := make([]*yaml.Node, 0, len(ruleGroups.Content))
+			for _, group := range ruleGroups.Content {
+				ok, err := ruleGroupPermitted(group, permitted, groups)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					visible = append(visible, group)
+				}
+			}
+
+			if len(visible) > 0 {
+				ruleGroups.Content = visible
+				namespaces = append(namespaces, root.Content[i], ruleGroups)
+			}
+		}
+		root.Content = namespaces
+
+		return yaml.Marshal(&doc)
+	}
+}
+
+// ruleGroupPermitted reports whether every rule of the group is permitted
+func ruleGroupPermitted(group *yaml.Node, permitted QueryPermitted, groups []config.Group) (bool, error) {
+	for _, expr := range ruleExpressions(group) {
+		ok, err := permitted(expr.Value, groups)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// ruleExpressions returns the expr nodes of every rule in a rule group
+func ruleExpressions(group *yaml.Node) []*yaml.Node {
+	exprs := make([]*yaml.Node, 0)
+
+	rules := mappingValue(group, "rules")
+	if rules == nil {
+		return exprs
+	}
+
+	for _, rule := range rules.Content {
+		if expr := mappingValue(rule, "expr"); expr != nil {
+			exprs = append(exprs, expr)
+		}
+	}
+
+	return exprs
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// checkExistingRules looks up the rule groups at path and checks that the user can see all of them
+// Like the log deletion requests, users can only replace or delete the rule groups they could have created
+func checkExistingRules(c echo.Context, path string, single bool, permitted QueryPermitted, groups []config.Group) error {
+	if !restricted(groups) {
+		// The user can see every rule
+		return nil
+	}
+
+	body, err := Get(c, path, nil)
+	if errors.Is(err, ErrUpstreamNotFound) {
+		// Nothing is replaced or deleted
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to lookup rule groups")
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "invalid rule groups")
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+
+	ruleGroups := []*yaml.Node{root}
+	if !single {
+		// namespace: [rule groups...]
+		ruleGroups = ruleGroups[:0]
+		for i := 1; i < len(root.Content); i += 2 {
+			ruleGroups = append(ruleGroups, root.Content[i].Content...)
+		}
+	}
+
+	for _, group := range ruleGroups {
+		ok, err := ruleGroupPermitted(group, permitted, groups)
+		if err != nil || !ok {
+			return echo.NewHTTPError(http.StatusForbidden, "rule group queries data that you can not access")
+		}
+	}
+
+	return nil
+}
+
+// patchRuleGroup rewrites every rule expression of the rule group in the request body
+// namespace is the path of the namespace of the group, the group it replaces must be permitted
+func patchRuleGroup(c echo.Context, namespace string, permitted QueryPermitted, enforce QueryEnforcer, groups []config.Group) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(body, &doc); err != nil || len(doc.Content) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid rule group")
+	}
+	group := doc.Content[0]
+
+	if mappingValue(group, "source_tenants") != nil {
+		// Federated rule groups would query other tenants
+		return echo.NewHTTPError(http.StatusForbidden, "federated rule groups are not supported")
+	}
+
+	name := mappingValue(group, "name")
+	if name == nil || name.Value == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid rule group")
+	}
+	err = checkExistingRules(c, namespace+"/"+name.Value, true, permitted, groups)
+	if err != nil {
+		return err
+	}
+
+	for _, expr := range ruleExpressions(group) {
+		query, err := enforce(expr.Value, groups)
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			// e.g. a metric that is not allowed
+			return err
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid rule expression: %v", err))
+		}
+		expr.Value = query
+		expr.Style = 0
+	}
+
+	patched, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+
+	SetBody(c, patched)
+
+	return nil
+}
+
+// FilterPrometheusRules enforces LBAC on the Prometheus rules API (/api/v1/rules)
+func FilterPrometheusRules(c echo.Context, permitted QueryPermitted) error {
+	groups, ok, err := UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	if !restricted(groups) {
+		// The user can see every rule
+		return nil
+	}
+
+	ModifyResponse(c, func(body []byte) ([]byte, error) {
+		// {"status": "success", "data": {"groups": [{"name": "", "rules": [{"query": ""}]}]}}
+		return modifyData(body, "groups", func(group json.RawMessage) (bool, error) {
+			var rg struct {
+				Rules []struct {
+					Query string `json:"query"`
+				} `json:"rules"`
+			}
+			if err := json.Unmarshal(group, &rg); err != nil {
+				return false, err
+			}
+
+			for _, rule := range rg.Rules {
+				ok, err := permitted(rule.Query, groups)
+				if err != nil || !ok {
+					return false, err
+				}
+			}
+
+			return true, nil
+		})
+	})
+
+	return nil
+}
+
+// FilterPrometheusAlerts enforces LBAC on the Prometheus alerts API (/api/v1/alerts)
+// The alerts do not have the expression of their rule, with metric filters only the alerts
+// of the alerting rules of rulesPath that the user can see are returned
+func FilterPrometheusAlerts(c echo.Context, rulesPath string, permitted QueryPermitted) error {
+	groups, ok, err := UserGroups(c)
+	if err != nil || !ok {
+		return err
+	}
+
+	enforcedLabels := Matchers(groups)
+	if !restricted(groups) {
+		// The user can see every alert
+		return nil
+	}
+
+	var alertNames map[string]bool
+	if HasMetricFilters(groups) {
+		alertNames, err = permittedAlertNames(c, rulesPath, permitted, groups)
+		if err != nil {
+			return err
+		}
+	}
+
+	ModifyResponse(c, func(body []byte) ([]byte, error) {
+		// {"status": "success", "data": {"alerts": [{"labels": {}}]}}
+		return modifyData(body, "alerts", func(alert json.RawMessage) (bool, error) {
+			var a struct {
+				Labels map[string]string `json:"labels"`
+			}
+			if err := json.Unmarshal(alert, &a); err != nil {
+				return false, err
+			}
+
+			if alertNames != nil && !alertNames[a.Labels[labels.AlertName]] {
+				return false, nil
+			}
+
+			return LabelsMatch(a.Labels, enforcedLabels), nil
+		})
+	})
+
+	return nil
+}
+
+// permittedAlertNames looks up the alerting rules and returns the names whose every rule is permitted
+func permittedAlertNames(c echo.Context, rulesPath string, permitted QueryPermitted, groups []config.Group) (map[string]bool, error) {
+	body, err := Get(c, rulesPath, url.Values{"type": {"alert"}})
+	if err != nil {
+		log.Println(err)
+		return nil, echo.NewHTTPError(http.StatusBadGateway, "failed to lookup alerting rules")
+	}
+
+	// {"status": "success", "data": {"groups": [{"name": "", "rules": [{"name": "", "query": "", "type": "alerting"}]}]}}
+	var response struct {
+		Data struct {
+			Groups []struct {
+				Rules []struct {
+					Name  string `json:"name"`
+					Query string `json:"query"`
+					Type  string `json:"type"`
+				} `json:"rules"`
+			} `json:"groups"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadGateway, "invalid alerting rules")
+	}
+
+	names := make(map[string]bool)
+	for _, group := range response.Data.Groups {
+		for _, rule := range group.Rules {
+			if rule.Type != "alerting" {
+				continue
+			}
+
+			ok, err := permitted(rule.Query, groups)
+			if err != nil {
+				ok = false
+			}
+			// An alert name is hidden when any of its rules is not permitted
+			if seen, exists := names[rule.Name]; !exists || seen {
+				names[rule.Name] = ok
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// modifyData keeps the items of data.<key> in a Prometheus API response for which keep returns true
+func modifyData(body []byte, key string, keep func(json.RawMessage) (bool, error)) ([]byte, error) {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(response["data"], &data); err != nil {
+		return nil, err
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data[key], &items); err != nil {
+		return nil, err
+	}
+
+	visible := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		ok, err := keep(item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			visible = append(visible, item)
+		}
+	}
+
+	var err error
+	if data[key], err = json.Marshal(visible); err != nil {
+		return nil, err
+	}
+	if response["data"], err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(response)
+}
+
+// LabelsMatch reports whether the label set satisfies every matcher
+func LabelsMatch(lbls map[string]string, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls[m.Name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ContainsMatcher reports whether matchers has a matcher equal to m
+func ContainsMatcher(matchers []*labels.Matcher, m *labels.Matcher) bool {
+	return slices.ContainsFunc(matchers, func(o *labels.Matcher) bool {
+		return o.Name == m.Name && o.Type == m.Type && o.Value == m.Value
+	})
+}
+
+// SetBody replaces the request body that will be sent upstream
+func SetBody(c echo.Context, body []byte) {
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	c.Request().ContentLength = int64(len(body))
+	c.Request().Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
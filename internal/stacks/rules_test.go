@@ -0,0 +1,144 @@
+package stacks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const rulesPrefix = "/prometheus/config/v1/rules"
+
+func TestHandleRulerConfigWrites(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case rulesPrefix + "/ns-a":
+			fmt.Fprint(w, "ns-a:\n  - name: g1\n    rules:\n      - record: a\n        expr: up{team=\"a\"}\n")
+		case rulesPrefix + "/ns-a/g1":
+			fmt.Fprint(w, "name: g1\nrules:\n  - record: a\n    expr: up{team=\"a\"}\n")
+		case rulesPrefix + "/ns-b":
+			fmt.Fprint(w, "ns-b:\n  - name: g1\n    rules:\n      - record: b\n        expr: up{team=\"b\"}\n")
+		case rulesPrefix + "/ns-b/g1":
+			fmt.Fprint(w, "name: g1\nrules:\n  - record: b\n    expr: up{team=\"b\"}\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	destination := config.Destination{
+		Type:     config.StackMimir,
+		Upstream: upstream.URL,
+		Tenants: map[string]config.Tenant{
+			"t1": {
+				Mode:  config.ModeAllowList,
+				Roles: config.Roles{RulerWrite: "rules-admin"},
+				Groups: []config.Group{{
+					Name:     "team-a",
+					Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "team", "a")},
+				}},
+			},
+		},
+	}
+
+	permitted := func(query string, _ []config.Group) (bool, error) {
+		return strings.Contains(query, `team="a"`), nil
+	}
+	enforce := func(query string, _ []config.Group) (string, error) {
+		return query, nil
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"replace own group", http.MethodPost, "/ns-a", "name: g1\nrules:\n  - record: a\n    expr: up\n", http.StatusOK},
+		{"create group", http.MethodPost, "/ns-new", "name: g1\nrules:\n  - record: a\n    expr: up\n", http.StatusOK},
+		{"replace group of another team", http.MethodPost, "/ns-b", "name: g1\nrules:\n  - record: a\n    expr: up\n", http.StatusForbidden},
+		{"delete own group", http.MethodDelete, "/ns-a/g1", "", http.StatusOK},
+		{"delete own namespace", http.MethodDelete, "/ns-a", "", http.StatusOK},
+		{"delete missing namespace", http.MethodDelete, "/ns-new", "", http.StatusOK},
+		{"delete group of another team", http.MethodDelete, "/ns-b/g1", "", http.StatusForbidden},
+		{"delete namespace of another team", http.MethodDelete, "/ns-b", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, rulesPrefix+tt.path, strings.NewReader(tt.body))
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"t1"})
+			c.Set("groups", []string{"team-a"})
+			c.Set("roles", []string{"rules-admin"})
+
+			err := HandleRulerConfig(c, rulesPrefix, permitted, enforce)
+
+			status := http.StatusOK
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
+
+func TestHandleRulerConfigUndefinedTenant(t *testing.T) {
+	destination := config.Destination{
+		Type:           config.StackMimir,
+		Upstream:       "http://localhost:9009",
+		AllowUndefined: true,
+		Tenants:        map[string]config.Tenant{},
+	}
+
+	permitted := func(string, []config.Group) (bool, error) { return true, nil }
+	enforce := func(query string, _ []config.Group) (string, error) { return query, nil }
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "", "", http.StatusOK},
+		{http.MethodPost, "/ns", "name: g1\nrules:\n  - record: a\n    expr: up\n", http.StatusForbidden},
+		{http.MethodDelete, "/ns/g1", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, rulesPrefix+tt.path, strings.NewReader(tt.body))
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("destination", destination)
+			c.Set("tenantNames", []string{"undefined"})
+			c.Set("groups", []string{"team-a"})
+			c.Set("roles", []string{"rules-admin"})
+
+			err := HandleRulerConfig(c, rulesPrefix, permitted, enforce)
+
+			status := http.StatusOK
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
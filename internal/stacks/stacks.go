@@ -0,0 +1,208 @@
+package stacks
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/metrics"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Tenant returns the requested tenant configuration
+// The returned bool is false when the tenant is not defined
+func Tenant(c echo.Context) (config.Tenant, bool) {
+	destination := c.Get("destination").(config.Destination)
+	tenantNames := c.Get("tenantNames").([]string)
+
+	// We dont support multi tenant requests for now
+	tenant, ok := destination.Tenants[tenantNames[0]]
+	return tenant, ok
+}
+
+// HasRole reports whether the user has the role
+// An empty role is never granted
+func HasRole(c echo.Context, role string) bool {
+	if role == "" {
+		return false
+	}
+
+	roles, _ := c.Get("roles").([]string)
+	return slices.Contains(roles, role)
+}
+
+// UserGroups returns the groups of the requested tenant that the user is part of
+// The returned bool is false when the tenant is not defined but the destination
+// allows undefined tenants, in this case no LBAC rules should be enforced
+func UserGroups(c echo.Context) ([]config.Group, bool, error) {
+	destination := c.Get("destination").(config.Destination)
+
+	tenant, ok := Tenant(c)
+	if !ok {
+		if destination.AllowUndefined {
+			// Allow access if the tenant is not defined
+			return nil, false, nil
+		}
+		return nil, false, echo.ErrBadRequest
+	}
+
+	rules, _ := c.Get("rules").(*RuleResult)
+	userGroups := rules.Active(c.Get("groups").([]string))
+
+	groups := make([]config.Group, 0)
+	// A user can be part of multiple groups, so we need to check all of them
+	// and see if any of them match any of the groups in the tenant
+	for _, group := range tenant.Groups {
+		if slices.Contains(userGroups, group.Name) {
+			groups = append(groups, group)
+		}
+	}
+
+	if tenant.Mode == config.ModeAllowList {
+		// This tenant requires that the user is part of at least one of the groups
+		if len(groups) == 0 {
+			return nil, true, echo.ErrForbidden
+		}
+	} else {
+		// This tenant requires that the user is not part of any of the groups
+		if len(groups) > 0 {
+			return nil, true, echo.ErrForbidden
+		}
+	}
+
+	return rules.apply(groups), true, nil
+}
+
+// Matchers returns the LBAC matchers enforced by the groups
+func Matchers(groups []config.Group) []*labels.Matcher {
+	enforcedLabels := make([]*labels.Matcher, 0)
+	for _, group := range groups {
+		if len(group.Matchers) > 0 {
+			// if we get here, it means that the user is part of a group
+			// that has LBAC rules
+			enforcedLabels = append(enforcedLabels, group.Matchers...)
+		}
+	}
+
+	return enforcedLabels
+}
+
+// HiddenLabels returns the label names that the groups are not allowed to inspect
+func HiddenLabels(groups []config.Group) []string {
+	hidden := make([]string, 0)
+	for _, group := range groups {
+		for _, name := range group.HiddenLabels {
+			if !slices.Contains(hidden, name) {
+				hidden = append(hidden, name)
+			}
+		}
+	}
+
+	return hidden
+}
+
+// HasMetricFilters reports whether any of the groups restricts metric names
+func HasMetricFilters(groups []config.Group) bool {
+	for _, group := range groups {
+		if !group.Metrics.IsEmpty() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsMetric reports whether the metric name is allowed by every group
+// Like the LBAC matchers, the restrictions of all groups are combined
+func AllowsMetric(groups []config.Group, name string) bool {
+	for _, group := range groups {
+		if !group.Metrics.Allows(name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MetricMatchers returns the __name__ matchers that restrict a selector to the metrics allowed to every group
+func MetricMatchers(groups []config.Group) []*labels.Matcher {
+	matchers := make([]*labels.Matcher, 0)
+	for _, group := range groups {
+		matchers = append(matchers, group.Metrics.Matchers()...)
+	}
+
+	return matchers
+}
+
+// UnknownRoute is returned by the stacks for routes where LBAC can not be enforced
+// The request is only proxied if the destination explicitly allows the route to pass through
+func UnknownRoute(c echo.Context) error {
+	destination := c.Get("destination").(config.Destination)
+	path := c.Request().URL.Path
+
+	if destination.Routes.AllowsPassthrough(path) {
+		return nil
+	}
+
+	return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("route %s %s is not allowed", c.Request().Method, path))
+}
+
+// RouteOther is the route of the requests to routes unknown to the stack
+const RouteOther = "other"
+
+// RewriteFailed records a query that could not be parsed or rewritten
+func RewriteFailed(c echo.Context) {
+	destination := c.Get("destination").(config.Destination)
+	metrics.QueryRewriteFailures.WithLabelValues(string(destination.Type)).Inc()
+}
+
+// RuleResult is the outcome of the CEL rules of the tenant and of the groups of the user
+type RuleResult struct {
+	// Inactive are the groups of the user whose allow rules are not satisfied
+	Inactive []string
+	// GroupMatchers are enforced for the users of the group
+	GroupMatchers map[string][]*labels.Matcher
+	// Matchers are enforced by the tenant rules
+	Matchers []*labels.Matcher
+}
+
+// Active returns the groups whose allow rules are satisfied
+func (r *RuleResult) Active(groups []string) []string {
+	if r == nil {
+		return groups
+	}
+
+	return slices.DeleteFunc(slices.Clone(groups), func(group string) bool {
+		return slices.Contains(r.Inactive, group)
+	})
+}
+
+// apply adds the matchers of the rules to the groups
+func (r *RuleResult) apply(groups []config.Group) []config.Group {
+	if r == nil {
+		return groups
+	}
+
+	for i, group := range groups {
+		if m := r.GroupMatchers[group.Name]; len(m) > 0 {
+			group.Matchers = append(slices.Clone(group.Matchers), m...)
+			groups[i] = group
+		}
+	}
+
+	if len(r.Matchers) == 0 {
+		return groups
+	}
+
+	if len(groups) == 0 {
+		// The user is not part of any group, e.g. in a denylist tenant
+		return []config.Group{{Matchers: r.Matchers}}
+	}
+
+	// Matchers of every group are combined, adding them to one group is enough
+	groups[0].Matchers = append(slices.Clone(groups[0].Matchers), r.Matchers...)
+
+	return groups
+}
@@ -0,0 +1,252 @@
+package stacks
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ElementModifier rewrites an element of a JSON array of the upstream response
+// The element is dropped when nil is returned
+type ElementModifier func(element json.RawMessage) (json.RawMessage, error)
+
+type elementModifier struct {
+	path []string
+	fn   ElementModifier
+}
+
+// responseStream rewrites the upstream response while it is sent to the client
+type responseStream struct {
+	http.ResponseWriter
+	modifiers []elementModifier
+	status    int
+	pipe      *io.PipeWriter
+	done      chan error
+}
+
+func (r *responseStream) WriteHeader(code int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = code
+
+	if code >= 200 && code < 300 {
+		// The length of the rewritten body is unknown
+		r.Header().Del("Content-Length")
+		r.Header().Del("Content-Encoding")
+
+		reader, writer := io.Pipe()
+		r.pipe = writer
+		r.done = make(chan error, 1)
+		go func() {
+			err := rewriteJSON(r.ResponseWriter, reader, r.modifiers)
+			if err == nil {
+				// e.g. the trailing new line
+				_, err = io.Copy(io.Discard, reader)
+			}
+			// Unblock the proxy if the body could not be rewritten
+			reader.CloseWithError(err)
+			r.done <- err
+		}()
+	}
+
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseStream) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if r.pipe == nil {
+		return r.ResponseWriter.Write(b)
+	}
+
+	return r.pipe.Write(b)
+}
+
+// Flush is a no-op, the rewritten body is written as it is processed
+func (r *responseStream) Flush() {}
+
+// StreamResponse rewrites the elements of the JSON array at path of a successful upstream response
+// e.g. []string{"data", "result"} for the query APIs
+// The response is rewritten while it is sent to the client and only one element is held in memory at a time
+// FlushResponse must be called after the request was proxied to wait for the response to be sent
+func StreamResponse(c echo.Context, path []string, fn ElementModifier) {
+	modifier := elementModifier{path: path, fn: fn}
+
+	if rs, ok := c.Get("responseStream").(*responseStream); ok {
+		rs.modifiers = append(rs.modifiers, modifier)
+		return
+	}
+
+	// We need a plain body to be able to rewrite it
+	c.Request().Header.Del("Accept-Encoding")
+
+	rs := &responseStream{
+		ResponseWriter: c.Response().Writer,
+		modifiers:      []elementModifier{modifier},
+	}
+	c.Response().Writer = rs
+	c.Set("responseStream", rs)
+}
+
+// closeStream waits for the streamed response to be sent to the client
+func closeStream(c echo.Context) error {
+	rs, ok := c.Get("responseStream").(*responseStream)
+	if !ok {
+		return nil
+	}
+
+	c.Response().Writer = rs.ResponseWriter
+	c.Set("responseStream", nil)
+
+	if rs.status == 0 {
+		// Nothing was written, let the error handler write the response
+		c.Response().Committed = false
+		return nil
+	}
+
+	if rs.pipe == nil {
+		return nil
+	}
+
+	rs.pipe.Close()
+	err := <-rs.done
+	if err != nil {
+		// The status was already sent, the client gets a truncated response
+		return fmt.Errorf("failed to process upstream response: %w", err)
+	}
+
+	return nil
+}
+
+// rewriteJSON copies the JSON document from src to dst, rewriting the elements of the arrays of the modifiers
+func rewriteJSON(dst io.Writer, src io.Reader, modifiers []elementModifier) error {
+	decoder := json.NewDecoder(src)
+	decoder.UseNumber()
+	w := bufio.NewWriter(dst)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	err = copyJSON(decoder, w, token, nil, modifiers)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// copyJSON writes the JSON value that starts with token
+func copyJSON(decoder *json.Decoder, w *bufio.Writer, token json.Token, path []string, modifiers []elementModifier) error {
+	delim, ok := token.(json.Delim)
+	if !ok {
+		b, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
+	switch delim {
+	case '{':
+		w.WriteByte('{')
+		for i := 0; decoder.More(); i++ {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return errors.New("invalid object key")
+			}
+
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			b, _ := json.Marshal(name)
+			w.Write(b)
+			w.WriteByte(':')
+
+			value, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			err = copyJSON(decoder, w, value, append(slices.Clone(path), name), modifiers)
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte('}')
+
+	case '[':
+		fns := make([]ElementModifier, 0)
+		for _, m := range modifiers {
+			if slices.Equal(m.path, path) {
+				fns = append(fns, m.fn)
+			}
+		}
+
+		w.WriteByte('[')
+		written := 0
+		for decoder.More() {
+			if len(fns) == 0 {
+				value, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				if written > 0 {
+					w.WriteByte(',')
+				}
+				err = copyJSON(decoder, w, value, append(slices.Clone(path), "[]"), modifiers)
+				if err != nil {
+					return err
+				}
+				written++
+				continue
+			}
+
+			var element json.RawMessage
+			if err := decoder.Decode(&element); err != nil {
+				return err
+			}
+			for _, fn := range fns {
+				var err error
+				element, err = fn(element)
+				if err != nil {
+					return err
+				}
+				if element == nil {
+					break
+				}
+			}
+			if element == nil {
+				continue
+			}
+
+			if written > 0 {
+				w.WriteByte(',')
+			}
+			w.Write(element)
+			written++
+		}
+		w.WriteByte(']')
+
+	default:
+		return fmt.Errorf("unexpected %s", delim)
+	}
+
+	// Closing delimiter
+	_, err := decoder.Token()
+	return err
+}
@@ -0,0 +1,58 @@
+package stacks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// ErrUpstreamNotFound is returned by Get when the upstream does not have the requested resource
+var ErrUpstreamNotFound = errors.New("not found")
+
+// Get performs a GET request against the destination upstream on behalf of the user
+// The request is sent to the same tenant and carries the same headers as the original request
+func Get(c echo.Context, path string, query url.Values) ([]byte, error) {
+	destination := c.Get("destination").(config.Destination)
+
+	u, err := url.Parse(destination.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.Request().Header.Clone()
+	// Let the transport negotiate the encoding so we always get a plain body
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("upstream returned %s for %s: %w", resp.Status, path, ErrUpstreamNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s for %s", resp.Status, path)
+	}
+
+	return body, nil
+}
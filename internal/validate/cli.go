@@ -0,0 +1,46 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/urfave/cli/v3"
+)
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:      "validate",
+		Usage:     "Validate the configuration",
+		ArgsUsage: "[path]",
+		Action:    Validate,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to the configuration file or to a directory of configuration files",
+				Aliases: []string{"f"},
+				Sources: cli.EnvVars("CONFIG"),
+				Value:   "config.yaml",
+			},
+		},
+	}
+}
+
+func Validate(ctx context.Context, c *cli.Command) error {
+	path := c.String("config")
+	if c.Args().Present() {
+		path = c.Args().First()
+	}
+
+	problems := Check(path)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return cli.Exit(fmt.Sprintf("%d problem(s) found", len(problems)), 1)
+	}
+
+	fmt.Printf("%s is valid\n", path)
+
+	return nil
+}
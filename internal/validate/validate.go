@@ -0,0 +1,451 @@
+package validate
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/config"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/policy"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/loki"
+	"github.com/AndreZiviani/lgtmp-query-gateway/internal/stacks/mimir"
+	"gopkg.in/yaml.v3"
+)
+
+// groupSettings are the group settings that only apply to users granted access through the group
+var groupSettings = []string{"enforcedLabels", "hiddenLabels", "metrics", "limits", "costBudget", "forbidden", "redact", "maskLabels"}
+
+// Problem is an issue found in the configuration
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) report(file string, node *yaml.Node, format string, args ...any) {
+	v.problems = append(v.problems, Problem{
+		File:    file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Check returns the problems of the configuration at path
+func Check(path string) []Problem {
+	document, err := config.LoadDocument(path)
+	if err != nil {
+		// Conflicts between files already carry their position
+		return []Problem{{File: path, Message: err.Error()}}
+	}
+
+	v := &validator{}
+	root := document.Node.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		v.destination(document, root.Content[i], root.Content[i+1])
+	}
+
+	if len(v.problems) > 0 {
+		return v.problems
+	}
+
+	// Everything else, e.g. invalid durations
+	_, err = config.LoadConfig(path)
+	if err != nil {
+		return []Problem{{File: path, Message: err.Error()}}
+	}
+
+	return nil
+}
+
+func (v *validator) destination(document *config.Document, key, node *yaml.Node) {
+	host := key.Value
+	file := document.File(key)
+
+	// The settings of a destination can be defined in other files than the destination key
+	fileOf := func(key *yaml.Node) string {
+		if f := document.File(key); f != "" {
+			return f
+		}
+		return file
+	}
+
+	stack := config.StackType("")
+	typeKey, typeNode := lookup(node, "type")
+	switch {
+	case typeNode == nil:
+		v.report(file, key, "destination %q: missing type", host)
+	case !slices.Contains(config.StackTypes(), config.StackType(typeNode.Value)):
+		v.report(fileOf(typeKey), typeNode, "destination %q: unknown stack type %q, available options: %v",
+			host, typeNode.Value, config.StackTypes())
+	default:
+		stack = config.StackType(typeNode.Value)
+	}
+
+	upstreamKey, upstreamNode := lookup(node, "upstream")
+	if upstreamNode == nil {
+		v.report(file, key, "destination %q: missing upstream", host)
+	} else if err := checkURL(upstreamNode.Value); err != nil {
+		v.report(fileOf(upstreamKey), upstreamNode, "destination %q: invalid upstream: %v", host, err)
+	}
+
+	if authzKey, authz := lookup(node, "externalAuthz"); authz != nil {
+		v.externalAuthz(fileOf(authzKey), host, authz)
+	}
+
+	if limitsKey, limits := lookup(node, "rateLimiting"); limits != nil {
+		v.rateLimiting(fileOf(limitsKey), host, limits)
+	}
+
+	_, tenants := lookup(node, "tenants")
+	if tenants == nil {
+		return
+	}
+	for i := 0; i+1 < len(tenants.Content); i += 2 {
+		v.tenant(fileOf(tenants.Content[i]), host, stack, tenants.Content[i], tenants.Content[i+1])
+	}
+}
+
+func (v *validator) externalAuthz(file, host string, node *yaml.Node) {
+	_, urlNode := lookup(node, "url")
+	if urlNode == nil {
+		v.report(file, node, "destination %q: externalAuthz: missing url", host)
+	} else if err := checkURL(urlNode.Value); err != nil {
+		v.report(file, urlNode, "destination %q: externalAuthz: invalid url: %v", host, err)
+	}
+
+	_, mode := lookup(node, "failureMode")
+	if mode != nil && mode.Value != string(config.FailureModeOpen) && mode.Value != string(config.FailureModeClosed) {
+		v.report(file, mode, "destination %q: externalAuthz: unknown failure mode %q, available options: open, closed", host, mode.Value)
+	}
+}
+
+// rateLimiting checks the keys of the rate limits
+func (v *validator) rateLimiting(file, host string, node *yaml.Node) {
+	_, limits := lookup(node, "limits")
+	if limits == nil {
+		return
+	}
+
+	keys := []config.RateLimitKey{config.RateLimitUser, config.RateLimitGroup, config.RateLimitTenant}
+	for _, limit := range limits.Content {
+		_, key := lookup(limit, "key")
+		if key == nil {
+			v.report(file, limit, "destination %q: rateLimiting: limit without key", host)
+		} else if !slices.Contains(keys, config.RateLimitKey(key.Value)) {
+			v.report(file, key, "destination %q: rateLimiting: invalid key %q, available options: %v", host, key.Value, keys)
+		}
+	}
+}
+
+func (v *validator) tenant(file, host string, stack config.StackType, key, node *yaml.Node) {
+	tenant := key.Value
+
+	mode := config.Mode("")
+	_, modeNode := lookup(node, "mode")
+	switch {
+	case modeNode == nil:
+		v.report(file, key, "destination %q: tenant %q: missing mode", host, tenant)
+	case modeNode.Value != string(config.ModeAllowList) && modeNode.Value != string(config.ModeDenyList):
+		v.report(file, modeNode, "destination %q: tenant %q: invalid mode %q, available options: %v",
+			host, tenant, modeNode.Value, []config.Mode{config.ModeAllowList, config.ModeDenyList})
+	default:
+		mode = config.Mode(modeNode.Value)
+	}
+
+	_, rules := lookup(node, "rules")
+	v.rules(file, fmt.Sprintf("destination %q: tenant %q", host, tenant), stack, rules)
+
+	_, groups := lookup(node, "groups")
+	if groups == nil || len(groups.Content) == 0 {
+		if mode == config.ModeAllowList {
+			v.report(file, key, "destination %q: tenant %q: allowlist without groups denies every user", host, tenant)
+		}
+		return
+	}
+
+	if groups.Kind != yaml.SequenceNode {
+		v.report(file, groups, "destination %q: tenant %q: groups must be a list", host, tenant)
+		return
+	}
+
+	seen := map[string]*yaml.Node{}
+	for _, group := range groups.Content {
+		_, nameNode := lookup(group, "name")
+		if nameNode == nil || nameNode.Value == "" {
+			v.report(file, group, "destination %q: tenant %q: group without name", host, tenant)
+			continue
+		}
+		name := nameNode.Value
+
+		if previous, ok := seen[name]; ok {
+			v.report(file, nameNode, "destination %q: tenant %q: group %q is already defined at line %d",
+				host, tenant, name, previous.Line)
+		}
+		seen[name] = nameNode
+
+		if mode == config.ModeDenyList {
+			// Users of the groups of a denylist are denied, the group settings are never applied
+			for _, setting := range groupSettings {
+				if settingKey, _ := lookup(group, setting); settingKey != nil {
+					v.report(file, settingKey, "destination %q: tenant %q: group %q: %s is unreachable, users of the groups of a denylist tenant are denied",
+						host, tenant, name, setting)
+				}
+			}
+		}
+
+		_, rules := lookup(group, "rules")
+		v.rules(file, fmt.Sprintf("destination %q: tenant %q: group %q", host, tenant, name), stack, rules)
+
+		_, metrics := lookup(group, "metrics")
+		v.metrics(file, fmt.Sprintf("destination %q: tenant %q: group %q", host, tenant, name), metrics)
+
+		_, budget := lookup(group, "costBudget")
+		v.costBudget(file, fmt.Sprintf("destination %q: tenant %q: group %q", host, tenant, name), budget)
+
+		_, forbidden := lookup(group, "forbidden")
+		v.forbidden(file, fmt.Sprintf("destination %q: tenant %q: group %q", host, tenant, name), stack, forbidden)
+
+		maskKey, mask := lookup(group, "maskLabels")
+		v.maskLabels(file, fmt.Sprintf("destination %q: tenant %q: group %q", host, tenant, name), stack, maskKey, mask)
+
+		redactKey, redact := lookup(group, "redact")
+		v.redact(file, fmt.Sprintf("destination %q: tenant %q: group %q", host, tenant, name), stack, redactKey, redact)
+
+		_, matchers := lookup(group, "enforcedLabels")
+		if matchers == nil || stack == "" {
+			continue
+		}
+		for _, matcher := range matchers.Content {
+			if _, err := config.ParseMatchers(stack, matcher.Value); err != nil {
+				v.report(file, matcher, "destination %q: tenant %q: group %q: invalid %s matcher %q: %v",
+					host, tenant, name, language(stack), matcher.Value, err)
+			}
+		}
+	}
+}
+
+// metrics checks the metric name patterns of a group
+func (v *validator) metrics(file, prefix string, node *yaml.Node) {
+	if node == nil {
+		return
+	}
+
+	for _, list := range []string{"allow", "deny"} {
+		_, patterns := lookup(node, list)
+		if patterns == nil {
+			continue
+		}
+		for _, pattern := range patterns.Content {
+			if _, err := config.ParseMetricPattern(pattern.Value); err != nil {
+				v.report(file, pattern, "%s: metrics: %v", prefix, err)
+			}
+		}
+	}
+}
+
+// costBudget checks the action of a cost budget
+func (v *validator) costBudget(file, prefix string, node *yaml.Node) {
+	if node == nil {
+		return
+	}
+
+	_, action := lookup(node, "action")
+	if action != nil && action.Value != string(config.CostActionReject) && action.Value != string(config.CostActionWarn) {
+		v.report(file, action, "%s: costBudget: invalid action %q, available options: %v",
+			prefix, action.Value, []config.CostAction{config.CostActionReject, config.CostActionWarn})
+	}
+}
+
+// forbidden checks that the forbidden stages and functions exist in the query language of the stack
+func (v *validator) forbidden(file, prefix string, stack config.StackType, node *yaml.Node) {
+	if node == nil || stack == "" {
+		return
+	}
+
+	stagesKey, stages := lookup(node, "stages")
+	if stages != nil && stack != config.StackLoki {
+		v.report(file, stagesKey, "%s: forbidden stages only apply to LogQL queries", prefix)
+	} else if stages != nil {
+		for _, stage := range stages.Content {
+			if !slices.Contains(loki.Stages, stage.Value) {
+				v.report(file, stage, "%s: unknown LogQL stage %q, available options: %v", prefix, stage.Value, loki.Stages)
+			}
+		}
+	}
+
+	functionsKey, functions := lookup(node, "functions")
+	if functions != nil && language(stack) != "PromQL" {
+		v.report(file, functionsKey, "%s: forbidden functions only apply to PromQL queries", prefix)
+	} else if functions != nil {
+		for _, function := range functions.Content {
+			if !mimir.KnownFunction(function.Value) {
+				v.report(file, function, "%s: unknown PromQL function %q", prefix, function.Value)
+			}
+		}
+	}
+}
+
+// maskLabels checks the masking action of a group, labels are masked in LogQL and PromQL results
+func (v *validator) maskLabels(file, prefix string, stack config.StackType, key, node *yaml.Node) {
+	if node == nil {
+		return
+	}
+
+	if stack == config.StackTempo || stack == config.StackPyroscope {
+		v.report(file, key, "%s: maskLabels only applies to LogQL and PromQL results", prefix)
+		return
+	}
+
+	_, action := lookup(node, "action")
+	if action != nil && action.Value != string(config.MaskActionDrop) && action.Value != string(config.MaskActionHash) {
+		v.report(file, action, "%s: maskLabels: invalid action %q, available options: %v",
+			prefix, action.Value, []config.MaskAction{config.MaskActionDrop, config.MaskActionHash})
+	}
+
+	requireKey, require := lookup(node, "requireAggregation")
+	if require != nil && require.Value == "true" && stack != "" && language(stack) != "PromQL" {
+		v.report(file, requireKey, "%s: maskLabels: requireAggregation only applies to PromQL queries", prefix)
+	}
+}
+
+// redact checks the redactions of a group, they only apply to LogQL streams
+func (v *validator) redact(file, prefix string, stack config.StackType, key, node *yaml.Node) {
+	if node == nil {
+		return
+	}
+
+	if stack != "" && stack != config.StackLoki {
+		v.report(file, key, "%s: redact only applies to LogQL streams", prefix)
+		return
+	}
+
+	if node.Kind != yaml.SequenceNode {
+		v.report(file, node, "%s: redact must be a list", prefix)
+		return
+	}
+
+	for i, item := range node.Content {
+		var redaction config.Redaction
+		if err := item.Decode(&redaction); err != nil {
+			v.report(file, item, "%s: redaction %d: %v", prefix, i, err)
+			continue
+		}
+		if err := redaction.Compile(); err != nil {
+			v.report(file, item, "%s: redaction %d: %v", prefix, i, err)
+		}
+	}
+}
+
+// rules checks the CEL expressions, effects and matchers of a list of rules
+func (v *validator) rules(file, prefix string, stack config.StackType, node *yaml.Node) {
+	if node == nil {
+		return
+	}
+
+	if node.Kind != yaml.SequenceNode {
+		v.report(file, node, "%s: rules must be a list", prefix)
+		return
+	}
+
+	for _, rule := range node.Content {
+		_, nameNode := lookup(rule, "name")
+		if nameNode == nil || nameNode.Value == "" {
+			v.report(file, rule, "%s: rule without name", prefix)
+			continue
+		}
+		name := nameNode.Value
+
+		_, effect := lookup(rule, "effect")
+		if effect != nil && effect.Value != string(config.RuleEffectAllow) && effect.Value != string(config.RuleEffectDeny) {
+			v.report(file, effect, "%s: rule %q: invalid effect %q, available options: %v",
+				prefix, name, effect.Value, []config.RuleEffect{config.RuleEffectAllow, config.RuleEffectDeny})
+		}
+
+		_, matchers := lookup(rule, "enforcedLabels")
+		if effect == nil && (matchers == nil || len(matchers.Content) == 0) {
+			v.report(file, rule, "%s: rule %q: a rule without effect must have enforcedLabels", prefix, name)
+		}
+
+		_, expression := lookup(rule, "expression")
+		if expression == nil {
+			v.report(file, rule, "%s: rule %q: missing expression", prefix, name)
+		} else if _, err := policy.Compile(expression.Value); err != nil {
+			v.report(file, expression, "%s: rule %q: invalid expression: %v", prefix, name, err)
+		}
+
+		if matchers == nil || stack == "" {
+			continue
+		}
+		for _, matcher := range matchers.Content {
+			if _, err := config.ParseMatchers(stack, matcher.Value); err != nil {
+				v.report(file, matcher, "%s: rule %q: invalid %s matcher %q: %v",
+					prefix, name, language(stack), matcher.Value, err)
+			}
+		}
+	}
+}
+
+// lookup returns the key and value nodes of a mapping
+func lookup(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value := node.Content[i+1]
+			for value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+			return node.Content[i], value
+		}
+	}
+
+	return nil, nil
+}
+
+func checkURL(upstream string) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+
+	return nil
+}
+
+// language returns the query language of the stack
+func language(stack config.StackType) string {
+	switch stack {
+	case config.StackLoki:
+		return "LogQL"
+	case config.StackTempo:
+		return "TraceQL"
+	default:
+		return "PromQL"
+	}
+}
@@ -0,0 +1,81 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		problems []string
+	}{
+		{
+			name: "valid",
+			config: `
+"localhost:9000":
+  type: loki
+  upstream: http://localhost:3100
+  rateLimiting:
+    limits:
+      - key: group
+        maxConcurrent: 2
+  tenants:
+    t1:
+      mode: allowlist
+      groups:
+        - name: team-a
+          costBudget:
+            max: 100
+            action: reject
+`,
+		},
+		{
+			name: "invalid settings",
+			config: `
+"localhost:9000":
+  type: loki
+  upstream: http://localhost:3100
+  rateLimiting:
+    limits:
+      - key: bogus
+        rate: 10
+  tenants:
+    t1:
+      mode: allowlist
+      groups:
+        - name: team-a
+          costBudget:
+            max: 100
+            action: explode
+`,
+			problems: []string{
+				`config.yaml:7:14: destination "localhost:9000": rateLimiting: invalid key "bogus"`,
+				`config.yaml:16:21: destination "localhost:9000": tenant "t1": group "team-a": costBudget: invalid action "explode"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			problems := Check(path)
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("got problems %v, want %d", problems, len(tt.problems))
+			}
+			for i, problem := range problems {
+				got := strings.TrimPrefix(problem.String(), filepath.Dir(path)+string(filepath.Separator))
+				if !strings.HasPrefix(got, tt.problems[i]) {
+					t.Errorf("got %q, want %q", got, tt.problems[i])
+				}
+			}
+		})
+	}
+}